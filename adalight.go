@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tarm/serial"
+	"image/color"
+	"io"
+)
+
+const DefaultAdalightBaud = 115200
+
+// SerialConfig describes serial transport of the device.
+type SerialConfig struct {
+	Device string `json:"device"`
+	Baud   int    `json:"baud,omitempty"`
+}
+
+// AdalightLed drives leds connected to a controller speaking Adalight protocol,
+// typically an Arduino connected over USB serial.
+type AdalightLed struct {
+	w     io.WriteCloser
+	count int
+	buf   []byte
+}
+
+// NewAdalightLed creates driver writing frames into w.
+func NewAdalightLed(w io.WriteCloser, amountOfLeds int) (*AdalightLed, error) {
+	if amountOfLeds <= 0 || amountOfLeds > 1<<16 {
+		return nil, fmt.Errorf("amount of leds should be within 1-%d range", 1<<16)
+	}
+	led := &AdalightLed{w: w, count: amountOfLeds}
+	led.buf = make([]byte, 6+amountOfLeds*3)
+	copy(led.buf, adalightHeader(amountOfLeds))
+	return led, nil
+}
+
+// OpenAdalightLed opens serial device and creates driver writing to it.
+func OpenAdalightLed(c *SerialConfig, amountOfLeds int) (*AdalightLed, error) {
+	baud := c.Baud
+	if baud <= 0 {
+		baud = DefaultAdalightBaud
+	}
+	port, err := serial.OpenPort(&serial.Config{Name: c.Device, Baud: baud})
+	if err != nil {
+		return nil, err
+	}
+	led, err := NewAdalightLed(port, amountOfLeds)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	return led, nil
+}
+
+// adalightHeader returns frame header: magic word "Ada", amount of leds
+// minus one as big-endian 16-bit number and checksum of both count bytes.
+func adalightHeader(amountOfLeds int) []byte {
+	hi, lo := byte((amountOfLeds-1)>>8), byte(amountOfLeds-1)
+	return []byte{'A', 'd', 'a', hi, lo, hi ^ lo ^ 0x55}
+}
+
+func (led *AdalightLed) Len() int {
+	return led.count
+}
+
+// Write sends single frame with colors of all leds.
+func (led *AdalightLed) Write(colors []color.RGBA) error {
+	if len(colors) > led.count {
+		return fmt.Errorf("received %d colors for %d leds", len(colors), led.count)
+	}
+	data := led.buf[6:]
+	for i, c := range colors {
+		data[i*3] = c.R
+		data[i*3+1] = c.G
+		data[i*3+2] = c.B
+	}
+	_, err := led.w.Write(led.buf)
+	return err
+}
+
+func (led *AdalightLed) Close() error {
+	return led.w.Close()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestAdalightFrame(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		count  int
+		colors []color.RGBA
+		want   []byte
+	}{
+		{
+			name:   "single led",
+			count:  1,
+			colors: []color.RGBA{{1, 2, 3, 255}},
+			want:   []byte{'A', 'd', 'a', 0, 0, 0x55, 1, 2, 3},
+		},
+		{
+			name:   "two leds",
+			count:  2,
+			colors: []color.RGBA{{255, 0, 0, 255}, {0, 128, 255, 0}},
+			want:   []byte{'A', 'd', 'a', 0, 1, 0x54, 255, 0, 0, 0, 128, 255},
+		},
+		{
+			name:   "fewer colors leave leds black",
+			count:  3,
+			colors: []color.RGBA{{9, 8, 7, 255}},
+			want:   []byte{'A', 'd', 'a', 0, 2, 0x57, 9, 8, 7, 0, 0, 0, 0, 0, 0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bufferCloser
+			led, err := NewAdalightLed(&buf, tc.count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := led.Write(tc.colors); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), tc.want) {
+				t.Errorf("frame is %v, want %v", buf.Bytes(), tc.want)
+			}
+		})
+	}
+}
+
+func TestAdalightHeader(t *testing.T) {
+	for _, tc := range []struct {
+		count int
+		want  []byte
+	}{
+		// count is sent minus one, high byte first
+		{256, []byte{'A', 'd', 'a', 0x00, 0xff, 0xaa}},
+		{257, []byte{'A', 'd', 'a', 0x01, 0x00, 0x54}},
+		{300, []byte{'A', 'd', 'a', 0x01, 0x2b, 0x7f}},
+		{1 << 16, []byte{'A', 'd', 'a', 0xff, 0xff, 0x55}},
+	} {
+		if got := adalightHeader(tc.count); !bytes.Equal(got, tc.want) {
+			t.Errorf("header for %d leds is %v, want %v", tc.count, got, tc.want)
+		}
+	}
+}
+
+func TestAdalightRejects(t *testing.T) {
+	for _, count := range []int{0, -1, 1<<16 + 1} {
+		if _, err := NewAdalightLed(&bufferCloser{}, count); err == nil {
+			t.Errorf("%d leds accepted", count)
+		}
+	}
+	var buf bufferCloser
+	led, err := NewAdalightLed(&buf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := led.Write(make([]color.RGBA, 2)); err == nil {
+		t.Error("more colors than leds accepted")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("rejected frame was written: %v", buf.Bytes())
+	}
+	if err := led.Close(); err != nil || !buf.closed {
+		t.Errorf("device wasn't closed: %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/technomancers/piCamera"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// decodeFrame decodes jpeg camera frame into RGBA image.
+func decodeFrame(b []byte) (*image.RGBA, error) {
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba, nil
+	}
+	bd := img.Bounds()
+	rgba := image.NewRGBA(bd)
+	draw.Draw(rgba, bd, img, bd.Min, draw.Src)
+	return rgba, nil
+}
+
+// regionColor returns average color of the frame area. Squared channel values
+// are averaged, so bright areas are not washed out by dark ones.
+func regionColor(frame *image.RGBA, rect image.Rectangle) color.RGBA {
+	rect = rect.Intersect(frame.Rect)
+	totalPixels := rect.Dx() * rect.Dy()
+	if totalPixels == 0 {
+		return color.RGBA{A: 255}
+	}
+	var sumR, sumG, sumB int
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			col := frame.RGBAAt(x, y)
+			sumR += int(col.R) * int(col.R)
+			sumG += int(col.G) * int(col.G)
+			sumB += int(col.B) * int(col.B)
+		}
+	}
+	return color.RGBA{
+		R: uint8(math.Sqrt(float64(sumR / totalPixels))),
+		G: uint8(math.Sqrt(float64(sumG / totalPixels))),
+		B: uint8(math.Sqrt(float64(sumB / totalPixels))),
+		A: 255,
+	}
+}
+
+// frameColors computes color of each led from the camera frame.
+func frameColors(frame *image.RGBA, regions []*image.Rectangle, colors []color.RGBA) {
+	for i, r := range regions {
+		colors[i] = regionColor(frame, *r)
+	}
+}
+
+// smoothColors blends colors with the previous ones kept in state, smoothing is the weight of the previous colors.
+func smoothColors(colors []color.RGBA, state [][3]float64, smoothing float64) {
+	for i, c := range colors {
+		cur := [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+		for j := range cur {
+			state[i][j] = state[i][j]*smoothing + cur[j]*(1-smoothing)
+		}
+		colors[i] = color.RGBA{
+			R: uint8(math.Round(state[i][0])),
+			G: uint8(math.Round(state[i][1])),
+			B: uint8(math.Round(state[i][2])),
+			A: 255,
+		}
+	}
+}
+
+// runAmbilight captures camera frames and updates the source with colors of the screen edges until the context is done.
+// Settings holds *frameSettings, they're loaded for each frame so config changes apply to the next one.
+func runAmbilight(ctx context.Context, cam *piCamera.PiCamera, settings *atomic.Value, source *FrameSource, screen *ScreenDetector, p *Pipeline) {
+	var colors []color.RGBA
+	var smoothed [][3]float64
+	for ctx.Err() == nil {
+		b, err := cam.GetFrame()
+		if err != nil {
+			if ctx.Err() != nil {
+				// the camera was stopped
+				return
+			}
+			metrics.CameraError()
+			cameraLog.Error("reading frame failed", "err", err)
+			time.Sleep(time.Duration(1) * time.Second)
+			continue
+		}
+		captured := time.Now()
+		metrics.FrameCaptured(captured)
+		frame, err := decodeFrame(b)
+		decoded := time.Now()
+		metrics.FrameDecoded(decoded.Sub(captured))
+		if err != nil {
+			metrics.FrameDropped()
+			cameraLog.Warn("decoding frame failed", "err", err)
+			continue
+		}
+		s := settings.Load().(*frameSettings)
+		if len(colors) != len(s.regions) {
+			colors = make([]color.RGBA, len(s.regions))
+		}
+		frameColors(frame, s.regions, colors)
+		if s.correction != nil {
+			s.correction.ApplyAll(colors)
+		}
+		if s.smoothing == 0 {
+			smoothed = nil
+		} else {
+			if len(smoothed) != len(colors) {
+				smoothed = make([][3]float64, len(colors))
+				smoothColors(colors, smoothed, 0)
+			}
+			smoothColors(colors, smoothed, s.smoothing)
+		}
+		// colors replaced before the pipeline rendered them never reach the leds
+		if source.Update(colors, captured) {
+			if active := p.Active(); active != nil && active.Source == Source(source) {
+				metrics.FrameDropped()
+			}
+		}
+		screen.Update(frame, captured)
+		metrics.FrameAnalyzed(time.Since(decoded))
+		p.Invalidate()
+	}
+}
+
+// AmbilightOptions control behaviour of the run command.
+type AmbilightOptions struct {
+	ShutdownTimeout time.Duration
+	WatchdogTimeout time.Duration
+	FadeOut         time.Duration
+	// HyperionAddr is an address of Hyperion JSON server, empty disables the server.
+	HyperionAddr string
+	// HTTPAddr is an address of the http api, empty disables the api.
+	HTTPAddr string
+	// Transition is a duration of the crossfade when the light mode changes.
+	Transition time.Duration
+}
+
+// startAmbilight runs until the application is stopped. Changes of the config file and the config api
+// are applied while running.
+func startAmbilight(opts AmbilightOptions) error {
+	lc := NewLifecycle(opts.ShutdownTimeout)
+	defer func() {
+		if err := lc.Shutdown(); err != nil {
+			mainLog.Error("shutdown failed", "err", err)
+		}
+	}()
+	active, err := Conf.WithProfile(Conf.Profile)
+	if err != nil {
+		return err
+	}
+	count := active.LedLayout().Count()
+	outputs, err := OpenOutputs(active.LedOutputs(), count)
+	if err != nil {
+		return err
+	}
+	pipeline := NewPipeline(count, outputs)
+	a := &ambilight{lc: lc, pipeline: pipeline}
+	a.active.Store(active)
+	a.settings.Store(newFrameSettings(active))
+	source := NewFrameSource(count)
+	a.screen = NewScreenDetector(active.ScreenOffSettings(), active.CameraQuad(), pipeline)
+	a.capture = &capture{run: func(ctx context.Context, cam *piCamera.PiCamera) {
+		runAmbilight(ctx, cam, &a.settings, source, a.screen, pipeline)
+	}}
+	pipelineDone := make(chan struct{})
+	lc.OnShutdown("capture", func(ctx context.Context) error {
+		a.capture.Stop()
+		return nil
+	})
+	lc.OnShutdown("leds", func(ctx context.Context) error {
+		select {
+		case <-pipelineDone:
+		case <-ctx.Done():
+		}
+		// outputs may have been replaced by a config change
+		outputs := pipeline.Outputs()
+		err := outputs.FadeOut(ctx, pipeline.Last(), opts.FadeOut)
+		return joinErrors([]error{err, outputs.Close()})
+	})
+	if err := a.capture.Start(lc.Context(), active.CameraSettings()); err != nil {
+		close(pipelineDone)
+		return err
+	}
+	effects := DefaultEffects()
+	if opts.HyperionAddr != "" {
+		a.hyperion = NewHyperionServer(pipeline, func(img *image.RGBA) Source {
+			c := a.Active()
+			return NewImageSource(img, c.LedLayout(), c.ScreenWidth, c.Depth())
+		})
+		a.hyperion.Effects = effects
+		a.hyperion.SetImageDelay(time.Duration(active.ImageDelay) * time.Millisecond)
+		if err := serveHyperion(lc, opts.HyperionAddr, a.hyperion); err != nil {
+			close(pipelineDone)
+			return err
+		}
+	}
+	a.light = NewLight(pipeline, effects)
+	a.light.Transition = opts.Transition
+	if u, ok := active.Light.update(nil); ok {
+		immediate := time.Duration(0)
+		u.Transition = &immediate
+		if err := a.light.Update(u); err != nil {
+			close(pipelineDone)
+			return fmt.Errorf("light: %s", err)
+		}
+	}
+	if opts.HTTPAddr != "" {
+		handleLightAPI(http.DefaultServeMux, a.light, effects)
+		handleConfigAPI(http.DefaultServeMux, a)
+		handleProfileAPI(http.DefaultServeMux, a)
+		handleCameraAPI(http.DefaultServeMux, a)
+		handleScreenAPI(http.DefaultServeMux, a.screen)
+		handleMetrics(http.DefaultServeMux, pipeline, a.light, a.screen)
+		serveHTTP(lc, opts.HTTPAddr)
+	}
+	a.watchMQTT()
+	if err := a.startMQTT(active.MQTT); err != nil {
+		close(pipelineDone)
+		return err
+	}
+	lc.OnShutdown("mqtt", func(ctx context.Context) error {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.stopMQTT()
+		return nil
+	})
+	if err := a.watchConfig(lc.Context()); err != nil {
+		mainLog.Warn("config changes won't be applied until restart", "err", err)
+	}
+	pipeline.SetSource(PriorityCamera, "camera", source, 0)
+	wd := NewWatchdog(opts.WatchdogTimeout, func() {
+		ledLog.Warn("output stalled, blanking leds", "timeout", opts.WatchdogTimeout)
+		if err := pipeline.Outputs().Blank(pipeline.Count()); err != nil {
+			ledLog.Error("blanking leds failed", "err", err)
+		}
+	})
+	pipeline.OnWrite = wd.Kick
+	go wd.Run(lc.Context())
+	go reportPowerLimits(lc.Context(), pipeline)
+	fmt.Printf("Driving %d leds on %d outputs with %s profile\n", count, len(outputs), Conf.ActiveProfile())
+	go func() {
+		defer close(pipelineDone)
+		pipeline.Run(lc.Context())
+	}()
+	<-lc.Context().Done()
+	return nil
+}
+
+// reportPowerLimits periodically logs how often power limiting was applied.
+func reportPowerLimits(ctx context.Context, p *Pipeline) {
+	report := time.NewTicker(time.Minute)
+	defer report.Stop()
+	powerStats := make(map[string][2]uint64)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-report.C:
+			p.Outputs().reportPowerLimits(powerStats)
+		}
+	}
+}
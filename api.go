@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// lightRequest is a body of the light update, all fields are optional.
+type lightRequest struct {
+	On         *bool           `json:"on"`
+	Brightness *uint8          `json:"brightness"`
+	Color      *effectColor    `json:"color"`
+	Effect     *string         `json:"effect"`
+	Args       json.RawMessage `json:"args"`
+	// Transition is a duration of the crossfade in seconds.
+	Transition *float64 `json:"transition"`
+}
+
+type effectInfo struct {
+	Name   string        `json:"name"`
+	Params []EffectParam `json:"params"`
+}
+
+// handleLightAPI registers http handlers controlling the light.
+func handleLightAPI(mux *http.ServeMux, light *Light, effects EffectRegistry) {
+	mux.HandleFunc("/api/light", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var req lightRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+				return
+			}
+			u := LightUpdate{On: req.On, Brightness: req.Brightness, Effect: req.Effect, Args: req.Args}
+			if req.Color != nil {
+				c := req.Color.RGBA()
+				u.Color = &c
+			}
+			if req.Transition != nil {
+				if *req.Transition < 0 {
+					writeAPIError(w, http.StatusBadRequest, fmt.Errorf("transition can't be negative"))
+					return
+				}
+				d := time.Duration(*req.Transition * float64(time.Second))
+				u.Transition = &d
+			}
+			if err := light.Update(u); err != nil {
+				writeAPIError(w, http.StatusBadRequest, err)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		writeJSON(w, http.StatusOK, lightResponse(light.State()))
+	})
+	mux.HandleFunc("/api/effects", func(w http.ResponseWriter, r *http.Request) {
+		infos := []effectInfo{{Name: EffectAmbilight, Params: []EffectParam{}}}
+		for _, name := range effects.EffectNames() {
+			infos = append(infos, effectInfo{Name: name, Params: effects.Params(name)})
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+}
+
+func lightResponse(s LightState) interface{} {
+	return struct {
+		On         bool            `json:"on"`
+		Brightness uint8           `json:"brightness"`
+		Color      effectColor     `json:"color"`
+		Effect     string          `json:"effect"`
+		Args       json.RawMessage `json:"args,omitempty"`
+	}{s.On, s.Brightness, effectColor{s.Color.R, s.Color.G, s.Color.B}, s.Effect, s.Args}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// handleCameraAPI registers http handler reading and changing camera settings.
+// Changed settings are applied by restarting only the camera and stored in the config file.
+func handleCameraAPI(mux *http.ServeMux, a *ambilight) {
+	mux.HandleFunc("/api/camera", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, currentConfig().CameraSettings())
+		case http.MethodPut:
+			c, err := currentConfig().Clone()
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, err)
+				return
+			}
+			camera := c.CameraSettings()
+			if err := json.NewDecoder(r.Body).Decode(&camera); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+				return
+			}
+			if err := camera.Validate(); err != nil {
+				writeAPIError(w, http.StatusBadRequest, err)
+				return
+			}
+			c.Camera = &camera
+			if !updateConfig(w, a, c) {
+				return
+			}
+			writeJSON(w, http.StatusOK, camera)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+	})
+}
+
+// handleConfigAPI registers http handler reading and changing the whole config. Fields missing
+// in the request keep their values, the change is applied while running and stored in the config file.
+func handleConfigAPI(mux *http.ServeMux, a *ambilight) {
+	mux.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, currentConfig())
+		case http.MethodPut:
+			c, err := currentConfig().Clone()
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := json.NewDecoder(r.Body).Decode(c); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+				return
+			}
+			if c.Version != ConfigVersion {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("version %d doesn't match config version %d", c.Version, ConfigVersion))
+				return
+			}
+			if !updateConfig(w, a, c) {
+				return
+			}
+			writeJSON(w, http.StatusOK, c)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+	})
+}
+
+// updateConfig applies and stores the config, the error response is written when it fails.
+func updateConfig(w http.ResponseWriter, a *ambilight, c *Config) bool {
+	if err := a.Apply(c); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return false
+	}
+	if err := c.Write(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	return true
+}
@@ -2,16 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/jpeg"
-	"log"
+	"io/ioutil"
+	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
-//var calibrationRects = calculateLedAreas(leds[AxisX], leds[AxisY], ScreenWidth, ScreenHeight, 300)
 //var screens = generateScreens()
 
 type CalibrationJpegImage struct {
@@ -35,16 +38,12 @@ func NewCalibrationJpegImage(index int, bytes []byte) *CalibrationJpegImage {
 }
 
 func fillRGBARect(img *image.RGBA, rect *image.Rectangle, color color.Color) {
-	for x := rect.Min.X; x < rect.Max.X; x++ {
-		for y := rect.Min.Y; y < rect.Max.Y; y++ {
-			img.Set(x, y, color)
-		}
-	}
+	draw.Draw(img, *rect, &image.Uniform{color}, image.Point{}, draw.Src)
 }
 
 func generateCalibrationImages(buffer chan<- *CalibrationJpegImage, c *Config) {
 	var wg sync.WaitGroup
-	rects := calculateLedAreas(c.LedsX, c.LedsY, c.ScreenWidth, c.ScreenHeight, 300)
+	rects := c.LedLayout().ScreenRegions(c.ScreenWidth, c.ScreenHeight, c.Depth())
 	for i, rect := range rects {
 		wg.Add(1)
 		go func(i int, rect *image.Rectangle) {
@@ -52,7 +51,7 @@ func generateCalibrationImages(buffer chan<- *CalibrationJpegImage, c *Config) {
 			rgba := image.NewRGBA(image.Rect(0, 0, c.ScreenWidth, c.ScreenHeight))
 			b, err := createJpegWithFilledArea(rgba, rect, color.White)
 			if err != nil {
-				log.Printf("error occurred: %q", err)
+				calibratorLog.Error("generating calibration screen failed", "led", i, "err", err)
 				return
 			}
 			buffer <- NewCalibrationJpegImage(i, b)
@@ -64,6 +63,59 @@ func generateCalibrationImages(buffer chan<- *CalibrationJpegImage, c *Config) {
 	}()
 }
 
+// colorSettleTime is time between showing a color and capturing it, so the screen and camera catch up.
+const colorSettleTime = 500 * time.Millisecond
+
+// calibrator shows patterns on the calibration display and captures them by the camera.
+type calibrator struct {
+	display CalibrationDisplay
+	frames  *frameBuffer
+	quad    Quad
+	// handshake enables the marker, patterns are captured once the camera sees it.
+	handshake bool
+	// timeout of waiting for the marker before the pattern is shown again.
+	timeout time.Duration
+	// sequence is code of the last pattern shown with the marker.
+	sequence int
+}
+
+// newCalibrator returns calibrator of the served calibration display and the camera frames.
+func newCalibrator(handshake bool) *calibrator {
+	return &calibrator{
+		display:   calibrationDisplay,
+		frames:    cameraFrames,
+		quad:      Conf.CameraQuad(),
+		handshake: handshake,
+		timeout:   markerTimeout,
+	}
+}
+
+// captureScreenColor shows the color full screen and returns camera frame captured after settle time.
+func (c *calibrator) captureScreenColor(ctx context.Context, col color.RGBA, settle time.Duration) (*image.RGBA, error) {
+	return c.capturePattern(ctx, ColorPattern(col), settle)
+}
+
+// capturePattern shows the pattern on the calibration page and returns camera frame captured after settle time.
+// With the handshake the marker proves the screen caught up, so only the time beyond colorSettleTime is waited.
+func (c *calibrator) capturePattern(ctx context.Context, p Pattern, settle time.Duration) (*image.RGBA, error) {
+	if c.handshake {
+		return c.showWithHandshake(ctx, p, settle-colorSettleTime)
+	}
+	if err := c.display.Show(ctx, p); err != nil {
+		return nil, err
+	}
+	select {
+	case <-time.After(settle):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	frame, err := c.frames.Next(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return decodeFrame(frame)
+}
+
 func createJpegWithFilledArea(rgba *image.RGBA, area *image.Rectangle, color color.Color) ([]byte, error) {
 	partial := rgba.SubImage(*area).(*image.RGBA)
 	draw.Draw(partial, partial.Bounds(), image.White, area.Min, draw.Src)
@@ -76,145 +128,247 @@ func createJpegWithFilledArea(rgba *image.RGBA, area *image.Rectangle, color col
 	return buffer.Bytes(), nil
 }
 
-func calibrate() {
-	time.Sleep(time.Duration(5000) * time.Millisecond)
-	// calculate position for each led within the screen
-	// render image marking led position in white for each led
-	// analyse camera image to determine led position within the camera
-	//rgba := image.NewRGBA(image.Rect(0, 0, ScreenWidth, ScreenHeight))
-	areas := make([][]image.Point, 96)
-	//draw.Draw(rgba, rgba.Bounds(), image.Black, image.ZP, draw.Src)
-	//white := color.RGBA{255, 255, 255, 255}
-	//black := color.RGBA{255, 255, 255, 255}
-	/*for _, rect := range calibrationRects {
-		//square := rgba.SubImage(rect).(*image.RGBA)
-		//draw.Draw(square, square.Bounds(), image.White, rect.Min, draw.Src)
-		fillRGBARect(rgba, rect, color.White)
-
-		buffer := new(bytes.Buffer)
-		err := jpeg.Encode(buffer, rgba, nil)
-		if err != nil {
-			log.Printf("error occurred: %q", err)
-			continue
-		}
+func drawCalibrationImage(x0, y0, x1, y1, screenWidth, screenHeight int) *image.RGBA {
+	rgba := image.NewRGBA(image.Rect(0, 0, screenWidth, screenHeight))
+	draw.Draw(rgba, rgba.Bounds(), image.Black, image.ZP, draw.Src)
+	square := rgba.SubImage(image.Rect(x0, y0, x1, y1)).(*image.RGBA)
+	draw.Draw(square, square.Bounds(), image.White, image.Point{x0, y0}, draw.Src)
+	return rgba
+}
+
+func divideScreenForLeds(maxPixels, amountOfLeds int) []int {
+	if amountOfLeds <= 0 {
+		return nil
+	}
+	r := make([]int, amountOfLeds)
+	val := maxPixels / amountOfLeds
+	for i := range r {
+		r[i] = val
+	}
+	remainder := maxPixels % amountOfLeds
+	for i := 0; i < remainder; i++ {
+		r[i]++
+	}
+	return r
+}
 
-		calibrationStream.UpdateJPEG(buffer.Bytes())
-		time.Sleep(time.Duration(500) * time.Millisecond)
-		areas = append(areas, findWhiteAreaInFrame())
-		fillRGBARect(rgba, rect, color.Black)
-	}*/
+// LedCalibration is a region of the camera frame lit by a single led calibration screen.
+type LedCalibration struct {
+	Index int `json:"index"`
+	// Region is a bounding box of lit pixels, empty when nothing was detected.
+	Region image.Rectangle `json:"region"`
+	// Area is amount of lit pixels.
+	Area     int        `json:"area"`
+	Centroid [2]float64 `json:"centroid"`
+	// Contrast is mean luma difference of lit pixels against the black screen.
+	Contrast float64 `json:"contrast"`
+	// Overlap is the largest share of the region covered by a region of the neighbouring led.
+	Overlap float64 `json:"overlap"`
+	// Confidence of the detection, 0-1.
+	Confidence float64 `json:"confidence"`
+	// OutOfOrder is set when the region doesn't follow direction of the strip.
+	OutOfOrder bool `json:"outOfOrder"`
+	// Suspicious leds should be captured again.
+	Suspicious bool     `json:"suspicious"`
+	Problems   []string `json:"problems,omitempty"`
+}
 
-	/*for _, screen := range screens {
-		calibrationStream.UpdateJPEG(screen)
-		time.Sleep(time.Duration(500) * time.Millisecond)
-		areas = append(areas, findWhiteAreaInFrame())
-		//fillRGBARect(rgba, rect, color.Black)
-	}*/
+// Thresholds of the led region detection and verification.
+const (
+	minLitDiff       = 40
+	minConfidence    = 0.5
+	maxOverlap       = 0.5
+	fullContrastDiff = 128
+)
 
-	b, err := camera.GetFrame()
-	if err != nil {
-		log.Printf("error occurred: %q", err)
-		return
-	}
-	img, err := jpeg.Decode(bytes.NewReader(b))
-	bd := img.Bounds()
-	frame := image.NewRGBA(image.Rect(0, 0, bd.Dx(), bd.Dy()))
-	draw.Draw(frame, frame.Bounds(), img, bd.Min, draw.Src)
-	green := color.RGBA{0, 255, 0, 255}
-	for _, area := range areas {
-		for _, pt := range area {
-			frame.Set(pt.X, pt.Y, green)
+// detectLed finds pixels lit by the calibration screen compared to the black screen.
+// Pixels in the ignored area, covered by the marker, are skipped.
+func detectLed(index int, frame, black *image.RGBA, ignore image.Rectangle) LedCalibration {
+	led := LedCalibration{Index: index}
+	rect := frame.Rect.Intersect(black.Rect)
+	maxDiff := 0.0
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if image.Pt(x, y).In(ignore) {
+				continue
+			}
+			maxDiff = math.Max(maxDiff, luma(frame.RGBAAt(x, y))-luma(black.RGBAAt(x, y)))
 		}
 	}
-	buffer := new(bytes.Buffer)
-	err = jpeg.Encode(buffer, frame, nil)
-	if err != nil {
-		log.Printf("error occurred: %q", err)
-		return
+	// only the brightest part is taken, so light scattered around the area is ignored
+	threshold := math.Max(minLitDiff, maxDiff/2)
+	var sumX, sumY, sumDiff float64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			pt := image.Pt(x, y)
+			if pt.In(ignore) {
+				continue
+			}
+			diff := luma(frame.RGBAAt(x, y)) - luma(black.RGBAAt(x, y))
+			if diff < threshold {
+				continue
+			}
+			if led.Area == 0 {
+				led.Region = image.Rectangle{pt, pt.Add(image.Pt(1, 1))}
+			} else {
+				led.Region = led.Region.Union(image.Rectangle{pt, pt.Add(image.Pt(1, 1))})
+			}
+			led.Area++
+			sumX += float64(x)
+			sumY += float64(y)
+			sumDiff += diff
+		}
+	}
+	if led.Area > 0 {
+		n := float64(led.Area)
+		led.Centroid = [2]float64{sumX / n, sumY / n}
+		led.Contrast = sumDiff / n
 	}
-	calibrationStream.UpdateJPEG(buffer.Bytes())
-	calibrationStream.UpdateJPEG(buffer.Bytes())
+	return led
 }
 
-func findWhiteAreaInFrame() []image.Point {
-	pixels := make([]image.Point, 0, 200)
-	b, err := camera.GetFrame()
-	if err != nil {
-		log.Printf("error occurred: %q", err)
-		return pixels
+// verifyLeds computes metrics which depend on the other leds and flags suspicious ones.
+// Leds are expected in the strip order.
+func verifyLeds(leds []LedCalibration, direction Direction) {
+	var areas []int
+	var cx, cy float64
+	for _, led := range leds {
+		if led.Area > 0 {
+			areas = append(areas, led.Area)
+			cx += led.Centroid[0]
+			cy += led.Centroid[1]
+		}
 	}
-	img, err := jpeg.Decode(bytes.NewReader(b))
-	if err != nil {
-		log.Printf("error occurred: %q", err)
-		return pixels
-	}
-	bd := img.Bounds()
-	rgba := image.NewRGBA(image.Rect(0, 0, bd.Dx(), bd.Dy()))
-	draw.Draw(rgba, rgba.Bounds(), img, bd.Min, draw.Src)
-	for x := rgba.Rect.Min.X; x < rgba.Rect.Max.X; x++ {
-		for y := rgba.Rect.Min.Y; y < rgba.Rect.Max.Y; y++ {
-			col := rgba.RGBAAt(x, y)
-			avg := float64(int(col.R)+int(col.G)+int(col.B)+int(col.A)) / 4
-			if avg > 150 {
-				pixels = append(pixels, image.Pt(x, y))
+	if len(areas) > 0 {
+		cx /= float64(len(areas))
+		cy /= float64(len(areas))
+	}
+	sort.Ints(areas)
+	median := 0.0
+	if len(areas) > 0 {
+		median = float64(areas[len(areas)/2])
+	}
+	angle := func(led LedCalibration) float64 {
+		return math.Atan2(led.Centroid[1]-cy, led.Centroid[0]-cx)
+	}
+	// in the camera frame y grows down, so clockwise strip increases the angle
+	sign := 1.0
+	if direction == CounterClockwise {
+		sign = -1
+	}
+	n := len(leds)
+	for i := range leds {
+		led := &leds[i]
+		led.Problems = nil
+		led.Overlap = 0
+		led.Confidence = 0
+		led.OutOfOrder = false
+		if led.Area == 0 {
+			led.Suspicious = true
+			led.Problems = append(led.Problems, "not detected")
+			continue
+		}
+		areaScore := math.Min(float64(led.Area), median) / math.Max(float64(led.Area), median)
+		led.Confidence = math.Min(led.Contrast/fullContrastDiff, 1) * areaScore
+		for _, j := range []int{i - 1, i + 1} {
+			if n < 2 || j < 0 || j >= n || leds[j].Area == 0 {
+				continue
+			}
+			inter := led.Region.Intersect(leds[j].Region)
+			area := led.Region.Dx() * led.Region.Dy()
+			if !inter.Empty() && area > 0 {
+				led.Overlap = math.Max(led.Overlap, float64(inter.Dx()*inter.Dy())/float64(area))
+			}
+			delta := angle(leds[j]) - angle(*led)
+			// normalize into (-pi, pi]
+			delta = math.Remainder(delta, 2*math.Pi)
+			if j < i {
+				delta = -delta
+			}
+			if n > 2 && delta*sign < 0 {
+				led.OutOfOrder = true
 			}
 		}
+		if led.Confidence < minConfidence {
+			led.Problems = append(led.Problems, "low confidence")
+		}
+		if led.Overlap > maxOverlap {
+			led.Problems = append(led.Problems, "overlaps neighbour")
+		}
+		if led.OutOfOrder {
+			led.Problems = append(led.Problems, "out of order")
+		}
+		led.Suspicious = len(led.Problems) > 0
 	}
-
-	col := color.RGBA{0, 255, 0, 255}
-	for _, px := range pixels {
-		rgba.Set(px.X, px.Y, col)
-	}
-	//buffer := new(bytes.Buffer)
-	//err = jpeg.Encode(buffer, rgba, nil)
-	//if err != nil {
-	//	log.Printf("error occurred: %q", err)
-	//	return pixels
-	//}
-	//calibrationStream.UpdateJPEG(buffer.Bytes())
-	//time.Sleep(time.Duration(500) * time.Millisecond)
-
-	return pixels
 }
 
-func calculateLedAreas(ledsX, ledsY, screenWidth, screenHeight, ledDepth int) []*image.Rectangle {
-	pos := make([]*image.Rectangle, 0, ledsX*2+ledsY*2)
-	// horizontal edges
-	widthX := divideScreenForLeds(screenWidth, ledsX)
-	for _, y := range []int{0, screenHeight - ledDepth} {
-		for xi, x := 0, 0; x < screenWidth; x, xi = x+widthX[xi], xi+1 {
-			r := image.Rect(x, y, x+widthX[xi], y+ledDepth)
-			pos = append(pos, &r)
+// calibrationScreen returns jpeg of the pattern. Pre-generated screen of its led is used when
+// available, the marker is drawn over it.
+func calibrationScreen(c *Config, p Pattern) ([]byte, error) {
+	if p.Led != nil {
+		if b, err := ioutil.ReadFile(c.CalibrationScreenPath(*p.Led)); err == nil {
+			if p.Marker == nil {
+				return b, nil
+			}
+			img, err := decodeFrame(b)
+			if err != nil {
+				return nil, fmt.Errorf("calibration screen %d: %s", *p.Led, err)
+			}
+			drawPatternRects(img, markerPatternRects(*p.Marker))
+			return encodeJpeg(img)
 		}
 	}
-	// vertical edges
-	widthY := divideScreenForLeds(screenHeight, ledsY)
-	for _, x := range []int{0, screenWidth - ledDepth} {
-		for yi, y := 0, 0; y < screenHeight; y, yi = y+widthY[yi], yi+1 {
-			r := image.Rect(x, y, x+ledDepth, y+widthY[yi])
-			pos = append(pos, &r)
-		}
+	return encodeJpeg(p.Render(c.ScreenWidth, c.ScreenHeight))
+}
+
+// mergeLeds returns the previous calibration with leds replaced by the recaptured ones.
+func mergeLeds(previous, captured []LedCalibration) []LedCalibration {
+	leds := append([]LedCalibration(nil), previous...)
+	for _, led := range captured {
+		leds[led.Index] = led
 	}
-	return pos
+	return leds
 }
 
-func drawCalibrationImage(x0, y0, x1, y1, screenWidth, screenHeight int) *image.RGBA {
-	rgba := image.NewRGBA(image.Rect(0, 0, screenWidth, screenHeight))
-	draw.Draw(rgba, rgba.Bounds(), image.Black, image.ZP, draw.Src)
-	square := rgba.SubImage(image.Rect(x0, y0, x1, y1)).(*image.RGBA)
-	draw.Draw(square, square.Bounds(), image.White, image.Point{x0, y0}, draw.Src)
-	return rgba
+// captureCalibrationScreen shows calibration screen of the led and returns the captured camera frame.
+// The jpeg display shows the screen pre-generated by init when available, the canvas page draws
+// the same region itself.
+func (c *calibrator) captureCalibrationScreen(ctx context.Context, index int) (*image.RGBA, error) {
+	p, err := LedPattern(Conf, index)
+	if err != nil {
+		return nil, err
+	}
+	return c.capturePattern(ctx, p, colorSettleTime)
 }
 
-func divideScreenForLeds(maxPixels, amountOfLeds int) []int {
-	r := make([]int, amountOfLeds)
-	val := maxPixels / amountOfLeds
-	for i := range r {
-		r[i] = val
+// calibrateLeds captures calibration screens of the given leds and detects their regions.
+func calibrateLeds(ctx context.Context, indices []int, black *image.RGBA, ignore image.Rectangle, capture func(ctx context.Context, index int) (*image.RGBA, error)) ([]LedCalibration, error) {
+	leds := make([]LedCalibration, 0, len(indices))
+	for _, i := range indices {
+		frame, err := capture(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		leds = append(leds, detectLed(i, frame, black, ignore))
 	}
-	remainder := maxPixels % amountOfLeds
-	for i := 0; i < remainder; i++ {
-		r[i]++
+	return leds, nil
+}
+
+// drawLedRegions marks detected regions in the frame, suspicious ones in red.
+func drawLedRegions(frame *image.RGBA, leds []LedCalibration) {
+	for _, led := range leds {
+		c := color.RGBA{0, 255, 0, 255}
+		if led.Suspicious {
+			c = color.RGBA{255, 0, 0, 255}
+		}
+		r := led.Region
+		for x := r.Min.X; x < r.Max.X; x++ {
+			frame.SetRGBA(x, r.Min.Y, c)
+			frame.SetRGBA(x, r.Max.Y-1, c)
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			frame.SetRGBA(r.Min.X, y, c)
+			frame.SetRGBA(r.Max.X-1, y, c)
+		}
 	}
-	return r
 }
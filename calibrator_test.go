@@ -0,0 +1,90 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMergeLeds(t *testing.T) {
+	previous := []LedCalibration{
+		{Index: 0, Region: image.Rect(0, 0, 10, 10), Area: 100},
+		{Index: 1, Suspicious: true, Problems: []string{"not detected"}},
+		{Index: 2, Region: image.Rect(20, 0, 30, 10), Area: 100},
+	}
+	recaptured := LedCalibration{Index: 1, Region: image.Rect(10, 0, 20, 10), Area: 100}
+	leds := mergeLeds(previous, []LedCalibration{recaptured})
+	want := []LedCalibration{previous[0], recaptured, previous[2]}
+	if !reflect.DeepEqual(leds, want) {
+		t.Errorf("merged leds are %+v\nwant %+v", leds, want)
+	}
+	if !previous[1].Suspicious {
+		t.Error("previous calibration was changed")
+	}
+}
+
+func TestCalibrationScreenReusesGenerated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "screens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Config{dir: dir, ScreenWidth: 200, ScreenHeight: 100, Layout: NewUniformLayout(4, 2)}
+	// generated screen is told apart from the rendered pattern by its color
+	generated := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	fillRGBARect(generated, &generated.Rect, color.RGBA{0, 0, 255, 255})
+	b, err := encodeJpeg(generated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(c.CalibrationScreenDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.CalibrationScreenPath(1), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	isBlue := func(c color.RGBA) bool {
+		return c.B > 200 && c.R < 50 && c.G < 50
+	}
+	for _, tc := range []struct {
+		name   string
+		led    int
+		marker bool
+		blue   bool
+	}{
+		{"generated", 1, false, true},
+		{"generated with marker", 1, true, true},
+		{"rendered without generated", 0, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := LedPattern(c, tc.led)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.marker {
+				p = p.withMarker(0xa5)
+			}
+			b, err := calibrationScreen(c, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := decodeFrame(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blue := isBlue(img.RGBAAt(1, 50)); blue != tc.blue {
+				t.Errorf("screen is blue: %t, want %t", blue, tc.blue)
+			}
+			if !tc.marker {
+				return
+			}
+			q := Quad{image.Pt(0, 0), image.Pt(200, 0), image.Pt(200, 100), image.Pt(0, 100)}
+			if code, ok := readMarker(img, q); !ok || code != 0xa5 {
+				t.Errorf("marker is %x, %t, want a5", code, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/technomancers/piCamera"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var exposureModes = map[string]piCamera.ExposureMode{
+	"off":          piCamera.ExpOff,
+	"auto":         piCamera.ExpAuto,
+	"night":        piCamera.ExpNight,
+	"nightpreview": piCamera.ExpNightpreview,
+	"backlight":    piCamera.ExpBacklight,
+	"spotlight":    piCamera.ExpSpotlight,
+	"sports":       piCamera.ExpSports,
+	"snow":         piCamera.ExpSnow,
+	"beach":        piCamera.ExpBeach,
+	"verylong":     piCamera.ExpVerylong,
+	"fixedfps":     piCamera.ExpFixedfps,
+	"antishake":    piCamera.ExpAntishake,
+	"fireworks":    piCamera.ExpFireworks,
+}
+
+var awbModes = map[string]piCamera.AWBMode{
+	"off":          piCamera.AwbOff,
+	"auto":         piCamera.AwbAuto,
+	"sun":          piCamera.AwbSun,
+	"cloud":        piCamera.AwbCloud,
+	"shade":        piCamera.AwbShade,
+	"tungsten":     piCamera.AwbTungsten,
+	"fluorescent":  piCamera.AwbFluorescent,
+	"incandescent": piCamera.AwbIncandescent,
+	"flash":        piCamera.AwbFlash,
+	"horizon":      piCamera.AwbHorizon,
+}
+
+// cameraSettleTime is time automatic exposure needs to adapt to the new scene.
+const cameraSettleTime = 2 * time.Second
+
+// maxShutterSpeed is the longest exposure supported by the camera module in microseconds.
+const maxShutterSpeed = 6000000
+
+// CameraConfig contains arguments passed to raspivid.
+type CameraConfig struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Mode is a sensor mode, see raspivid documentation.
+	Mode int `json:"mode"`
+	// Framerate is amount of frames per second, zero uses default of the mode.
+	Framerate int `json:"framerate,omitempty"`
+	// ShutterSpeed in microseconds, zero lets the camera choose.
+	ShutterSpeed int `json:"shutterSpeed,omitempty"`
+	// ISO sensitivity, zero lets the camera choose.
+	ISO      int    `json:"iso,omitempty"`
+	Exposure string `json:"exposure"`
+	AWB      string `json:"awb"`
+	// AWBGains are red and blue gains used when AWB is off.
+	AWBGains   [2]float64 `json:"awbGains"`
+	Brightness int        `json:"brightness"`
+	Contrast   int        `json:"contrast"`
+	Saturation int        `json:"saturation"`
+	// Locked means exposure and white balance were fixed after calibration.
+	Locked bool `json:"locked,omitempty"`
+}
+
+func DefaultCameraConfig() CameraConfig {
+	return CameraConfig{
+		Width:      1640,
+		Height:     1232,
+		Mode:       4,
+		Exposure:   "verylong",
+		AWB:        "auto",
+		AWBGains:   [2]float64{1, 1},
+		Brightness: 60,
+		Contrast:   40,
+	}
+}
+
+func (c *CameraConfig) Validate() error {
+	switch {
+	case c.Width < 64 || c.Width > 3280 || c.Height < 64 || c.Height > 2464:
+		return fmt.Errorf("camera resolution %dx%d is out of range (64x64-3280x2464)", c.Width, c.Height)
+	case c.Mode < 0 || c.Mode > 7:
+		return fmt.Errorf("camera mode %d is out of range (0-7)", c.Mode)
+	case c.Framerate < 0 || c.Framerate > 90:
+		return fmt.Errorf("camera framerate %d is out of range (0-90)", c.Framerate)
+	case c.ShutterSpeed < 0 || c.ShutterSpeed > maxShutterSpeed:
+		return fmt.Errorf("camera shutter speed %d is out of range (0-%d)", c.ShutterSpeed, maxShutterSpeed)
+	case c.ISO != 0 && (c.ISO < 100 || c.ISO > 800):
+		return fmt.Errorf("camera ISO %d is out of range (100-800)", c.ISO)
+	case c.Brightness < 0 || c.Brightness > 100:
+		return fmt.Errorf("camera brightness %d is out of range (0-100)", c.Brightness)
+	case c.Contrast < -100 || c.Contrast > 100:
+		return fmt.Errorf("camera contrast %d is out of range (-100-100)", c.Contrast)
+	case c.Saturation < -100 || c.Saturation > 100:
+		return fmt.Errorf("camera saturation %d is out of range (-100-100)", c.Saturation)
+	}
+	if max, ok := sensorModes[c.Mode]; ok && (c.Width > max.X || c.Height > max.Y) {
+		return fmt.Errorf("camera mode %d captures at most %dx%d, resolution %dx%d would be upscaled", c.Mode, max.X, max.Y, c.Width, c.Height)
+	}
+	if _, ok := exposureModes[c.Exposure]; !ok {
+		return fmt.Errorf("unknown exposure mode %q, expected one of: %s", c.Exposure, strings.Join(modeNames(exposureModes), ", "))
+	}
+	if _, ok := awbModes[c.AWB]; !ok {
+		return fmt.Errorf("unknown awb mode %q, expected one of: %s", c.AWB, strings.Join(modeNames(awbModes), ", "))
+	}
+	if c.AWB == "off" {
+		for _, g := range c.AWBGains {
+			if g <= 0 || g > 8 {
+				return fmt.Errorf("awb gains must be within 0-8 range when awb is off")
+			}
+		}
+	}
+	if c.Locked && (c.Exposure != "off" || c.AWB != "off") {
+		return fmt.Errorf("locked camera must have exposure and awb off")
+	}
+	return nil
+}
+
+func modeNames(modes interface{}) []string {
+	var names []string
+	switch m := modes.(type) {
+	case map[string]piCamera.ExposureMode:
+		for name := range m {
+			names = append(names, name)
+		}
+	case map[string]piCamera.AWBMode:
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *CameraConfig) args() *piCamera.RaspiVidArgs {
+	args := piCamera.NewArgs()
+	args.Width = c.Width
+	args.Height = c.Height
+	args.Mode = c.Mode
+	args.Framerate = c.Framerate
+	args.ShutterSpeed = time.Duration(c.ShutterSpeed) * time.Microsecond
+	args.ISO = c.ISO
+	args.ExposureMode = exposureModes[c.Exposure]
+	args.AWBMode = awbModes[c.AWB]
+	args.AWBGains = c.AWBGains
+	args.Brightness = c.Brightness
+	args.Contrast = c.Contrast
+	args.Saturation = c.Saturation
+	return args
+}
+
+// measuring returns settings used while the white balance is measured: exposure is automatic
+// and white balance is fixed, so gains of the captured frame are known.
+func (c CameraConfig) measuring() CameraConfig {
+	c.Locked = false
+	if c.Exposure == "off" {
+		c.Exposure = "auto"
+	}
+	if c.AWB != "off" {
+		c.AWB = "off"
+		c.AWBGains = [2]float64{1, 1}
+	}
+	return c
+}
+
+// Lock returns settings with exposure and white balance fixed, gains are corrected
+// so the white screen captured with the measuring settings becomes neutral.
+func (c CameraConfig) Lock(white *image.RGBA, q Quad) (CameraConfig, error) {
+	m := c.measuring()
+	var sum [3]float64
+	for i := 0; i < screenSamples; i++ {
+		for j := 0; j < screenSamples; j++ {
+			pt := q.Map((float64(i)+0.5)/screenSamples, (float64(j)+0.5)/screenSamples)
+			if !pt.In(white.Rect) {
+				continue
+			}
+			px := white.RGBAAt(pt.X, pt.Y)
+			sum[0] += float64(px.R)
+			sum[1] += float64(px.G)
+			sum[2] += float64(px.B)
+		}
+	}
+	if sum[0] == 0 || sum[1] == 0 || sum[2] == 0 {
+		return c, fmt.Errorf("screen isn't visible, can't measure white balance")
+	}
+	c.AWBGains = [2]float64{
+		math.Min(m.AWBGains[0]*sum[1]/sum[0], 8),
+		math.Min(m.AWBGains[1]*sum[1]/sum[2], 8),
+	}
+	c.Exposure = "off"
+	c.AWB = "off"
+	c.Locked = true
+	return c, c.Validate()
+}
+
+// cameraFlagSet defines flags overriding camera settings.
+func cameraFlagSet(c *CameraConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet("camera", flag.ContinueOnError)
+	fs.IntVar(&c.Width, "camera-width", c.Width, "width of captured frames")
+	fs.IntVar(&c.Height, "camera-height", c.Height, "height of captured frames")
+	fs.IntVar(&c.Mode, "camera-mode", c.Mode, "sensor mode of the camera (0-7)")
+	fs.IntVar(&c.Framerate, "camera-fps", c.Framerate, "frames per second, zero uses default of the mode")
+	fs.IntVar(&c.ShutterSpeed, "camera-shutter", c.ShutterSpeed, "shutter speed in microseconds, zero lets the camera choose")
+	fs.IntVar(&c.ISO, "camera-iso", c.ISO, "ISO sensitivity (100-800), zero lets the camera choose")
+	fs.StringVar(&c.Exposure, "camera-exposure", c.Exposure, "exposure mode: "+strings.Join(modeNames(exposureModes), ", "))
+	fs.StringVar(&c.AWB, "camera-awb", c.AWB, "white balance mode: "+strings.Join(modeNames(awbModes), ", "))
+	fs.Var((*awbGainsFlag)(&c.AWBGains), "camera-awb-gains", "red and blue gains used when awb is off, e.g. 1.5,1.2")
+	fs.IntVar(&c.Brightness, "camera-brightness", c.Brightness, "brightness of the image (0-100)")
+	fs.IntVar(&c.Contrast, "camera-contrast", c.Contrast, "contrast of the image (-100-100)")
+	fs.IntVar(&c.Saturation, "camera-saturation", c.Saturation, "saturation of the image (-100-100)")
+	return fs
+}
+
+// addCameraFlags registers camera flags of the command.
+func addCameraFlags(fs *flag.FlagSet) {
+	defaults := DefaultCameraConfig()
+	cameraFlagSet(&defaults).VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+}
+
+// applyCameraFlags overrides settings with camera flags set on the command line.
+func applyCameraFlags(fs *flag.FlagSet, c *CameraConfig) error {
+	camera := cameraFlagSet(c)
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if camera.Lookup(f.Name) != nil && err == nil {
+			err = camera.Set(f.Name, f.Value.String())
+		}
+	})
+	return err
+}
+
+type awbGainsFlag [2]float64
+
+func (g *awbGainsFlag) String() string {
+	return fmt.Sprintf("%g,%g", g[0], g[1])
+}
+
+func (g *awbGainsFlag) Set(s string) error {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("expected red and blue gain separated by comma")
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return fmt.Errorf("invalid gain %q", p)
+		}
+		g[i] = v
+	}
+	return nil
+}
+
+// sensorModes are the largest resolutions captured by each sensor mode, mode 0 is picked automatically.
+var sensorModes = map[int]image.Point{
+	1: {1920, 1080},
+	2: {3280, 2464},
+	3: {3280, 2464},
+	4: {1640, 1232},
+	5: {1640, 922},
+	6: {1280, 720},
+	7: {640, 480},
+}
+
+// frameBuffer keeps the most recent camera frame, so it can be shared by the stream and calibration.
+type frameBuffer struct {
+	mu       sync.Mutex
+	frame    []byte
+	captured time.Time
+	updated  chan struct{}
+}
+
+func newFrameBuffer() *frameBuffer {
+	return &frameBuffer{updated: make(chan struct{})}
+}
+
+func (b *frameBuffer) Set(frame []byte) {
+	b.mu.Lock()
+	b.frame = frame
+	b.captured = time.Now()
+	close(b.updated)
+	b.updated = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// Next waits for a frame captured after the given time.
+func (b *frameBuffer) Next(ctx context.Context, after time.Time) ([]byte, error) {
+	frame, _, err := b.NextCaptured(ctx, after)
+	return frame, err
+}
+
+// NextCaptured waits for a frame captured after the given time and returns also the time it was received.
+func (b *frameBuffer) NextCaptured(ctx context.Context, after time.Time) ([]byte, time.Time, error) {
+	for {
+		b.mu.Lock()
+		frame, captured, updated := b.frame, b.captured, b.updated
+		b.mu.Unlock()
+		if frame != nil && captured.After(after) {
+			return frame, captured, nil
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil, time.Time{}, ctx.Err()
+		}
+	}
+}
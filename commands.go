@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit codes returned by the program.
+const (
+	ExitOK    = 0
+	ExitError = 1
+	ExitUsage = 2
+)
+
+type command struct {
+	name  string
+	args  string
+	short string
+	flags *flag.FlagSet
+	run   func(fs *flag.FlagSet) error
+}
+
+// usageError marks errors caused by invalid command-line input.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usageErrorf(format string, a ...interface{}) error {
+	return &usageError{fmt.Sprintf(format, a...)}
+}
+
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func newCommand(name, args, short string, run func(fs *flag.FlagSet) error) *command {
+	cmd := &command{name: name, args: args, short: short, run: run}
+	cmd.flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	cmd.flags.Usage = func() {
+		out := cmd.flags.Output()
+		fmt.Fprintf(out, "Usage: %s %s [flags] %s\n\n", programName(), cmd.name, cmd.args)
+		fmt.Fprintf(out, "%s\n\nFlags:\n", cmd.short)
+		cmd.flags.PrintDefaults()
+	}
+	cmd.flags.StringVar(&Conf.dir, "config-dir", DefaultConfigDir, "directory where configuration and calibration data are stored")
+	cmd.flags.StringVar(&logOptions.format, "log-format", LogText, "format of log records: text or json")
+	cmd.flags.StringVar(&logOptions.level, "log-level", LevelInfo.String(), "minimal level of logged records: debug, info, warn or error")
+	return cmd
+}
+
+// readConfig reads configuration written by init and validates it.
+func readConfig() error {
+	if err := Conf.Read(); err != nil {
+		return err
+	}
+	if !Conf.HasCalibrationSettingsSet() {
+		return fmt.Errorf("missing or invalid configuration: run \"%s init\"", programName())
+	}
+	if err := Conf.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration %s: %s", Conf.Dest(), err)
+	}
+	return nil
+}
+
+// logOptions are set by flags shared by all commands.
+var logOptions struct {
+	format string
+	level  string
+}
+
+func commands() []*command {
+	return []*command{
+		initCmd(),
+		calibrateCmd(),
+		tuneExposureCmd(),
+		latencyTestCmd(),
+		runCmd(),
+		profileCmd(),
+	}
+}
+
+func printUsage(cmds []*command) {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", programName())
+	for _, cmd := range cmds {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun \"%s <command> --help\" for more information about a command.\n", programName())
+}
+
+// execute parses arguments, runs requested command and returns process exit code.
+func execute(args []string) int {
+	cmds := commands()
+	if len(args) < 1 {
+		printUsage(cmds)
+		return ExitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		printUsage(cmds)
+		return ExitOK
+	}
+	for _, cmd := range cmds {
+		if cmd.name != args[0] {
+			continue
+		}
+		if err := cmd.flags.Parse(args[1:]); err != nil {
+			if err == flag.ErrHelp {
+				return ExitOK
+			}
+			return ExitUsage
+		}
+		if err := configureLogging(logOptions.format, logOptions.level); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n\n", err)
+			cmd.flags.Usage()
+			return ExitUsage
+		}
+		if err := cmd.run(cmd.flags); err != nil {
+			var uerr *usageError
+			if errors.As(err, &uerr) {
+				fmt.Fprintf(os.Stderr, "%s\n\n", uerr)
+				cmd.flags.Usage()
+				return ExitUsage
+			}
+			handleError(err)
+			return ExitError
+		}
+		return ExitOK
+	}
+	fmt.Fprintf(os.Stderr, "Unrecognized command: %s\n\n", args[0])
+	printUsage(cmds)
+	return ExitUsage
+}
+
+// gapsFlag collects repeated --gap flags.
+type gapsFlag []Gap
+
+func (g *gapsFlag) String() string {
+	parts := make([]string, len(*g))
+	for i, gap := range *g {
+		parts[i] = fmt.Sprintf("%s:%d-%d", gap.Edge, gap.From, gap.To)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (g *gapsFlag) Set(s string) error {
+	gap, err := ParseGap(s)
+	if err != nil {
+		return err
+	}
+	*g = append(*g, gap)
+	return nil
+}
+
+func initCmd() *command {
+	var screenWidth, screenHeight, ledsX, ledsY, depth int
+	var top, right, bottom, left int
+	var gaps gapsFlag
+	var start, direction string
+	var corners, jpegScreens bool
+	cmd := newCommand(
+		"init",
+		"[screen_width screen_height amount_of_leds_x amount_of_leds_y]",
+		"Write screen, LED and camera configuration.",
+		func(fs *flag.FlagSet) error {
+			if err := Conf.Read(); err != nil {
+				return err
+			}
+			// positional form is kept for compatibility with older versions
+			if fs.NArg() > 0 {
+				if fs.NArg() != 4 {
+					return usageErrorf("expected 4 positional arguments, got %d", fs.NArg())
+				}
+				values := []*int{&screenWidth, &screenHeight, &ledsX, &ledsY}
+				for i, v := range values {
+					n, err := strconv.Atoi(fs.Arg(i))
+					if err != nil {
+						return usageErrorf("invalid argument %q: must be a number", fs.Arg(i))
+					}
+					*v = n
+				}
+			}
+			Conf.ScreenWidth = screenWidth
+			Conf.ScreenHeight = screenHeight
+			Conf.LedDepth = depth
+			Conf.Layout = NewUniformLayout(ledsX, ledsY)
+			custom := false
+			fs.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "leds-top", "leds-right", "leds-bottom", "leds-left", "gap", "start", "direction", "corners":
+					custom = true
+				}
+			})
+			if custom {
+				layout := Conf.Layout
+				// negative values mean edge wasn't set and uniform amount is used
+				for _, v := range []struct {
+					dst *int
+					val int
+				}{
+					{&layout.Top, top}, {&layout.Right, right}, {&layout.Bottom, bottom}, {&layout.Left, left},
+				} {
+					if v.val >= 0 {
+						*v.dst = v.val
+					}
+				}
+				pos, err := ParsePosition(start)
+				if err != nil {
+					return usageErrorf("%s", err)
+				}
+				layout.Start = pos
+				layout.Direction = Direction(direction)
+				layout.Gaps = gaps
+				layout.Corners = corners
+			}
+			if err := Conf.LedLayout().Validate(); err != nil {
+				return usageErrorf("invalid led layout: %s", err)
+			}
+			if !Conf.HasCalibrationSettingsSet() {
+				return usageErrorf("screen size and amount of leds must be greater than zero")
+			}
+			camera := Conf.CameraSettings()
+			if err := applyCameraFlags(fs, &camera); err != nil {
+				return usageErrorf("%s", err)
+			}
+			if err := camera.Validate(); err != nil {
+				return usageErrorf("invalid camera settings: %s", err)
+			}
+			Conf.Camera = &camera
+			// regions detected for another layout would be ignored
+			if len(Conf.LedRegions) != Conf.LedLayout().Count() {
+				Conf.LedRegions = nil
+			}
+			if err := Conf.Validate(); err != nil {
+				return usageErrorf("invalid configuration: %s", err)
+			}
+			return runInit(jpegScreens)
+		},
+	)
+	cmd.flags.IntVar(&screenWidth, "screen-width", 0, "screen width in pixels")
+	cmd.flags.IntVar(&screenHeight, "screen-height", 0, "screen height in pixels")
+	cmd.flags.IntVar(&ledsX, "leds-x", 0, "amount of leds along the horizontal edge")
+	cmd.flags.IntVar(&ledsY, "leds-y", 0, "amount of leds along the vertical edge")
+	cmd.flags.IntVar(&depth, "led-depth", DefaultLedDepth, "distance in screen pixels from the border analyzed for each led")
+	cmd.flags.IntVar(&top, "leds-top", -1, "amount of led slots on the top edge (defaults to --leds-x)")
+	cmd.flags.IntVar(&right, "leds-right", -1, "amount of led slots on the right edge (defaults to --leds-y)")
+	cmd.flags.IntVar(&bottom, "leds-bottom", -1, "amount of led slots on the bottom edge (defaults to --leds-x)")
+	cmd.flags.IntVar(&left, "leds-left", -1, "amount of led slots on the left edge (defaults to --leds-y)")
+	cmd.flags.Var(&gaps, "gap", "slots without leds in format edge:from-to, can be repeated (e.g. bottom:12-18)")
+	cmd.flags.StringVar(&start, "start", "top:0", "slot of the first led in format edge:offset or corner name (e.g. bottom:15, top-left)")
+	cmd.flags.StringVar(&direction, "direction", string(Clockwise), "direction of the strip looking at the screen: cw or ccw")
+	cmd.flags.BoolVar(&corners, "corners", false, "whether each corner holds an additional led")
+	cmd.flags.BoolVar(&jpegScreens, "jpeg-screens", false, "pre-generate jpeg calibration screens for \"calibrate --display jpeg\"")
+	addCameraFlags(cmd.flags)
+	return cmd
+}
+
+func runInit(jpegScreens bool) error {
+	if err := Conf.Write(); err != nil {
+		return err
+	}
+	// screens of the previous layout are removed, so they're never shown by mistake
+	dir := Conf.CalibrationScreenDir()
+	if err := createOrCleanUpDir(dir); err != nil {
+		return err
+	}
+	if !jpegScreens {
+		fmt.Println("Done.")
+		return nil
+	}
+	fmt.Println("Generating calibration screens...")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed error
+	buffer := make(chan *CalibrationJpegImage)
+	generateCalibrationImages(buffer, Conf)
+	for img := range buffer {
+		wg.Add(1)
+		go func(img *CalibrationJpegImage) {
+			defer wg.Done()
+			err := ioutil.WriteFile(Conf.CalibrationScreenPath(img.Index()), img.Bytes(), 0644)
+			if err != nil {
+				mu.Lock()
+				failed = err
+				mu.Unlock()
+			}
+		}(img)
+	}
+	wg.Wait()
+	if failed != nil {
+		return failed
+	}
+	fmt.Println("Done.")
+	return nil
+}
+
+func calibrateCmd() *command {
+	var opts CalibrateOptions
+	var leds string
+	cmd := newCommand(
+		"calibrate",
+		"",
+		"Detect led positions within the camera frame.",
+		func(fs *flag.FlagSet) error {
+			if fs.NArg() > 0 {
+				return usageErrorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+			}
+			if err := readConfig(); err != nil {
+				return err
+			}
+			if leds != "" {
+				if opts.LockCamera {
+					return usageErrorf("--lock-camera can't be combined with --leds")
+				}
+				report, err := ReadCalibrationReport(Conf)
+				if err != nil {
+					return err
+				}
+				count := Conf.LedLayout().Count()
+				if report == nil || len(report.Leds) != count || len(Conf.LedRegions) != count {
+					return fmt.Errorf("no previous calibration of all leds found: run \"%s calibrate\" without --leds", programName())
+				}
+				if opts.Leds, err = parseLedList(leds, report); err != nil {
+					return usageErrorf("invalid --leds: %s", err)
+				}
+				if len(opts.Leds) == 0 {
+					fmt.Println("No suspicious leds to calibrate")
+					return nil
+				}
+				opts.Report = report
+				// colors are kept, only the regions are recaptured
+				opts.Colors = false
+			}
+			return runCalibrate(opts)
+		},
+	)
+	cmd.flags.StringVar(&opts.Addr, "addr", ":8081", "address of the calibration http server")
+	cmd.flags.StringVar(&opts.Display, "display", DisplayCanvas, "how calibration page shows patterns: canvas drawn by the browser or jpeg stream")
+	cmd.flags.BoolVar(&opts.LockCamera, "lock-camera", false, "fix exposure and white balance measured on white screen after calibration")
+	cmd.flags.BoolVar(&opts.Handshake, "handshake", true, "show marker in each pattern and capture once the camera sees it, instead of waiting fixed time")
+	cmd.flags.BoolVar(&opts.Colors, "colors", true, "measure reference colors and fit camera color correction")
+	cmd.flags.StringVar(&leds, "leds", "", "recapture only the given leds and merge them into the previous calibration, e.g. 3,10-12 or \"suspicious\"")
+	return cmd
+}
+
+// CalibrateOptions control behaviour of the calibrate command.
+type CalibrateOptions struct {
+	Addr       string
+	Display    string
+	LockCamera bool
+	Colors     bool
+	Handshake  bool
+	// Leds are recaptured and merged into the report when set, all leds are captured otherwise.
+	Leds   []int
+	Report *CalibrationReport
+}
+
+// parseLedList parses comma separated led indexes and ranges, "suspicious" selects leds flagged by the report.
+func parseLedList(s string, report *CalibrationReport) ([]int, error) {
+	if s == "suspicious" {
+		return report.Suspicious, nil
+	}
+	seen := make(map[int]bool)
+	var leds []int
+	for _, part := range strings.Split(s, ",") {
+		from, to, err := parseRange(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if from > to {
+			from, to = to, from
+		}
+		if from < 0 || to >= len(report.Leds) {
+			return nil, fmt.Errorf("led range %s is out of range (0-%d)", part, len(report.Leds)-1)
+		}
+		for i := from; i <= to; i++ {
+			if !seen[i] {
+				seen[i] = true
+				leds = append(leds, i)
+			}
+		}
+	}
+	sort.Ints(leds)
+	return leds, nil
+}
+
+func runCalibrate(opts CalibrateOptions) error {
+	lc := NewLifecycle(DefaultShutdownTimeout)
+	defer func() {
+		if err := lc.Shutdown(); err != nil {
+			mainLog.Error("shutdown failed", "err", err)
+		}
+	}()
+	settings := Conf.CameraSettings()
+	if opts.LockCamera {
+		settings = settings.measuring()
+	}
+	camera, err := startCamera(settings)
+	if err != nil {
+		return err
+	}
+	lc.OnShutdown("camera", func(ctx context.Context) error {
+		camera.Stop()
+		return nil
+	})
+	captureCtx, stopCapture := context.WithCancel(lc.Context())
+	defer stopCapture()
+	serveCameraStream(captureCtx, camera)
+	if err := serveCalibrationDisplay(lc.Context(), opts.Display); err != nil {
+		return err
+	}
+	serveHTTP(lc, opts.Addr)
+	url := serverURL(opts.Addr)
+	fmt.Printf("Started camera stream at %s/camera\n", url)
+	fmt.Println("Adjust camera placement to it's permanent position and make sure whole screen is visible")
+	fmt.Println()
+	fmt.Printf("Started calibration server at %s/calibration\n", url)
+	fmt.Println("Open website on calibrated screen and make it full screen")
+	fmt.Println("When you are ready press enter to start calibration process")
+	if err := waitForEnter(lc.Context()); err != nil {
+		return err
+	}
+	cal := newCalibrator(opts.Handshake)
+	result, err := calibrateLedRegions(lc.Context(), cal, opts.Leds, opts.Report)
+	if err != nil {
+		return err
+	}
+	if opts.LockCamera {
+		locked, err := lockCamera(lc.Context(), cal)
+		if err != nil {
+			return err
+		}
+		// colors have to be measured with the locked settings
+		stopCapture()
+		camera.Stop()
+		if camera, err = startCamera(locked); err != nil {
+			return err
+		}
+		go mjpegCapture(lc.Context(), camera)
+	}
+	if opts.Colors {
+		if err := calibrateCameraColors(lc.Context(), cal); err != nil {
+			return err
+		}
+	}
+	http.HandleFunc("/calibration-result", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(result)
+	})
+	fmt.Printf("Calibration result is shown at %s/calibration-result, press enter to finish\n", url)
+	return waitForEnter(lc.Context())
+}
+
+// calibrateLedRegions detects region of each led, stores them and writes the report.
+// When indices are given, only those leds are captured and merged into the previous report.
+// Returns jpeg of the camera frame with marked regions.
+func calibrateLedRegions(ctx context.Context, cal *calibrator, indices []int, previous *CalibrationReport) ([]byte, error) {
+	fmt.Println("Detecting led regions...")
+	black, err := cal.captureScreenColor(ctx, color.RGBA{A: 255}, colorSettleTime)
+	if err != nil {
+		return nil, err
+	}
+	layout := Conf.LedLayout()
+	if indices == nil {
+		indices = make([]int, layout.Count())
+		for i := range indices {
+			indices[i] = i
+		}
+	}
+	captured, err := calibrateLeds(ctx, indices, black, cal.ignoredArea(), cal.captureCalibrationScreen)
+	if err != nil {
+		return nil, err
+	}
+	leds := captured
+	if previous != nil {
+		leds = mergeLeds(previous.Leds, captured)
+		fmt.Printf("Recaptured leds: %s\n", joinInts(indices))
+	}
+	verifyLeds(leds, layout.Direction)
+	Conf.LedRegions = make([]image.Rectangle, len(leds))
+	for i, led := range leds {
+		Conf.LedRegions[i] = led.Region
+	}
+	if err := Conf.Write(); err != nil {
+		return nil, err
+	}
+	white, err := cal.captureScreenColor(ctx, color.RGBA{255, 255, 255, 255}, colorSettleTime)
+	if err != nil {
+		return nil, err
+	}
+	report := NewCalibrationReport(white, leds)
+	if err := writeCalibrationReport(Conf, report, white); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Calibration report written to %s\n", filepath.Join(Conf.dir, reportHTMLFile))
+	if len(report.Suspicious) > 0 {
+		fmt.Printf("Suspicious leds: %s\n", joinInts(report.Suspicious))
+		fmt.Printf("Run \"%s calibrate --leds suspicious\" to capture them again\n", programName())
+	}
+	drawLedRegions(white, leds)
+	return encodeJpeg(white)
+}
+
+// joinInts formats numbers as comma separated list.
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// lockCamera shows white screen, measures white balance and stores locked camera settings.
+func lockCamera(ctx context.Context, cal *calibrator) (CameraConfig, error) {
+	fmt.Println("Measuring exposure and white balance...")
+	// let automatic exposure settle on the white screen
+	img, err := cal.captureScreenColor(ctx, color.RGBA{255, 255, 255, 255}, cameraSettleTime)
+	if err != nil {
+		return CameraConfig{}, err
+	}
+	locked, err := Conf.CameraSettings().Lock(img, Conf.CameraQuad())
+	if err != nil {
+		return locked, err
+	}
+	Conf.Camera = &locked
+	if err := Conf.Write(); err != nil {
+		return locked, err
+	}
+	fmt.Printf("Camera locked with awb gains %.2f,%.2f\n", locked.AWBGains[0], locked.AWBGains[1])
+	return locked, nil
+}
+
+// calibrateCameraColors measures reference colors and stores the fitted color correction.
+func calibrateCameraColors(ctx context.Context, cal *calibrator) error {
+	fmt.Println("Measuring camera colors...")
+	capture := func(ctx context.Context, c color.RGBA) (*image.RGBA, error) {
+		return cal.captureScreenColor(ctx, c, colorSettleTime)
+	}
+	m, _, err := calibrateColors(ctx, capture, Conf.CameraQuad())
+	if err != nil {
+		return err
+	}
+	Conf.ColorCorrection = &m
+	if err := Conf.Write(); err != nil {
+		return err
+	}
+	fmt.Println("Stored color correction")
+	return nil
+}
+
+func tuneExposureCmd() *command {
+	var addr, display string
+	cmd := newCommand(
+		"tune-exposure",
+		"",
+		"Find camera shutter speed and ISO separating colors of the screen the best.",
+		func(fs *flag.FlagSet) error {
+			if fs.NArg() > 0 {
+				return usageErrorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+			}
+			if err := readConfig(); err != nil {
+				return err
+			}
+			return runTuneExposure(addr, display)
+		},
+	)
+	cmd.flags.StringVar(&addr, "addr", ":8081", "address of the calibration http server")
+	cmd.flags.StringVar(&display, "display", DisplayCanvas, "how calibration page shows patterns: canvas drawn by the browser or jpeg stream")
+	return cmd
+}
+
+func runTuneExposure(addr, display string) error {
+	lc := NewLifecycle(DefaultShutdownTimeout)
+	defer func() {
+		if err := lc.Shutdown(); err != nil {
+			mainLog.Error("shutdown failed", "err", err)
+		}
+	}()
+	cam := &piTuningCamera{}
+	lc.OnShutdown("camera", func(ctx context.Context) error {
+		cam.Close()
+		return nil
+	})
+	if err := serveCalibrationDisplay(lc.Context(), display); err != nil {
+		return err
+	}
+	serveHTTP(lc, addr)
+	fmt.Printf("Started calibration server at %s/calibration\n", serverURL(addr))
+	fmt.Println("Open website on calibrated screen and make it full screen")
+	fmt.Println("When you are ready press enter to start tuning")
+	if err := waitForEnter(lc.Context()); err != nil {
+		return err
+	}
+	if err := calibrationDisplay.Show(lc.Context(), tuningPattern()); err != nil {
+		return err
+	}
+	fmt.Println("Capturing patches with different exposures...")
+	result, err := tuneExposure(lc.Context(), cam, Conf.CameraSettings(), Conf.CameraQuad())
+	if err != nil {
+		return err
+	}
+	Conf.Camera = &result.Camera
+	if err := Conf.Write(); err != nil {
+		return err
+	}
+	fmt.Printf("Stored shutter speed %dus and ISO %d\n", result.Camera.ShutterSpeed, result.Camera.ISO)
+	return nil
+}
+
+func latencyTestCmd() *command {
+	var opts LatencyTestOptions
+	cmd := newCommand(
+		"latency-test",
+		"",
+		"Measure how far the leds lag the picture on the screen.",
+		func(fs *flag.FlagSet) error {
+			if fs.NArg() > 0 {
+				return usageErrorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+			}
+			if opts.Iterations < 1 {
+				return usageErrorf("--iterations must be positive")
+			}
+			if err := readConfig(); err != nil {
+				return err
+			}
+			return runLatencyTest(opts)
+		},
+	)
+	cmd.flags.StringVar(&opts.Addr, "addr", ":8081", "address of the calibration http server")
+	cmd.flags.StringVar(&opts.Display, "display", DisplayCanvas, "how calibration page shows patterns: canvas drawn by the browser or jpeg stream")
+	cmd.flags.IntVar(&opts.Iterations, "iterations", 30, "amount of measured flashes")
+	cmd.flags.BoolVar(&opts.Save, "save", false, "store median display delay as delay of images received over Hyperion API, so they show in sync with the screen")
+	return cmd
+}
+
+// LatencyTestOptions control behaviour of the latency-test command.
+type LatencyTestOptions struct {
+	Addr       string
+	Display    string
+	Iterations int
+	Save       bool
+}
+
+func runLatencyTest(opts LatencyTestOptions) error {
+	lc := NewLifecycle(DefaultShutdownTimeout)
+	defer func() {
+		if err := lc.Shutdown(); err != nil {
+			mainLog.Error("shutdown failed", "err", err)
+		}
+	}()
+	count := Conf.LedLayout().Count()
+	outputs, err := OpenOutputs(Conf.LedOutputs(), count)
+	if err != nil {
+		return err
+	}
+	pipeline := NewPipeline(count, outputs)
+	pipelineDone := make(chan struct{})
+	lc.OnShutdown("leds", func(ctx context.Context) error {
+		select {
+		case <-pipelineDone:
+		case <-ctx.Done():
+		}
+		return joinErrors([]error{outputs.Blank(count), outputs.Close()})
+	})
+	if err := serveCalibrationDisplay(lc.Context(), opts.Display); err != nil {
+		close(pipelineDone)
+		return err
+	}
+	test := newLatencyTest(newCalibrator(false), Conf.CameraLedRegions(), Conf.ColorCorrection, pipeline)
+	go func() {
+		defer close(pipelineDone)
+		pipeline.Run(lc.Context())
+	}()
+	camera, err := startCamera(Conf.CameraSettings())
+	if err != nil {
+		return err
+	}
+	lc.OnShutdown("camera", func(ctx context.Context) error {
+		camera.Stop()
+		return nil
+	})
+	serveCameraStream(lc.Context(), camera)
+	serveHTTP(lc, opts.Addr)
+	fmt.Printf("Started calibration server at %s/calibration\n", serverURL(opts.Addr))
+	fmt.Println("Open website on calibrated screen and make it full screen")
+	fmt.Println("When you are ready press enter to start measuring")
+	if err := waitForEnter(lc.Context()); err != nil {
+		return err
+	}
+	report, err := measureLatency(lc.Context(), test, opts.Iterations)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	fmt.Printf("Display to camera: %s\n", report.Display)
+	fmt.Printf("Processing:        %s\n", report.Processing)
+	fmt.Printf("Screen to leds:    %s\n", report.Total)
+	if !opts.Save {
+		return nil
+	}
+	Conf.ImageDelay = int(report.Display.P50 / time.Millisecond)
+	if err := Conf.Write(); err != nil {
+		return err
+	}
+	fmt.Printf("Stored image delay %dms\n", Conf.ImageDelay)
+	return nil
+}
+
+// waitForEnter blocks until user presses enter or the context is done.
+func waitForEnter(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		_, err := reader.ReadString('\n')
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func runCmd() *command {
+	var opts AmbilightOptions
+	var profile string
+	cmd := newCommand(
+		"run",
+		"",
+		"Capture camera frames and drive leds.",
+		func(fs *flag.FlagSet) error {
+			if err := readConfig(); err != nil {
+				return err
+			}
+			if profile != "" {
+				if err := setProfile(profile); err != nil {
+					return err
+				}
+			}
+			return startAmbilight(opts)
+		},
+	)
+	cmd.flags.DurationVar(&opts.ShutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout, "maximum time to release hardware on shutdown")
+	cmd.flags.DurationVar(&opts.WatchdogTimeout, "watchdog-timeout", 3*time.Second, "time without led update after which leds are blanked")
+	cmd.flags.DurationVar(&opts.FadeOut, "fade-out", time.Second, "duration of the fade out on shutdown")
+	cmd.flags.StringVar(&opts.HyperionAddr, "hyperion-addr", DefaultHyperionAddr, "address of Hyperion compatible JSON server, empty disables the server")
+	cmd.flags.StringVar(&opts.HTTPAddr, "addr", ":8080", "address of the http api, empty disables the api")
+	cmd.flags.DurationVar(&opts.Transition, "transition", DefaultTransition, "duration of the crossfade when the light mode changes")
+	cmd.flags.StringVar(&profile, "profile", "", "activate the profile at start and store it, switches made while running replace it, empty keeps the stored one")
+	return cmd
+}
+
+// serverURL returns base url for the http server listening on given address.
+func serverURL(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return "http://" + addr
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLedList(t *testing.T) {
+	report := &CalibrationReport{Leds: make([]LedCalibration, 32), Suspicious: []int{4, 17}}
+	for _, tc := range []struct {
+		name string
+		in   string
+		want []int
+		err  string
+	}{
+		{name: "single", in: "3", want: []int{3}},
+		{name: "range", in: "10-12", want: []int{10, 11, 12}},
+		{name: "reversed range", in: "12-10", want: []int{10, 11, 12}},
+		{name: "duplicates are sorted out", in: "5,1-3,2,5", want: []int{1, 2, 3, 5}},
+		{name: "spaces", in: " 0 , 31", want: []int{0, 31}},
+		{name: "suspicious", in: "suspicious", want: []int{4, 17}},
+		{name: "beyond last led", in: "30-32", err: "led range 30-32 is out of range (0-31)"},
+		{name: "negative", in: "-1", err: `"" is not a number`},
+		{name: "not a number", in: "3,x", err: `"x" is not a number`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseLedList(tc.in, report)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error is %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ConfigVersion is version of the config file written by this program.
+// Older files are upgraded by configMigrations when they're read.
+const ConfigVersion = 2
+
+// configMigration upgrades raw config file by a single version.
+type configMigration func(raw map[string]json.RawMessage) error
+
+// configMigrations are indexed by the version they upgrade from.
+var configMigrations = []configMigration{
+	0: migratePinDefaults,
+	1: migrateUniformLayout,
+}
+
+// migratePinDefaults stores camera settings and screen area, which were used when missing
+// in files without version, so changing the defaults doesn't change older setups.
+// Values are copied, they must stay the same even when the defaults change.
+func migratePinDefaults(raw map[string]json.RawMessage) error {
+	if isNull(raw["camera"]) {
+		raw["camera"] = json.RawMessage(`{"width":1640,"height":1232,"mode":4,"exposure":"verylong","awb":"auto","awbGains":[1,1],"brightness":60,"contrast":40,"saturation":0}`)
+	}
+	if isNull(raw["screenQuad"]) {
+		raw["screenQuad"] = json.RawMessage(`{"topLeft":{"X":58,"Y":70},"topRight":{"X":537,"Y":61},"bottomRight":{"X":560,"Y":334},"bottomLeft":{"X":27,"Y":343}}`)
+	}
+	return nil
+}
+
+// migrateUniformLayout replaces ledsX and ledsY by the layout, so the strip is described only one way.
+func migrateUniformLayout(raw map[string]json.RawMessage) error {
+	var x, y int
+	for key, v := range map[string]*int{"ledsX": &x, "ledsY": &y} {
+		if isNull(raw[key]) {
+			continue
+		}
+		if err := json.Unmarshal(raw[key], v); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		delete(raw, key)
+	}
+	if !isNull(raw["layout"]) {
+		return nil
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"top": x, "right": y, "bottom": x, "left": y,
+		"start":     map[string]interface{}{"edge": "top", "offset": 0},
+		"direction": "cw",
+	})
+	if err != nil {
+		return err
+	}
+	raw["layout"] = b
+	return nil
+}
+
+func isNull(v json.RawMessage) bool {
+	return len(v) == 0 || string(v) == "null"
+}
+
+// migrateConfig upgrades content of the config file to the current version.
+// Returns the version of the file before the upgrade.
+func migrateConfig(b []byte) ([]byte, int, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, 0, err
+	}
+	version := 0
+	if !isNull(raw["version"]) {
+		if err := json.Unmarshal(raw["version"], &version); err != nil {
+			return nil, 0, fmt.Errorf("invalid version: %s", err)
+		}
+	}
+	switch {
+	case version > ConfigVersion:
+		return nil, version, fmt.Errorf("version %d is newer than supported version %d, update %s", version, ConfigVersion, programName())
+	case version < 0:
+		return nil, version, fmt.Errorf("invalid version %d", version)
+	case version == ConfigVersion:
+		return b, version, nil
+	}
+	for v := version; v < ConfigVersion; v++ {
+		if err := configMigrations[v](raw); err != nil {
+			return nil, version, fmt.Errorf("upgrading from version %d: %s", v, err)
+		}
+	}
+	raw["version"] = json.RawMessage(fmt.Sprintf("%d", ConfigVersion))
+	b, err := json.Marshal(raw)
+	return b, version, err
+}
+
+// upgrade stores the migrated config, the original file is kept as a backup.
+func (c *Config) upgrade(original []byte, from int) error {
+	backup := fmt.Sprintf("%s.v%d.bak", c.Dest(), from)
+	if err := ioutil.WriteFile(backup, original, 0644); err != nil {
+		return err
+	}
+	if err := c.Write(); err != nil {
+		return err
+	}
+	mainLog.Info("config upgraded", "from", from, "to", ConfigVersion, "backup", backup)
+	return nil
+}
+
+// Read loads the config file, older versions are upgraded in place.
+func (c *Config) Read() error {
+	original, err := ioutil.ReadFile(c.Dest())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, from, err := migrateConfig(original)
+	if err != nil {
+		return fmt.Errorf("%s: %s", c.Dest(), err)
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("%s: %s", c.Dest(), err)
+	}
+	if from == ConfigVersion {
+		return nil
+	}
+	return c.upgrade(original, from)
+}
+
+// Validate checks all fields and reports every problem found.
+func (c *Config) Validate() error {
+	var errs []error
+	// field is empty when the error already names it
+	check := func(field string, err error) {
+		if err != nil && field != "" {
+			err = fmt.Errorf("%s: %s", field, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.ScreenWidth <= 0 || c.ScreenHeight <= 0 {
+		check("screenWidth, screenHeight", fmt.Errorf("screen size %dx%d must be positive", c.ScreenWidth, c.ScreenHeight))
+	}
+	layout := c.LedLayout()
+	if err := layout.Validate(); err != nil {
+		check("layout", err)
+	} else if c.ScreenWidth > 0 && c.ScreenHeight > 0 {
+		check("layout", layout.fitsScreen(c.ScreenWidth, c.ScreenHeight, c.Depth()))
+	}
+	count := layout.Count()
+	if c.LedDepth < 0 {
+		check("ledDepth", fmt.Errorf("can't be negative"))
+	}
+	camera := c.CameraSettings()
+	check("", camera.Validate())
+	if c.ScreenQuad != nil {
+		check("screenQuad", c.ScreenQuad.fitsFrame(camera.Width, camera.Height))
+	}
+	for _, out := range c.Outputs {
+		check("", out.Validate(count))
+	}
+	if c.MQTT != nil {
+		check("mqtt", c.MQTT.Validate())
+	}
+	if c.ScreenOff != nil {
+		check("screenOff", c.ScreenOff.Validate())
+	}
+	if len(c.LedRegions) > 0 && len(c.LedRegions) != count {
+		check("ledRegions", fmt.Errorf("%d regions don't match %d leds of the layout, run calibration again", len(c.LedRegions), count))
+	}
+	if c.ImageDelay < 0 {
+		check("imageDelay", fmt.Errorf("can't be negative"))
+	}
+	if c.Smoothing < 0 || c.Smoothing >= 1 {
+		check("smoothing", fmt.Errorf("%g must be within 0-1 range, 1 excluded", c.Smoothing))
+	}
+	if c.Light != nil {
+		check("light", c.Light.Validate(DefaultEffects()))
+	}
+	if len(errs) == 0 {
+		// profiles would repeat problems of the base settings
+		errs = c.validateProfiles()
+	}
+	return joinErrors(errs)
+}
+
+// fitsScreen checks that each led slot covers at least one pixel and leds of opposite edges don't overlap.
+func (l *Layout) fitsScreen(width, height, depth int) error {
+	var problems []string
+	for _, e := range []struct {
+		name  string
+		slots int
+		size  int
+	}{
+		{"top", l.EdgeSlots(EdgeTop), width}, {"bottom", l.EdgeSlots(EdgeBottom), width},
+		{"right", l.EdgeSlots(EdgeRight), height}, {"left", l.EdgeSlots(EdgeLeft), height},
+	} {
+		if e.slots > e.size {
+			problems = append(problems, fmt.Sprintf("%d leds on %s edge don't fit into %d pixels of the screen", e.slots, e.name, e.size))
+		}
+	}
+	if 2*depth > width || 2*depth > height {
+		problems = append(problems, fmt.Sprintf("led depth %d is more than half of the screen %dx%d", depth, width, height))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// fitsFrame checks that corners of the screen area are within the camera frame.
+func (q Quad) fitsFrame(width, height int) error {
+	frame := image.Rect(0, 0, width, height)
+	for _, p := range []image.Point{q.TopLeft, q.TopRight, q.BottomRight, q.BottomLeft} {
+		if !p.In(frame) {
+			return fmt.Errorf("corner %s is outside of the %dx%d camera frame", p, width, height)
+		}
+	}
+	return nil
+}
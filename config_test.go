@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	pinnedCamera = `{"width":1640,"height":1232,"mode":4,"exposure":"verylong","awb":"auto","awbGains":[1,1],"brightness":60,"contrast":40,"saturation":0}`
+	pinnedQuad   = `{"topLeft":{"X":58,"Y":70},"topRight":{"X":537,"Y":61},"bottomRight":{"X":560,"Y":334},"bottomLeft":{"X":27,"Y":343}}`
+)
+
+func uniformLayoutJSON(x, y string) string {
+	return `{"top":` + x + `,"right":` + y + `,"bottom":` + x + `,"left":` + y + `,"start":{"edge":"top","offset":0},"direction":"cw"}`
+}
+
+func TestMigrateConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		in      string
+		want    string
+		version int
+		err     string
+	}{
+		{
+			name:    "v0 pins defaults and converts leds",
+			in:      `{"screenWidth":3840,"screenHeight":2160,"ledsX":10,"ledsY":6}`,
+			want:    `{"version":2,"screenWidth":3840,"screenHeight":2160,"camera":` + pinnedCamera + `,"screenQuad":` + pinnedQuad + `,"layout":` + uniformLayoutJSON("10", "6") + `}`,
+			version: 0,
+		},
+		{
+			name:    "v0 keeps stored camera and quad",
+			in:      `{"ledsX":2,"ledsY":1,"camera":{"width":640},"screenQuad":null}`,
+			want:    `{"version":2,"camera":{"width":640},"screenQuad":` + pinnedQuad + `,"layout":` + uniformLayoutJSON("2", "1") + `}`,
+			version: 0,
+		},
+		{
+			name:    "v1 converts leds",
+			in:      `{"version":1,"ledsX":4,"ledsY":2}`,
+			want:    `{"version":2,"layout":` + uniformLayoutJSON("4", "2") + `}`,
+			version: 1,
+		},
+		{
+			name:    "v1 keeps existing layout",
+			in:      `{"version":1,"ledsX":4,"ledsY":2,"layout":{"top":1}}`,
+			want:    `{"version":2,"layout":{"top":1}}`,
+			version: 1,
+		},
+		{
+			name:    "current version is unchanged",
+			in:      `{"version":2,"ledsX":4}`,
+			want:    `{"version":2,"ledsX":4}`,
+			version: 2,
+		},
+		{name: "newer version", in: `{"version":3}`, version: 3, err: "version 3 is newer than supported version 2"},
+		{name: "negative version", in: `{"version":-1}`, version: -1, err: "invalid version -1"},
+		{name: "invalid version", in: `{"version":"2"}`, err: "invalid version"},
+		{name: "invalid leds", in: `{"version":1,"ledsX":"4"}`, version: 1, err: "upgrading from version 1: ledsX"},
+		{name: "invalid json", in: `{`, err: "unexpected end of JSON input"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, version, err := migrateConfig([]byte(tc.in))
+			if version != tc.version {
+				t.Errorf("version is %d, want %d", version, tc.version)
+			}
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error is %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tc.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %s\nwant %s", b, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadUpgradesFileWithBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	original := []byte(`{"screenWidth":3840,"screenHeight":2160,"ledsX":10,"ledsY":6}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{dir: dir}
+	if err := c.Read(); err != nil {
+		t.Fatalf("reading failed: %s", err)
+	}
+	if c.Version != ConfigVersion || c.Camera == nil || c.ScreenQuad == nil {
+		t.Errorf("config wasn't upgraded: %+v", c)
+	}
+	if l := c.LedLayout(); l.Top != 10 || l.Left != 6 {
+		t.Errorf("layout is %+v, want 10x6", l)
+	}
+	backup, err := ioutil.ReadFile(filepath.Join(dir, "config.json.v0.bak"))
+	if err != nil {
+		t.Fatalf("backup wasn't written: %s", err)
+	}
+	if string(backup) != string(original) {
+		t.Errorf("backup is %s, want the original file", backup)
+	}
+	stored := &Config{dir: dir}
+	if err := stored.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if !sameJSON(stored, c) {
+		t.Errorf("stored config differs from the upgraded one")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "config.json.v2.bak")); !os.IsNotExist(err) {
+		t.Errorf("current version was backed up again")
+	}
+}
+
+func TestReadRejectsNewerVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	original := []byte(`{"version":99}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Config{dir: dir}).Read(); err == nil {
+		t.Fatal("newer version was accepted")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil || string(b) != string(original) {
+		t.Errorf("file was changed to %s, %v", b, err)
+	}
+}
+
+func TestValidateReportsAllFields(t *testing.T) {
+	valid := func() *Config {
+		return &Config{ScreenWidth: 3840, ScreenHeight: 2160, Layout: NewUniformLayout(10, 6)}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("valid config rejected: %s", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		change func(c *Config)
+		errs   []string
+	}{
+		{
+			name: "several fields",
+			change: func(c *Config) {
+				c.LedDepth = -1
+				c.ImageDelay = -5
+				c.Smoothing = 1
+			},
+			errs: []string{"ledDepth: can't be negative", "imageDelay: can't be negative", "smoothing: 1 must be within 0-1 range"},
+		},
+		{
+			name: "screen and regions",
+			change: func(c *Config) {
+				c.ScreenWidth = 0
+				c.LedRegions = make([]image.Rectangle, 3)
+			},
+			errs: []string{"screenWidth, screenHeight: screen size 0x2160 must be positive", "ledRegions: 3 regions don't match 32 leds"},
+		},
+		{
+			name: "outputs name themselves",
+			change: func(c *Config) {
+				c.Outputs = []*OutputConfig{
+					{Name: "a", Driver: "foo"},
+					{Name: "b", Driver: "ws2801", SPI: &SPIConfig{}, Range: &LedRange{0, 40}},
+				}
+			},
+			errs: []string{`output "a": unknown driver "foo"`, `output "b": range 0-40 is out of layout (0-31)`},
+		},
+		{
+			name: "profiles are skipped while base settings are invalid",
+			change: func(c *Config) {
+				c.Smoothing = -1
+				c.Profiles = map[string]json.RawMessage{"night": json.RawMessage(`{"smoothing":2}`)}
+			},
+			errs: []string{"smoothing: -1 must be"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := valid()
+			tc.change(c)
+			err := c.Validate()
+			if err == nil {
+				t.Fatal("invalid config accepted")
+			}
+			msgs := strings.Split(err.Error(), "; ")
+			if len(msgs) != len(tc.errs) {
+				t.Fatalf("got %d errors, want %d: %s", len(msgs), len(tc.errs), err)
+			}
+			for i, want := range tc.errs {
+				if !strings.HasPrefix(msgs[i], want) {
+					t.Errorf("error %d is %q, want %q", i, msgs[i], want)
+				}
+			}
+		})
+	}
+}
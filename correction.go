@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// referenceColors are shown full screen to measure how the camera sees them.
+var referenceColors = []color.RGBA{
+	{0, 0, 0, 255}, {64, 64, 64, 255}, {128, 128, 128, 255}, {192, 192, 192, 255}, {255, 255, 255, 255},
+	{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255},
+	{0, 255, 255, 255}, {255, 0, 255, 255}, {255, 255, 0, 255},
+	{255, 128, 0, 255}, {128, 0, 255, 255}, {0, 128, 64, 255},
+}
+
+// ColorMatrix is an affine transformation from camera RGB into the intended RGB.
+// Each row computes one output channel from red, green, blue and a constant offset.
+type ColorMatrix [3][4]float64
+
+// IdentityColorMatrix leaves colors intact.
+func IdentityColorMatrix() ColorMatrix {
+	return ColorMatrix{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}}
+}
+
+// Apply corrects single color.
+func (m *ColorMatrix) Apply(c color.RGBA) color.RGBA {
+	in := [4]float64{float64(c.R), float64(c.G), float64(c.B), 255}
+	var out [3]uint8
+	for ch, row := range m {
+		var v float64
+		for i, k := range row {
+			v += k * in[i]
+		}
+		out[ch] = uint8(math.Round(math.Max(0, math.Min(v, 255))))
+	}
+	return color.RGBA{out[0], out[1], out[2], c.A}
+}
+
+// ApplyAll corrects colors in place.
+func (m *ColorMatrix) ApplyAll(colors []color.RGBA) {
+	for i, c := range colors {
+		colors[i] = m.Apply(c)
+	}
+}
+
+// ColorResponse is a mean color captured by the camera while the reference color was shown.
+type ColorResponse struct {
+	Reference color.RGBA
+	Measured  [3]float64
+}
+
+// FitColorMatrix finds matrix mapping measured colors to the references with the least squared error.
+func FitColorMatrix(responses []ColorResponse) (ColorMatrix, error) {
+	var m ColorMatrix
+	if len(responses) < 4 {
+		return m, fmt.Errorf("at least 4 color responses are required, got %d", len(responses))
+	}
+	// normal equations are shared by all channels, only the right side differs
+	var ata [4][4]float64
+	var aty [3][4]float64
+	for _, r := range responses {
+		x := [4]float64{r.Measured[0], r.Measured[1], r.Measured[2], 255}
+		y := [3]float64{float64(r.Reference.R), float64(r.Reference.G), float64(r.Reference.B)}
+		for i := range x {
+			for j := range x {
+				ata[i][j] += x[i] * x[j]
+			}
+			for ch := range y {
+				aty[ch][i] += x[i] * y[ch]
+			}
+		}
+	}
+	for ch := range m {
+		row, err := solve4(ata, aty[ch])
+		if err != nil {
+			return m, err
+		}
+		m[ch] = row
+	}
+	return m, nil
+}
+
+// solve4 solves system of linear equations by Gaussian elimination with partial pivoting.
+func solve4(a [4][4]float64, b [4]float64) ([4]float64, error) {
+	var x [4]float64
+	for col := 0; col < 4; col++ {
+		pivot := col
+		for row := col + 1; row < 4; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-9 {
+			return x, fmt.Errorf("camera responses don't distinguish colors, can't fit color correction")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for row := col + 1; row < 4; row++ {
+			f := a[row][col] / a[col][col]
+			for k := col; k < 4; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+			b[row] -= f * b[col]
+		}
+	}
+	for row := 3; row >= 0; row-- {
+		v := b[row]
+		for k := row + 1; k < 4; k++ {
+			v -= a[row][k] * x[k]
+		}
+		x[row] = v / a[row][row]
+	}
+	return x, nil
+}
+
+// screenMean returns mean color of the screen area, borders are skipped as they may be cropped or blurred
+// and the marker as it doesn't have the screen color.
+func screenMean(frame *image.RGBA, q Quad) ([3]float64, error) {
+	var sum [3]float64
+	n := 0
+	for i := 0; i < screenSamples; i++ {
+		for j := 0; j < screenSamples; j++ {
+			u, v := 0.1+0.8*float64(i)/(screenSamples-1), 0.1+0.8*float64(j)/(screenSamples-1)
+			if markerContains(u, v) {
+				continue
+			}
+			pt := q.Map(u, v)
+			if !pt.In(frame.Rect) {
+				continue
+			}
+			c := frame.RGBAAt(pt.X, pt.Y)
+			sum[0] += float64(c.R)
+			sum[1] += float64(c.G)
+			sum[2] += float64(c.B)
+			n++
+		}
+	}
+	if n == 0 {
+		return sum, fmt.Errorf("screen isn't visible in the camera frame")
+	}
+	for ch := range sum {
+		sum[ch] /= float64(n)
+	}
+	return sum, nil
+}
+
+// calibrateColors shows each reference color using the capture function, which returns
+// the camera frame of the screen, and fits the color correction.
+func calibrateColors(ctx context.Context, capture func(ctx context.Context, c color.RGBA) (*image.RGBA, error), q Quad) (ColorMatrix, []ColorResponse, error) {
+	responses := make([]ColorResponse, 0, len(referenceColors))
+	for _, ref := range referenceColors {
+		frame, err := capture(ctx, ref)
+		if err != nil {
+			return ColorMatrix{}, nil, err
+		}
+		measured, err := screenMean(frame, q)
+		if err != nil {
+			return ColorMatrix{}, nil, err
+		}
+		responses = append(responses, ColorResponse{Reference: ref, Measured: measured})
+	}
+	m, err := FitColorMatrix(responses)
+	return m, responses, err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFitColorMatrix(t *testing.T) {
+	// camera lifts blacks of red, leaks red into green and darkens blue
+	camera := func(c color.RGBA) [3]float64 {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		return [3]float64{0.8*r + 20, 0.1*r + 0.85*g + 5, 0.7 * b}
+	}
+	// inverse of the camera, offsets are multiplied by 255 in the matrix
+	want := ColorMatrix{
+		{1.25, 0, 0, -25. / 255},
+		{-0.125 / 0.85, 1 / 0.85, 0, -2.5 / 0.85 / 255},
+		{0, 0, 1 / 0.7, 0},
+	}
+	var responses []ColorResponse
+	for _, ref := range referenceColors {
+		responses = append(responses, ColorResponse{Reference: ref, Measured: camera(ref)})
+	}
+	m, err := FitColorMatrix(responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ch := range want {
+		for i := range want[ch] {
+			if math.Abs(m[ch][i]-want[ch][i]) > 1e-9 {
+				t.Errorf("m[%d][%d] is %g, want %g", ch, i, m[ch][i], want[ch][i])
+			}
+		}
+	}
+	for _, r := range responses {
+		measured := color.RGBA{uint8(math.Round(r.Measured[0])), uint8(math.Round(r.Measured[1])), uint8(math.Round(r.Measured[2])), 255}
+		got := m.Apply(measured)
+		for ch, d := range []int{int(got.R) - int(r.Reference.R), int(got.G) - int(r.Reference.G), int(got.B) - int(r.Reference.B)} {
+			// measured colors are rounded before the correction
+			if d < -1 || d > 1 {
+				t.Errorf("corrected %v is %v, want %v (channel %d)", measured, got, r.Reference, ch)
+			}
+		}
+	}
+}
+
+func TestFitColorMatrixRejects(t *testing.T) {
+	gray := make([]ColorResponse, len(referenceColors))
+	for i, ref := range referenceColors {
+		// camera sees only brightness, so channels can't be told apart
+		v := (float64(ref.R) + float64(ref.G) + float64(ref.B)) / 3
+		gray[i] = ColorResponse{Reference: ref, Measured: [3]float64{v, v, v}}
+	}
+	for _, tc := range []struct {
+		name      string
+		responses []ColorResponse
+		err       string
+	}{
+		{"too few", gray[:3], "at least 4 color responses are required, got 3"},
+		{"singular", gray, "don't distinguish colors"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := FitColorMatrix(tc.responses)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error is %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestSolve4(t *testing.T) {
+	// first column is zero on the diagonal, so rows have to be swapped
+	a := [4][4]float64{
+		{0, 2, 0, 1},
+		{1, 0, 0, 0},
+		{0, 1, 3, 0},
+		{2, 0, 1, 4},
+	}
+	want := [4]float64{1, -2, 3, 0.5}
+	var b [4]float64
+	for i := range a {
+		for j := range a[i] {
+			b[i] += a[i][j] * want[j]
+		}
+	}
+	x, err := solve4(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range x {
+		if math.Abs(x[i]-want[i]) > 1e-12 {
+			t.Errorf("x is %v, want %v", x, want)
+			break
+		}
+	}
+	a[3] = [4]float64{1, 2, 3, 1}
+	a[2] = [4]float64{2, 4, 6, 2}
+	if _, err := solve4(a, b); err == nil {
+		t.Error("singular system solved")
+	}
+}
+
+func TestColorMatrixApplyClamps(t *testing.T) {
+	m := ColorMatrix{{2, 0, 0, 0}, {0, 1, 0, -0.5}, {0, 0, 1, 0}}
+	got := m.Apply(color.RGBA{200, 100, 50, 7})
+	if want := (color.RGBA{255, 0, 50, 7}); got != want {
+		t.Errorf("corrected color is %v, want %v", got, want)
+	}
+}
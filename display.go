@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Display modes of the calibration page.
+const (
+	DisplayCanvas = "canvas"
+	DisplayJpeg   = "jpeg"
+)
+
+// paintTimeout is maximum time to wait until the calibration page paints the pattern.
+const paintTimeout = 10 * time.Second
+
+// jpegPaintDelay is time given to the browser to show the jpeg, it doesn't confirm painting.
+const jpegPaintDelay = 300 * time.Millisecond
+
+// PatternRect is an area of the screen in normalized coordinates (0-1) filled with the color.
+type PatternRect struct {
+	X     float64     `json:"x"`
+	Y     float64     `json:"y"`
+	W     float64     `json:"w"`
+	H     float64     `json:"h"`
+	Color effectColor `json:"color"`
+}
+
+// GrayCodePattern draws stripes where the given bit of Gray code of the pixel coordinate is set.
+type GrayCodePattern struct {
+	// Axis is "x" for vertical stripes or "y" for horizontal ones.
+	Axis string `json:"axis"`
+	Bit  int    `json:"bit"`
+	// Inverted swaps black and white stripes.
+	Inverted bool `json:"inverted,omitempty"`
+}
+
+// Pattern is a calibration screen drawn over the background color.
+type Pattern struct {
+	ID         int              `json:"id"`
+	Background effectColor      `json:"background"`
+	Rects      []PatternRect    `json:"rects,omitempty"`
+	GrayCode   *GrayCodePattern `json:"grayCode,omitempty"`
+	// Led is index of the led the pattern calibrates, pre-generated jpeg is used for it when available.
+	Led *int `json:"-"`
+	// Marker is code of the handshake marker, which is drawn also over the pre-generated jpeg.
+	Marker *int `json:"-"`
+}
+
+// ColorPattern fills the whole screen with the color.
+func ColorPattern(c color.RGBA) Pattern {
+	return Pattern{Background: effectColor{c.R, c.G, c.B}}
+}
+
+// LedPattern lights the screen region of the led.
+func LedPattern(c *Config, index int) (Pattern, error) {
+	rects := c.LedLayout().ScreenRegions(c.ScreenWidth, c.ScreenHeight, c.Depth())
+	if index < 0 || index >= len(rects) {
+		return Pattern{}, fmt.Errorf("led %d is out of range (0-%d)", index, len(rects)-1)
+	}
+	r := rects[index]
+	w, h := float64(c.ScreenWidth), float64(c.ScreenHeight)
+	return Pattern{
+		Rects: []PatternRect{{
+			X: float64(r.Min.X) / w, Y: float64(r.Min.Y) / h,
+			W: float64(r.Dx()) / w, H: float64(r.Dy()) / h,
+			Color: effectColor{255, 255, 255},
+		}},
+		Led: &index,
+	}, nil
+}
+
+// Render draws the pattern into the image of the screen size.
+func (p *Pattern) Render(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Rect, &image.Uniform{p.Background.RGBA()}, image.Point{}, draw.Src)
+	drawPatternRects(img, p.Rects)
+	if g := p.GrayCode; g != nil {
+		size := width
+		if g.Axis == "y" {
+			size = height
+		}
+		for i := 0; i < size; i++ {
+			lit := (i^(i>>1))>>uint(g.Bit)&1 == 1
+			if lit == g.Inverted {
+				continue
+			}
+			rect := image.Rect(i, 0, i+1, height)
+			if g.Axis == "y" {
+				rect = image.Rect(0, i, width, i+1)
+			}
+			draw.Draw(img, rect, image.White, image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
+
+// drawPatternRects draws normalized rectangles over the whole image.
+func drawPatternRects(img *image.RGBA, rects []PatternRect) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	for _, r := range rects {
+		rect := image.Rect(
+			int(r.X*float64(width)), int(r.Y*float64(height)),
+			int((r.X+r.W)*float64(width)), int((r.Y+r.H)*float64(height)),
+		)
+		draw.Draw(img, rect, &image.Uniform{r.Color.RGBA()}, image.Point{}, draw.Src)
+	}
+}
+
+// CalibrationDisplay shows patterns on the calibrated screen.
+type CalibrationDisplay interface {
+	// Show returns once the pattern is visible on the screen.
+	Show(ctx context.Context, p Pattern) error
+}
+
+var calibrationDisplay CalibrationDisplay
+
+// serveCalibrationDisplay registers calibration page using the given display mode.
+func serveCalibrationDisplay(ctx context.Context, mode string) error {
+	switch mode {
+	case DisplayJpeg:
+		serveCalibrationStream(ctx)
+		calibrationDisplay = jpegDisplay{}
+	case DisplayCanvas:
+		d := newCanvasDisplay()
+		http.Handle("/calibration-ws", d)
+		http.HandleFunc("/calibration", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, "calibration-canvas.html")
+		})
+		go func() {
+			<-ctx.Done()
+			d.Close()
+		}()
+		calibrationDisplay = d
+	default:
+		return fmt.Errorf("unknown display %q: must be %q or %q", mode, DisplayCanvas, DisplayJpeg)
+	}
+	return nil
+}
+
+// jpegDisplay streams patterns rendered on the server as mjpeg.
+type jpegDisplay struct{}
+
+func (jpegDisplay) Show(ctx context.Context, p Pattern) error {
+	b, err := calibrationScreen(Conf, p)
+	if err != nil {
+		return err
+	}
+	showCalibrationImage(b)
+	select {
+	case <-time.After(jpegPaintDelay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// canvasDisplay sends patterns over websocket to the calibration page, which draws them
+// on the canvas and confirms each painted pattern.
+type canvasDisplay struct {
+	upgrader websocket.Upgrader
+	mu       sync.Mutex
+	conns    map[*websocket.Conn]*sync.Mutex
+	current  *Pattern
+	nextID   int
+	acks     chan int
+}
+
+type paintAck struct {
+	ID int `json:"id"`
+}
+
+func newCanvasDisplay() *canvasDisplay {
+	return &canvasDisplay{conns: make(map[*websocket.Conn]*sync.Mutex), acks: make(chan int, 16)}
+}
+
+func (d *canvasDisplay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := d.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		httpLog.Warn("calibration page connection failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	wmu := &sync.Mutex{}
+	d.mu.Lock()
+	d.conns[conn] = wmu
+	current := d.current
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.conns, conn)
+		d.mu.Unlock()
+		conn.Close()
+	}()
+	// page opened late still paints the pattern which is waited for
+	if current != nil {
+		if err := writePattern(conn, wmu, current); err != nil {
+			return
+		}
+	}
+	for {
+		var ack paintAck
+		if err := conn.ReadJSON(&ack); err != nil {
+			return
+		}
+		select {
+		case d.acks <- ack.ID:
+		default:
+		}
+	}
+}
+
+func writePattern(conn *websocket.Conn, mu *sync.Mutex, p *Pattern) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return conn.WriteJSON(p)
+}
+
+func (d *canvasDisplay) Show(ctx context.Context, p Pattern) error {
+	d.mu.Lock()
+	d.nextID++
+	p.ID = d.nextID
+	d.current = &p
+	conns := make(map[*websocket.Conn]*sync.Mutex, len(d.conns))
+	for conn, mu := range d.conns {
+		conns[conn] = mu
+	}
+	d.mu.Unlock()
+	for conn, mu := range conns {
+		if err := writePattern(conn, mu, &p); err != nil {
+			calibratorLog.Warn("sending pattern failed", "remote", conn.RemoteAddr(), "err", err)
+		}
+	}
+	timeout := time.NewTimer(paintTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case id := <-d.acks:
+			if id == p.ID {
+				return nil
+			}
+		case <-timeout.C:
+			return fmt.Errorf("calibration page didn't paint the pattern within %s, make sure it's open", paintTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close disconnects all calibration pages.
+func (d *canvasDisplay) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for conn := range d.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestPatternRenderGrayCode(t *testing.T) {
+	// Gray codes of 0-7 are 0, 1, 3, 2, 6, 7, 5, 4
+	for _, tc := range []struct {
+		name    string
+		pattern GrayCodePattern
+		stripes string
+	}{
+		{"bit 0", GrayCodePattern{Axis: "x", Bit: 0}, ".##..##."},
+		{"bit 1", GrayCodePattern{Axis: "x", Bit: 1}, "..####.."},
+		{"bit 2", GrayCodePattern{Axis: "x", Bit: 2}, "....####"},
+		{"inverted", GrayCodePattern{Axis: "x", Bit: 1, Inverted: true}, "##....##"},
+		{"horizontal", GrayCodePattern{Axis: "y", Bit: 0}, ".##..##."},
+		{"bit beyond size", GrayCodePattern{Axis: "x", Bit: 3}, "........"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := tc.pattern
+			p := Pattern{GrayCode: &g}
+			// the other axis is shorter, so stripes are checked across the whole image
+			width, height := 8, 3
+			if g.Axis == "y" {
+				width, height = 3, 8
+			}
+			img := p.Render(width, height)
+			for i, s := range tc.stripes {
+				want := color.RGBA{A: 255}
+				if s == '#' {
+					want = color.RGBA{255, 255, 255, 255}
+				}
+				for j := 0; j < 3; j++ {
+					x, y := i, j
+					if g.Axis == "y" {
+						x, y = j, i
+					}
+					if c := img.RGBAAt(x, y); c != want {
+						t.Errorf("pixel %d,%d is %v, want %v", x, y, c, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPatternRenderRects(t *testing.T) {
+	p := Pattern{
+		Background: effectColor{10, 20, 30},
+		Rects:      []PatternRect{{X: 0.5, Y: 0, W: 0.5, H: 0.5, Color: effectColor{255, 0, 0}}},
+	}
+	img := p.Render(4, 4)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			want := color.RGBA{10, 20, 30, 255}
+			if x >= 2 && y < 2 {
+				want = color.RGBA{255, 0, 0, 255}
+			}
+			if c := img.RGBAAt(x, y); c != want {
+				t.Errorf("pixel %d,%d is %v, want %v", x, y, c, want)
+			}
+		}
+	}
+}
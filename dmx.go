@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"image/color"
+	"net"
+	"strconv"
+)
+
+const (
+	dmxChannels         = 512
+	pixelsPerUniverse   = 170
+	E131Port            = 5568
+	ArtNetPort          = 6454
+	defaultE131Source   = "rpi-cam-ambilight"
+	defaultE131Priority = 100
+)
+
+// NetworkConfig describes network transport of E1.31 and Art-Net devices.
+type NetworkConfig struct {
+	// Address of the receiver, port is optional. Ignored when Multicast is set.
+	Address string `json:"address,omitempty"`
+	// Multicast sends E1.31 data to the multicast group of each universe
+	// and Art-Net data as broadcast to Address or to all hosts of the local network.
+	Multicast bool `json:"multicast,omitempty"`
+	// StartUniverse is the universe of the first led.
+	StartUniverse int `json:"startUniverse"`
+	// StartChannel is 1-based DMX channel of the first led within the start universe.
+	StartChannel int `json:"startChannel,omitempty"`
+	// Priority of the E1.31 source, 0-200.
+	Priority int `json:"priority,omitempty"`
+	// SourceName of the E1.31 source.
+	SourceName string `json:"sourceName,omitempty"`
+}
+
+func (c *NetworkConfig) Validate(driver string) error {
+	if !c.Multicast && c.Address == "" {
+		return fmt.Errorf("address is required for unicast")
+	}
+	maxUniverse := 63999
+	if driver == "artnet" {
+		maxUniverse = 1<<15 - 1
+	}
+	if c.StartUniverse < 0 || c.StartUniverse > maxUniverse || driver == "e131" && c.StartUniverse == 0 {
+		return fmt.Errorf("start universe %d is out of range", c.StartUniverse)
+	}
+	if c.StartChannel < 0 || c.StartChannel > dmxChannels-2 {
+		return fmt.Errorf("start channel %d is out of range (1-%d)", c.StartChannel, dmxChannels-2)
+	}
+	if c.Priority < 0 || c.Priority > 200 {
+		return fmt.Errorf("priority %d is out of range (0-200)", c.Priority)
+	}
+	if len(c.SourceName) > 63 {
+		return fmt.Errorf("source name can't be longer than 63 bytes")
+	}
+	return nil
+}
+
+// dmxUniverse is a part of the strip transmitted within a single universe.
+type dmxUniverse struct {
+	Universe int
+	// Offset of the first channel within the universe.
+	Offset int
+	From   int
+	To     int
+}
+
+// splitUniverses splits leds into universes, so no pixel is split between two universes.
+// First universe holds leds starting at startChannel, following ones start at the first channel.
+func splitUniverses(amountOfLeds, startUniverse, startChannel int) []dmxUniverse {
+	offset := 0
+	if startChannel > 0 {
+		offset = startChannel - 1
+	}
+	var universes []dmxUniverse
+	for from := 0; from < amountOfLeds; {
+		n := (dmxChannels - offset) / 3
+		if n > pixelsPerUniverse {
+			n = pixelsPerUniverse
+		}
+		to := from + n
+		if to > amountOfLeds {
+			to = amountOfLeds
+		}
+		universes = append(universes, dmxUniverse{startUniverse + len(universes), offset, from, to})
+		from = to
+		offset = 0
+	}
+	return universes
+}
+
+// dmxPacketSender writes DMX data of all universes into UDP packets.
+type dmxPacketSender struct {
+	conn      *net.UDPConn
+	count     int
+	universes []dmxUniverse
+	sequence  []byte
+	dest      func(universe int) *net.UDPAddr
+}
+
+func newDMXPacketSender(c *NetworkConfig, amountOfLeds int, dest func(universe int) *net.UDPAddr) (*dmxPacketSender, error) {
+	if amountOfLeds <= 0 {
+		return nil, fmt.Errorf("amount of leds should be greater than zero")
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	universes := splitUniverses(amountOfLeds, c.StartUniverse, c.StartChannel)
+	return &dmxPacketSender{
+		conn:      conn,
+		count:     amountOfLeds,
+		universes: universes,
+		sequence:  make([]byte, len(universes)),
+		dest:      dest,
+	}, nil
+}
+
+// write sends packet for each universe. Packet function gets index of the universe
+// and DMX data, and returns whole packet.
+func (s *dmxPacketSender) write(colors []color.RGBA, packet func(i int, u dmxUniverse, data []byte) []byte) error {
+	if len(colors) > s.count {
+		return fmt.Errorf("received %d colors for %d leds", len(colors), s.count)
+	}
+	for i, u := range s.universes {
+		// DMX data always starts at the first channel of the universe, so channels
+		// before the start channel are filled with zeros by the sender
+		data := make([]byte, u.Offset+(u.To-u.From)*3)
+		for j := u.From; j < u.To && j < len(colors); j++ {
+			c := colors[j]
+			k := u.Offset + (j-u.From)*3
+			data[k], data[k+1], data[k+2] = c.R, c.G, c.B
+		}
+		if _, err := s.conn.WriteToUDP(packet(i, u, data), s.dest(u.Universe)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveUDPAddr(address string, defaultPort int) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(defaultPort))
+	}
+	return net.ResolveUDPAddr("udp4", address)
+}
+
+// E131Led sends colors as E1.31 (streaming ACN) data packets.
+type E131Led struct {
+	*dmxPacketSender
+	cid      [16]byte
+	source   string
+	priority byte
+}
+
+func NewE131Led(c *NetworkConfig, amountOfLeds int) (*E131Led, error) {
+	var dest func(universe int) *net.UDPAddr
+	if c.Multicast {
+		dest = func(universe int) *net.UDPAddr {
+			return &net.UDPAddr{IP: net.IPv4(239, 255, byte(universe>>8), byte(universe)), Port: E131Port}
+		}
+	} else {
+		addr, err := resolveUDPAddr(c.Address, E131Port)
+		if err != nil {
+			return nil, err
+		}
+		dest = func(int) *net.UDPAddr { return addr }
+	}
+	sender, err := newDMXPacketSender(c, amountOfLeds, dest)
+	if err != nil {
+		return nil, err
+	}
+	led := &E131Led{dmxPacketSender: sender, source: c.SourceName, priority: byte(c.Priority)}
+	if led.source == "" {
+		led.source = defaultE131Source
+	}
+	if led.priority == 0 {
+		led.priority = defaultE131Priority
+	}
+	if _, err := rand.Read(led.cid[:]); err != nil {
+		sender.conn.Close()
+		return nil, err
+	}
+	// mark CID as random UUID
+	led.cid[6] = led.cid[6]&0x0f | 0x40
+	led.cid[8] = led.cid[8]&0x3f | 0x80
+	return led, nil
+}
+
+// e131Packet builds E1.31 data packet with root, framing and DMP layers.
+func e131Packet(cid [16]byte, source string, priority, sequence byte, universe int, data []byte) []byte {
+	p := make([]byte, 126+len(data))
+	binary.BigEndian.PutUint16(p[0:], 0x0010) // preamble size
+	copy(p[4:], "ASC-E1.17\x00\x00\x00")
+	// root layer
+	binary.BigEndian.PutUint16(p[16:], 0x7000|uint16(len(p)-16))
+	binary.BigEndian.PutUint32(p[18:], 0x00000004) // VECTOR_ROOT_E131_DATA
+	copy(p[22:38], cid[:])
+	// framing layer
+	binary.BigEndian.PutUint16(p[38:], 0x7000|uint16(len(p)-38))
+	binary.BigEndian.PutUint32(p[40:], 0x00000002) // VECTOR_E131_DATA_PACKET
+	copy(p[44:107], source)
+	p[108] = priority
+	p[111] = sequence
+	binary.BigEndian.PutUint16(p[113:], uint16(universe))
+	// DMP layer
+	binary.BigEndian.PutUint16(p[115:], 0x7000|uint16(len(p)-115))
+	p[117] = 0x02                          // VECTOR_DMP_SET_PROPERTY
+	p[118] = 0xa1                          // address and data type
+	binary.BigEndian.PutUint16(p[121:], 1) // address increment
+	binary.BigEndian.PutUint16(p[123:], uint16(len(data)+1))
+	copy(p[126:], data) // p[125] is DMX start code
+	return p
+}
+
+func (led *E131Led) Len() int {
+	return led.count
+}
+
+func (led *E131Led) Write(colors []color.RGBA) error {
+	return led.write(colors, func(i int, u dmxUniverse, data []byte) []byte {
+		led.sequence[i]++
+		return e131Packet(led.cid, led.source, led.priority, led.sequence[i], u.Universe, data)
+	})
+}
+
+func (led *E131Led) Close() error {
+	return led.conn.Close()
+}
+
+// ArtNetLed sends colors as Art-Net ArtDmx packets.
+type ArtNetLed struct {
+	*dmxPacketSender
+}
+
+func NewArtNetLed(c *NetworkConfig, amountOfLeds int) (*ArtNetLed, error) {
+	address := c.Address
+	if c.Multicast && address == "" {
+		address = "255.255.255.255"
+	}
+	addr, err := resolveUDPAddr(address, ArtNetPort)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := newDMXPacketSender(c, amountOfLeds, func(int) *net.UDPAddr { return addr })
+	if err != nil {
+		return nil, err
+	}
+	return &ArtNetLed{sender}, nil
+}
+
+// artNetPacket builds ArtDmx packet. Universe is 15-bit port address combining net, sub-net and universe.
+func artNetPacket(sequence byte, universe int, data []byte) []byte {
+	// data length has to be even
+	length := len(data) + len(data)%2
+	if length < 2 {
+		length = 2
+	}
+	p := make([]byte, 18+length)
+	copy(p, "Art-Net\x00")
+	binary.LittleEndian.PutUint16(p[8:], 0x5000) // OpDmx
+	binary.BigEndian.PutUint16(p[10:], 14)       // protocol version
+	p[12] = sequence
+	p[14] = byte(universe)
+	p[15] = byte(universe>>8) & 0x7f
+	binary.BigEndian.PutUint16(p[16:], uint16(length))
+	copy(p[18:], data)
+	return p
+}
+
+func (led *ArtNetLed) Len() int {
+	return led.count
+}
+
+func (led *ArtNetLed) Write(colors []color.RGBA) error {
+	return led.write(colors, func(i int, u dmxUniverse, data []byte) []byte {
+		// zero disables sequencing, so it's skipped
+		led.sequence[i]++
+		if led.sequence[i] == 0 {
+			led.sequence[i] = 1
+		}
+		return artNetPacket(led.sequence[i], u.Universe, data)
+	})
+}
+
+func (led *ArtNetLed) Close() error {
+	return led.conn.Close()
+}
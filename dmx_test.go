@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// listenLoopback returns receiver of the packets and its address.
+func listenLoopback(t *testing.T) (*net.UDPConn, string) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, conn.LocalAddr().String()
+}
+
+// receivePackets reads n packets, failing the test when they don't arrive in time.
+func receivePackets(t *testing.T, conn *net.UDPConn, n int) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	buf := make([]byte, 1500)
+	for len(packets) < n {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		m, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("received %d of %d packets: %s", len(packets), n, err)
+		}
+		packets = append(packets, append([]byte(nil), buf[:m]...))
+	}
+	return packets
+}
+
+// testColors returns distinct colors, so misplaced channels are detected.
+func testColors(n int) []color.RGBA {
+	colors := make([]color.RGBA, n)
+	for i := range colors {
+		colors[i] = color.RGBA{byte(i), byte(i + 100), byte(i * 3), 255}
+	}
+	return colors
+}
+
+// dmxData returns channels expected for leds from-to with offset channels before them.
+func dmxData(colors []color.RGBA, offset, from, to int) []byte {
+	data := make([]byte, offset)
+	for _, c := range colors[from:to] {
+		data = append(data, c.R, c.G, c.B)
+	}
+	return data
+}
+
+type e131Data struct {
+	cid      []byte
+	source   string
+	priority byte
+	sequence byte
+	universe int
+	data     []byte
+}
+
+func decodeE131(t *testing.T, p []byte) e131Data {
+	t.Helper()
+	if len(p) < 126 {
+		t.Fatalf("packet of %d bytes is too short", len(p))
+	}
+	if !bytes.Equal(p[:16], []byte("\x00\x10\x00\x00ASC-E1.17\x00\x00\x00")) {
+		t.Errorf("invalid preamble % x", p[:16])
+	}
+	for _, layer := range []struct {
+		name   string
+		offset int
+		vector uint32
+	}{
+		{"root", 16, 4},
+		{"framing", 38, 2},
+	} {
+		if l := binary.BigEndian.Uint16(p[layer.offset:]); l != 0x7000|uint16(len(p)-layer.offset) {
+			t.Errorf("%s layer flags and length are %#x", layer.name, l)
+		}
+		if v := binary.BigEndian.Uint32(p[layer.offset+2:]); v != layer.vector {
+			t.Errorf("%s layer vector is %d, want %d", layer.name, v, layer.vector)
+		}
+	}
+	if l := binary.BigEndian.Uint16(p[115:]); l != 0x7000|uint16(len(p)-115) {
+		t.Errorf("dmp layer flags and length are %#x", l)
+	}
+	if p[117] != 0x02 || p[118] != 0xa1 || binary.BigEndian.Uint16(p[121:]) != 1 {
+		t.Errorf("invalid dmp layer % x", p[115:125])
+	}
+	if count := int(binary.BigEndian.Uint16(p[123:])); count != len(p)-125 {
+		t.Errorf("property value count is %d, want %d", count, len(p)-125)
+	}
+	if p[125] != 0 {
+		t.Errorf("start code is %d", p[125])
+	}
+	return e131Data{
+		cid:      p[22:38],
+		source:   string(bytes.TrimRight(p[44:108], "\x00")),
+		priority: p[108],
+		sequence: p[111],
+		universe: int(binary.BigEndian.Uint16(p[113:])),
+		data:     p[126:],
+	}
+}
+
+func TestE131Packets(t *testing.T) {
+	conn, addr := listenLoopback(t)
+	defer conn.Close()
+	led, err := NewE131Led(&NetworkConfig{Address: addr, StartUniverse: 5, StartChannel: 4, Priority: 150}, 172)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer led.Close()
+	colors := testColors(172)
+	for frame := 1; frame <= 2; frame++ {
+		if err := led.Write(colors); err != nil {
+			t.Fatal(err)
+		}
+		// first universe fits 169 leds after 3 skipped channels
+		want := []struct {
+			universe int
+			data     []byte
+		}{
+			{5, dmxData(colors, 3, 0, 169)},
+			{6, dmxData(colors, 0, 169, 172)},
+		}
+		for i, p := range receivePackets(t, conn, len(want)) {
+			got := decodeE131(t, p)
+			if got.universe != want[i].universe || got.sequence != byte(frame) {
+				t.Errorf("packet %d is universe %d sequence %d, want %d, %d", i, got.universe, got.sequence, want[i].universe, frame)
+			}
+			if !bytes.Equal(got.data, want[i].data) {
+				t.Errorf("packet %d data is % x\nwant % x", i, got.data, want[i].data)
+			}
+			if got.source != defaultE131Source || got.priority != 150 {
+				t.Errorf("packet %d source is %q priority %d", i, got.source, got.priority)
+			}
+			if !bytes.Equal(got.cid, led.cid[:]) || got.cid[6]>>4 != 4 {
+				t.Errorf("packet %d cid is % x, want random uuid % x", i, got.cid, led.cid)
+			}
+		}
+	}
+}
+
+func TestArtNetPackets(t *testing.T) {
+	conn, addr := listenLoopback(t)
+	defer conn.Close()
+	// universe 0x1234 is net 0x12, sub-net 3 and universe 4
+	led, err := NewArtNetLed(&NetworkConfig{Address: addr, StartUniverse: 0x1234}, 171)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer led.Close()
+	colors := testColors(171)
+	if err := led.Write(colors); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		universe int
+		data     []byte
+	}{
+		{0x1234, dmxData(colors, 0, 0, 170)},
+		// odd amount of channels is padded
+		{0x1235, append(dmxData(colors, 0, 170, 171), 0)},
+	}
+	for i, p := range receivePackets(t, conn, len(want)) {
+		if !bytes.Equal(p[:8], []byte("Art-Net\x00")) {
+			t.Errorf("packet %d has invalid id % x", i, p[:8])
+		}
+		if op := binary.LittleEndian.Uint16(p[8:]); op != 0x5000 {
+			t.Errorf("packet %d opcode is %#x", i, op)
+		}
+		if v := binary.BigEndian.Uint16(p[10:]); v != 14 {
+			t.Errorf("packet %d protocol version is %d", i, v)
+		}
+		if p[12] != 1 {
+			t.Errorf("packet %d sequence is %d, want 1", i, p[12])
+		}
+		if u := int(p[15])<<8 | int(p[14]); u != want[i].universe {
+			t.Errorf("packet %d universe is %#x, want %#x", i, u, want[i].universe)
+		}
+		if l := int(binary.BigEndian.Uint16(p[16:])); l != len(p)-18 || l != len(want[i].data) {
+			t.Errorf("packet %d length is %d, want %d", i, l, len(want[i].data))
+		}
+		if !bytes.Equal(p[18:], want[i].data) {
+			t.Errorf("packet %d data is % x\nwant % x", i, p[18:], want[i].data)
+		}
+	}
+}
+
+func TestArtNetSequenceSkipsZero(t *testing.T) {
+	conn, addr := listenLoopback(t)
+	defer conn.Close()
+	led, err := NewArtNetLed(&NetworkConfig{Address: addr}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer led.Close()
+	led.sequence[0] = 254
+	for _, want := range []byte{255, 1} {
+		if err := led.Write(testColors(1)); err != nil {
+			t.Fatal(err)
+		}
+		if p := receivePackets(t, conn, 1)[0]; p[12] != want {
+			t.Errorf("sequence is %d, want %d", p[12], want)
+		}
+	}
+}
+
+func TestSplitUniverses(t *testing.T) {
+	for _, tc := range []struct {
+		name                    string
+		leds, universe, channel int
+		want                    []dmxUniverse
+	}{
+		{"single", 3, 1, 0, []dmxUniverse{{1, 0, 0, 3}}},
+		{"full universe", 170, 1, 1, []dmxUniverse{{1, 0, 0, 170}}},
+		{"pixels aren't split", 171, 1, 0, []dmxUniverse{{1, 0, 0, 170}, {2, 0, 170, 171}}},
+		{"last start channel", 200, 3, 510, []dmxUniverse{{3, 509, 0, 1}, {4, 0, 1, 171}, {5, 0, 171, 200}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := splitUniverses(tc.leds, tc.universe, tc.channel)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("universes are %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// effectColor is a color in JSON arguments of effects, encoded as [r, g, b].
+type effectColor [3]uint8
+
+func (c effectColor) RGBA() color.RGBA {
+	return color.RGBA{c[0], c[1], c[2], 255}
+}
+
+// EffectParam describes single argument of the effect.
+type EffectParam struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Default     interface{} `json:"default"`
+}
+
+type effectDefinition struct {
+	params []EffectParam
+	create func(args json.RawMessage, start time.Time) (Source, error)
+}
+
+// EffectRegistry creates effects by name.
+type EffectRegistry map[string]effectDefinition
+
+// DefaultEffects returns registry with all built-in effects.
+func DefaultEffects() EffectRegistry {
+	return EffectRegistry{
+		"static": {
+			params: []EffectParam{{"color", "shown color as [r, g, b]", effectColor{255, 255, 255}}},
+			create: func(args json.RawMessage, start time.Time) (Source, error) {
+				p := struct {
+					Color effectColor `json:"color"`
+				}{effectColor{255, 255, 255}}
+				if err := decodeEffectArgs(args, &p); err != nil {
+					return nil, err
+				}
+				return &ColorSource{p.Color.RGBA()}, nil
+			},
+		},
+		"gradient": {
+			params: []EffectParam{
+				{"colors", "colors of the gradient as list of [r, g, b]", []effectColor{{255, 80, 0}, {120, 0, 255}}},
+				{"period", "seconds it takes the gradient to move around the screen", 60.0},
+			},
+			create: func(args json.RawMessage, start time.Time) (Source, error) {
+				p := &GradientEffect{Colors: []effectColor{{255, 80, 0}, {120, 0, 255}}, Period: 60, start: start}
+				if err := decodeEffectArgs(args, p); err != nil {
+					return nil, err
+				}
+				if len(p.Colors) == 0 {
+					return nil, fmt.Errorf("gradient needs at least one color")
+				}
+				return p, nil
+			},
+		},
+		"rainbow": {
+			params: []EffectParam{
+				{"speed", "leds per second the rainbow moves by", 10.0},
+				{"length", "amount of leds covered by a single rainbow, zero means all leds", 0},
+				{"saturation", "saturation of colors, 0-1", 1.0},
+			},
+			create: func(args json.RawMessage, start time.Time) (Source, error) {
+				p := &RainbowEffect{Speed: 10, Saturation: 1, start: start}
+				if err := decodeEffectArgs(args, p); err != nil {
+					return nil, err
+				}
+				if p.Length < 0 || p.Saturation < 0 || p.Saturation > 1 {
+					return nil, fmt.Errorf("invalid rainbow arguments")
+				}
+				return p, nil
+			},
+		},
+		"breathing": {
+			params: []EffectParam{
+				{"color", "color as [r, g, b]", effectColor{255, 255, 255}},
+				{"period", "seconds of a single breath", 4.0},
+				{"min", "minimal brightness, 0-1", 0.1},
+			},
+			create: func(args json.RawMessage, start time.Time) (Source, error) {
+				p := &BreathingEffect{Color: effectColor{255, 255, 255}, Period: 4, Min: 0.1, start: start}
+				if err := decodeEffectArgs(args, p); err != nil {
+					return nil, err
+				}
+				if p.Min < 0 || p.Min > 1 {
+					return nil, fmt.Errorf("minimal brightness must be within 0-1 range")
+				}
+				return p, nil
+			},
+		},
+		"candle": {
+			params: []EffectParam{
+				{"color", "color of the flame as [r, g, b]", effectColor{255, 138, 18}},
+				{"intensity", "strength of the flicker, 0-1", 0.4},
+				{"seed", "seed of the random generator, same seed renders the same flicker", 1},
+			},
+			create: func(args json.RawMessage, start time.Time) (Source, error) {
+				p := &CandleEffect{Color: effectColor{255, 138, 18}, Intensity: 0.4, Seed: 1, start: start}
+				if err := decodeEffectArgs(args, p); err != nil {
+					return nil, err
+				}
+				if p.Intensity < 0 || p.Intensity > 1 {
+					return nil, fmt.Errorf("intensity must be within 0-1 range")
+				}
+				return p, nil
+			},
+		},
+	}
+}
+
+func decodeEffectArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 || string(args) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return fmt.Errorf("invalid effect arguments: %s", err)
+	}
+	return nil
+}
+
+// EffectNames returns sorted names of all effects.
+func (r EffectRegistry) EffectNames() []string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Params returns arguments accepted by the effect.
+func (r EffectRegistry) Params(name string) []EffectParam {
+	return r[name].params
+}
+
+// NewEffect creates effect starting now.
+func (r EffectRegistry) NewEffect(name string, args json.RawMessage) (Source, error) {
+	return r.NewEffectAt(name, args, time.Now())
+}
+
+// NewEffectAt creates effect starting at the given time.
+func (r EffectRegistry) NewEffectAt(name string, args json.RawMessage, start time.Time) (Source, error) {
+	def, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("effect %q not found", name)
+	}
+	return def.create(args, start)
+}
+
+// mix blends two colors, t=0 returns a, t=1 returns b.
+func mix(a, b color.RGBA, t float64) color.RGBA {
+	lerp := func(x, y uint8) uint8 {
+		return uint8(math.Round(float64(x) + (float64(y)-float64(x))*t))
+	}
+	return color.RGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 255}
+}
+
+func scale(c color.RGBA, t float64) color.RGBA {
+	return mix(color.RGBA{A: 255}, c, t)
+}
+
+// hsv converts hue (0-1), saturation and value into color.
+func hsv(h, s, v float64) color.RGBA {
+	h = (h - math.Floor(h)) * 6
+	i := math.Floor(h)
+	f := h - i
+	p, q, t := v*(1-s), v*(1-s*f), v*(1-s*(1-f))
+	var r, g, b float64
+	switch int(i) {
+	case 0:
+		r, g, b = v, t, p
+	case 1:
+		r, g, b = q, v, p
+	case 2:
+		r, g, b = p, v, t
+	case 3:
+		r, g, b = p, q, v
+	case 4:
+		r, g, b = t, p, v
+	default:
+		r, g, b = v, p, q
+	}
+	return color.RGBA{uint8(math.Round(r * 255)), uint8(math.Round(g * 255)), uint8(math.Round(b * 255)), 255}
+}
+
+// phase returns position within the period (0-1) at the given time.
+func phase(start, now time.Time, period float64) float64 {
+	if period <= 0 {
+		return 0
+	}
+	p := now.Sub(start).Seconds() / period
+	return p - math.Floor(p)
+}
+
+// GradientEffect slowly moves gradient of colors around the screen.
+type GradientEffect struct {
+	Colors []effectColor `json:"colors"`
+	Period float64       `json:"period"`
+	start  time.Time
+}
+
+func (e *GradientEffect) Animated() bool {
+	return e.Period > 0
+}
+
+func (e *GradientEffect) Render(now time.Time, colors []color.RGBA) {
+	offset := phase(e.start, now, e.Period)
+	n := len(e.Colors)
+	for i := range colors {
+		pos := float64(i)/float64(len(colors)) + offset
+		pos = (pos - math.Floor(pos)) * float64(n)
+		j := int(pos)
+		colors[i] = mix(e.Colors[j%n].RGBA(), e.Colors[(j+1)%n].RGBA(), pos-float64(j))
+	}
+}
+
+// RainbowEffect chases rainbow along the strip.
+type RainbowEffect struct {
+	Speed      float64 `json:"speed"`
+	Length     int     `json:"length"`
+	Saturation float64 `json:"saturation"`
+	start      time.Time
+}
+
+func (e *RainbowEffect) Animated() bool {
+	return e.Speed != 0
+}
+
+func (e *RainbowEffect) Render(now time.Time, colors []color.RGBA) {
+	length := float64(e.Length)
+	if length == 0 {
+		length = float64(len(colors))
+	}
+	shift := now.Sub(e.start).Seconds() * e.Speed
+	for i := range colors {
+		colors[i] = hsv((float64(i)-shift)/length, e.Saturation, 1)
+	}
+}
+
+// BreathingEffect slowly pulses brightness of a single color.
+type BreathingEffect struct {
+	Color  effectColor `json:"color"`
+	Period float64     `json:"period"`
+	Min    float64     `json:"min"`
+	start  time.Time
+}
+
+func (e *BreathingEffect) Animated() bool {
+	return e.Period > 0
+}
+
+func (e *BreathingEffect) Render(now time.Time, colors []color.RGBA) {
+	// cosine starting at full brightness
+	t := (1 + math.Cos(2*math.Pi*phase(e.start, now, e.Period))) / 2
+	c := scale(e.Color.RGBA(), e.Min+(1-e.Min)*t)
+	for i := range colors {
+		colors[i] = c
+	}
+}
+
+// CandleEffect flickers each led independently like a candle flame.
+// Flicker is derived from the seed and time only, so it's reproducible.
+type CandleEffect struct {
+	Color     effectColor `json:"color"`
+	Intensity float64     `json:"intensity"`
+	Seed      int64       `json:"seed"`
+	start     time.Time
+}
+
+// candleStep is time after which flame of each led changes its target brightness.
+const candleStep = 100 * time.Millisecond
+
+func (e *CandleEffect) Animated() bool {
+	return e.Intensity > 0
+}
+
+func (e *CandleEffect) Render(now time.Time, colors []color.RGBA) {
+	elapsed := now.Sub(e.start)
+	step := int64(elapsed / candleStep)
+	t := float64(elapsed%candleStep) / float64(candleStep)
+	for i := range colors {
+		from := e.flicker(step, i)
+		to := e.flicker(step+1, i)
+		colors[i] = scale(e.Color.RGBA(), 1-e.Intensity*(from+(to-from)*t))
+	}
+}
+
+// flicker returns pseudo-random dimming (0-1) of the led in the given step.
+func (e *CandleEffect) flicker(step int64, led int) float64 {
+	r := rand.New(rand.NewSource(e.Seed ^ step*7919 ^ int64(led)*104729))
+	return r.Float64()
+}
+
+// Crossfade blends colors of two sources over time and then shows only the target one.
+type Crossfade struct {
+	From     Source
+	To       Source
+	Start    time.Time
+	Duration time.Duration
+	buf      []color.RGBA
+}
+
+func (c *Crossfade) progress(now time.Time) float64 {
+	if c.Duration <= 0 {
+		return 1
+	}
+	return math.Min(float64(now.Sub(c.Start))/float64(c.Duration), 1)
+}
+
+func (c *Crossfade) Animated() bool {
+	if c.progress(time.Now()) < 1 {
+		return true
+	}
+	a, ok := c.To.(AnimatedSource)
+	return ok && a.Animated()
+}
+
+func (c *Crossfade) Render(now time.Time, colors []color.RGBA) {
+	c.To.Render(now, colors)
+	t := c.progress(now)
+	if t >= 1 {
+		return
+	}
+	if len(c.buf) != len(colors) {
+		c.buf = make([]color.RGBA, len(colors))
+	}
+	c.From.Render(now, c.buf)
+	for i := range colors {
+		colors[i] = mix(c.buf[i], colors[i], t)
+	}
+}
+
+// Captured returns capture time of the target source, so latency of camera frames is still measured.
+func (c *Crossfade) Captured() time.Time {
+	if src, ok := c.To.(capturedSource); ok {
+		return src.Captured()
+	}
+	return time.Time{}
+}
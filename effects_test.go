@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEffectFrames(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var (
+		red     = color.RGBA{255, 0, 0, 255}
+		yellow  = color.RGBA{255, 255, 0, 255}
+		green   = color.RGBA{0, 255, 0, 255}
+		cyan    = color.RGBA{0, 255, 255, 255}
+		blue    = color.RGBA{0, 0, 255, 255}
+		magenta = color.RGBA{255, 0, 255, 255}
+		purple  = color.RGBA{128, 0, 128, 255}
+	)
+	repeat := func(c color.RGBA, n int) []color.RGBA {
+		colors := make([]color.RGBA, n)
+		for i := range colors {
+			colors[i] = c
+		}
+		return colors
+	}
+	for _, tc := range []struct {
+		name    string
+		effect  string
+		args    string
+		elapsed time.Duration
+		want    []color.RGBA
+	}{
+		{"static default", "static", ``, 0, repeat(color.RGBA{255, 255, 255, 255}, 4)},
+		{"static color", "static", `{"color":[10,20,30]}`, time.Hour, repeat(color.RGBA{10, 20, 30, 255}, 4)},
+		{"rainbow start", "rainbow", ``, 0, []color.RGBA{red, yellow, green, cyan, blue, magenta}},
+		// default speed moves the rainbow by a led every 100ms
+		{"rainbow moved", "rainbow", ``, 100 * time.Millisecond, []color.RGBA{magenta, red, yellow, green, cyan, blue}},
+		{"rainbow moved back", "rainbow", `{"speed":-20}`, 100 * time.Millisecond, []color.RGBA{green, cyan, blue, magenta, red, yellow}},
+		{"rainbow length", "rainbow", `{"length":3}`, 0, []color.RGBA{red, green, blue, red, green, blue}},
+		{"rainbow saturation", "rainbow", `{"saturation":0.5,"length":3}`, 0, []color.RGBA{
+			{255, 128, 128, 255}, {128, 255, 128, 255}, {128, 128, 255, 255},
+			{255, 128, 128, 255}, {128, 255, 128, 255}, {128, 128, 255, 255},
+		}},
+		{"breathing start", "breathing", `{"color":[200,100,0],"period":4,"min":0.2}`, 0, repeat(color.RGBA{200, 100, 0, 255}, 3)},
+		{"breathing quarter", "breathing", `{"color":[200,100,0],"period":4,"min":0.2}`, time.Second, repeat(color.RGBA{120, 60, 0, 255}, 3)},
+		{"breathing half", "breathing", `{"color":[200,100,0],"period":4,"min":0.2}`, 2 * time.Second, repeat(color.RGBA{40, 20, 0, 255}, 3)},
+		{"breathing next period", "breathing", `{"color":[200,100,0],"period":4,"min":0.2}`, 7 * time.Second, repeat(color.RGBA{120, 60, 0, 255}, 3)},
+		{"breathing default", "breathing", ``, 2 * time.Second, repeat(color.RGBA{26, 26, 26, 255}, 2)},
+		{"gradient start", "gradient", `{"colors":[[255,0,0],[0,0,255]],"period":4}`, 0, []color.RGBA{red, purple, blue, purple}},
+		{"gradient quarter", "gradient", `{"colors":[[255,0,0],[0,0,255]],"period":4}`, time.Second, []color.RGBA{purple, blue, purple, red}},
+		{"gradient next period", "gradient", `{"colors":[[255,0,0],[0,0,255]],"period":4}`, 5 * time.Second, []color.RGBA{purple, blue, purple, red}},
+		{"gradient default", "gradient", ``, 0, []color.RGBA{{255, 80, 0, 255}, {120, 0, 255, 255}}},
+		{"candle seeded", "candle", `{"color":[200,100,0],"intensity":0.5,"seed":7}`, 0, []color.RGBA{{108, 54, 0, 255}, {184, 92, 0, 255}, {172, 86, 0, 255}}},
+		// flame moves halfway to the next step
+		{"candle between steps", "candle", `{"color":[200,100,0],"intensity":0.5,"seed":7}`, 50 * time.Millisecond, []color.RGBA{{129, 64, 0, 255}, {144, 72, 0, 255}, {153, 76, 0, 255}}},
+		{"candle next step", "candle", `{"color":[200,100,0],"intensity":0.5,"seed":7}`, 100 * time.Millisecond, []color.RGBA{{150, 75, 0, 255}, {104, 52, 0, 255}, {133, 66, 0, 255}}},
+		{"candle other seed", "candle", `{"color":[200,100,0],"intensity":0.5,"seed":8}`, 0, []color.RGBA{{155, 77, 0, 255}, {112, 56, 0, 255}, {184, 92, 0, 255}}},
+		{"candle without flicker", "candle", `{"color":[200,100,0],"intensity":0}`, 50 * time.Millisecond, repeat(color.RGBA{200, 100, 0, 255}, 3)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, err := DefaultEffects().NewEffectAt(tc.effect, json.RawMessage(tc.args), start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			colors := make([]color.RGBA, len(tc.want))
+			src.Render(start.Add(tc.elapsed), colors)
+			if !reflect.DeepEqual(colors, tc.want) {
+				t.Errorf("frame is %v\nwant %v", colors, tc.want)
+			}
+		})
+	}
+}
+
+func TestEffectAnimated(t *testing.T) {
+	for _, tc := range []struct {
+		effect   string
+		args     string
+		animated bool
+	}{
+		{"rainbow", ``, true},
+		{"rainbow", `{"speed":0}`, false},
+		{"breathing", ``, true},
+		{"breathing", `{"period":0}`, false},
+		{"gradient", ``, true},
+		{"gradient", `{"period":0}`, false},
+		{"candle", ``, true},
+		{"candle", `{"intensity":0}`, false},
+	} {
+		src, err := DefaultEffects().NewEffect(tc.effect, json.RawMessage(tc.args))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := src.(AnimatedSource).Animated(); a != tc.animated {
+			t.Errorf("%s %s animated is %t, want %t", tc.effect, tc.args, a, tc.animated)
+		}
+	}
+}
+
+func TestEffectArgsRejected(t *testing.T) {
+	for _, tc := range []struct {
+		effect string
+		args   string
+	}{
+		{"static", `{"color":"red"}`},
+		{"rainbow", `{"length":-1}`},
+		{"rainbow", `{"saturation":2}`},
+		{"breathing", `{"min":1.5}`},
+		{"missing", ``},
+	} {
+		if _, err := DefaultEffects().NewEffect(tc.effect, json.RawMessage(tc.args)); err == nil {
+			t.Errorf("%s %s accepted", tc.effect, tc.args)
+		}
+	}
+}
+
+func TestCrossfade(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	fade := &Crossfade{From: &ColorSource{red}, To: &ColorSource{blue}, Start: start, Duration: time.Second}
+	for _, tc := range []struct {
+		name    string
+		elapsed time.Duration
+		want    color.RGBA
+	}{
+		{"start", 0, red},
+		{"midpoint", 500 * time.Millisecond, color.RGBA{128, 0, 128, 255}},
+		{"end", time.Second, blue},
+		{"after end", time.Minute, blue},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			colors := make([]color.RGBA, 2)
+			fade.Render(start.Add(tc.elapsed), colors)
+			if !reflect.DeepEqual(colors, []color.RGBA{tc.want, tc.want}) {
+				t.Errorf("frame is %v, want %v", colors, tc.want)
+			}
+		})
+	}
+	if fade.Animated() {
+		t.Error("finished crossfade to static color is animated")
+	}
+	fade.Start = time.Now()
+	if !fade.Animated() {
+		t.Error("running crossfade isn't animated")
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultHyperionAddr = ":19444"
+
+// hyperionRequest contains fields of all commands supported by Hyperion JSON server.
+type hyperionRequest struct {
+	Command     string          `json:"command"`
+	Tan         int             `json:"tan,omitempty"`
+	Priority    *int            `json:"priority,omitempty"`
+	Duration    int             `json:"duration,omitempty"`
+	Origin      string          `json:"origin,omitempty"`
+	Color       []int           `json:"color,omitempty"`
+	Effect      *hyperionEffect `json:"effect,omitempty"`
+	ImageWidth  int             `json:"imagewidth,omitempty"`
+	ImageHeight int             `json:"imageheight,omitempty"`
+	ImageData   string          `json:"imagedata,omitempty"`
+	Adjustment  *hyperionAdjust `json:"adjustment,omitempty"`
+}
+
+type hyperionEffect struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type hyperionAdjust struct {
+	Brightness *float64 `json:"brightness,omitempty"`
+	Red        []int    `json:"red,omitempty"`
+	Green      []int    `json:"green,omitempty"`
+	Blue       []int    `json:"blue,omitempty"`
+	GammaRed   *float64 `json:"gammaRed,omitempty"`
+	GammaGreen *float64 `json:"gammaGreen,omitempty"`
+	GammaBlue  *float64 `json:"gammaBlue,omitempty"`
+}
+
+type hyperionResponse struct {
+	Command string      `json:"command"`
+	Success bool        `json:"success"`
+	Error   string      `json:"error,omitempty"`
+	Tan     int         `json:"tan,omitempty"`
+	Info    interface{} `json:"info,omitempty"`
+}
+
+// EffectFactory creates source rendering named effect with optional JSON arguments.
+type EffectFactory interface {
+	EffectNames() []string
+	NewEffect(name string, args json.RawMessage) (Source, error)
+}
+
+// HyperionServer implements core commands of Hyperion JSON server protocol,
+// so existing remote apps and integrations can control the leds.
+type HyperionServer struct {
+	pipeline *Pipeline
+	// Effects is nil when no effects are available.
+	Effects EffectFactory
+	// ImageSource creates source showing externally injected image.
+	ImageSource func(img *image.RGBA) Source
+	mu          sync.Mutex
+	conns       map[net.Conn]struct{}
+	imageDelay  time.Duration
+	// pending is closed when the last delayed change was applied.
+	pending chan struct{}
+}
+
+func NewHyperionServer(p *Pipeline, imageSource func(img *image.RGBA) Source) *HyperionServer {
+	return &HyperionServer{pipeline: p, ImageSource: imageSource, conns: make(map[net.Conn]struct{})}
+}
+
+// serveHyperion starts Hyperion server which is stopped on shutdown.
+func serveHyperion(lc *Lifecycle, addr string, s *HyperionServer) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go s.Serve(ln)
+	lc.OnShutdown("hyperion server", func(ctx context.Context) error {
+		return s.Close(ln)
+	})
+	return nil
+}
+
+// Serve accepts connections until the listener is closed.
+func (s *HyperionServer) Serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops accepting new connections and closes existing ones.
+func (s *HyperionServer) Close(ln net.Listener) error {
+	err := ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *HyperionServer) handleConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if err := enc.Encode(s.Handle(line)); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				hyperionLog.Warn("reading request failed", "remote", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+	}
+}
+
+// Handle executes single JSON request and returns the response.
+func (s *HyperionServer) Handle(b []byte) *hyperionResponse {
+	var req hyperionRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return &hyperionResponse{Command: "", Error: "Errors during message parsing: " + err.Error()}
+	}
+	resp := &hyperionResponse{Command: req.Command, Tan: req.Tan}
+	info, err := s.execute(&req)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	resp.Success = true
+	resp.Info = info
+	return resp
+}
+
+func (s *HyperionServer) execute(req *hyperionRequest) (interface{}, error) {
+	origin := req.Origin
+	if origin == "" {
+		origin = "JSON API"
+	}
+	duration := time.Duration(req.Duration) * time.Millisecond
+	switch req.Command {
+	case "serverinfo":
+		return s.serverInfo(), nil
+	case "color":
+		priority, err := requirePriority(req)
+		if err != nil {
+			return nil, err
+		}
+		if len(req.Color) < 3 {
+			return nil, fmt.Errorf("color must contain red, green and blue value")
+		}
+		c := color.RGBA{clampByte(req.Color[0]), clampByte(req.Color[1]), clampByte(req.Color[2]), 255}
+		s.delayed(func() {
+			s.pipeline.SetExternalSource(priority, origin, &ColorSource{c}, duration)
+		})
+	case "image":
+		priority, err := requirePriority(req)
+		if err != nil {
+			return nil, err
+		}
+		img, err := decodeHyperionImage(req.ImageWidth, req.ImageHeight, req.ImageData)
+		if err != nil {
+			return nil, err
+		}
+		src := s.ImageSource(img)
+		s.delayed(func() {
+			s.pipeline.SetExternalSource(priority, origin, src, duration)
+		})
+	case "effect":
+		priority, err := requirePriority(req)
+		if err != nil {
+			return nil, err
+		}
+		if req.Effect == nil || req.Effect.Name == "" {
+			return nil, fmt.Errorf("effect name is missing")
+		}
+		if s.Effects == nil {
+			return nil, fmt.Errorf("effect %q not found", req.Effect.Name)
+		}
+		src, err := s.Effects.NewEffect(req.Effect.Name, req.Effect.Args)
+		if err != nil {
+			return nil, err
+		}
+		s.delayed(func() {
+			s.pipeline.SetExternalSource(priority, origin, src, duration)
+		})
+	case "clear":
+		priority, err := requirePriority(req)
+		if err != nil {
+			return nil, err
+		}
+		s.delayed(func() {
+			if priority < 0 {
+				s.pipeline.ClearAll()
+			} else {
+				s.pipeline.ClearExternal(priority)
+			}
+		})
+	case "clearall":
+		s.delayed(s.pipeline.ClearAll)
+	case "adjustment":
+		if req.Adjustment == nil {
+			return nil, fmt.Errorf("adjustment is missing")
+		}
+		a, err := applyHyperionAdjustment(s.pipeline.Adjustment(), req.Adjustment)
+		if err != nil {
+			return nil, err
+		}
+		s.pipeline.SetAdjustment(a)
+	default:
+		return nil, fmt.Errorf("Unknown command %q", req.Command)
+	}
+	return nil, nil
+}
+
+// SetImageDelay postpones changes of the sources, so images show together with the picture delayed by the screen.
+func (s *HyperionServer) SetImageDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.imageDelay = d
+}
+
+// delayed runs the change after the image delay. Changes run in the order of the requests,
+// so a color or clear isn't replaced by an image still waiting for its time.
+func (s *HyperionServer) delayed(change func()) {
+	now := time.Now()
+	done := make(chan struct{})
+	s.mu.Lock()
+	d, prev := s.imageDelay, s.pending
+	s.pending = done
+	s.mu.Unlock()
+	run := func() {
+		change()
+		close(done)
+	}
+	idle := prev == nil
+	if !idle {
+		select {
+		case <-prev:
+			idle = true
+		default:
+		}
+	}
+	if d <= 0 && idle {
+		run()
+		return
+	}
+	go func() {
+		if prev != nil {
+			<-prev
+		}
+		time.Sleep(time.Until(now.Add(d)))
+		run()
+	}()
+}
+
+func requirePriority(req *hyperionRequest) (int, error) {
+	if req.Priority == nil {
+		return 0, fmt.Errorf("priority is missing")
+	}
+	p := *req.Priority
+	if req.Command == "clear" && p == -1 {
+		return p, nil
+	}
+	if p < 0 || p > PriorityLowest {
+		return 0, fmt.Errorf("priority %d is out of range (0-%d)", p, PriorityLowest)
+	}
+	return p, nil
+}
+
+func clampByte(v int) uint8 {
+	switch {
+	case v < 0:
+		return 0
+	case v > 255:
+		return 255
+	}
+	return uint8(v)
+}
+
+// decodeHyperionImage decodes base64 encoded RGB24 image.
+func decodeHyperionImage(width, height int, data string) (*image.RGBA, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid image size %dx%d", width, height)
+	}
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image data: %s", err)
+	}
+	if len(b) != width*height*3 {
+		return nil, fmt.Errorf("size of image data does not match with the width and height")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		copy(img.Pix[i*4:], b[i*3:i*3+3])
+		img.Pix[i*4+3] = 255
+	}
+	return img, nil
+}
+
+func applyHyperionAdjustment(a Adjustment, adj *hyperionAdjust) (Adjustment, error) {
+	if adj.Brightness != nil {
+		if *adj.Brightness < 0 || *adj.Brightness > 100 {
+			return a, fmt.Errorf("brightness must be within 0-100 range")
+		}
+		a.Brightness = *adj.Brightness / 100
+	}
+	for ch, rgb := range [3][]int{adj.Red, adj.Green, adj.Blue} {
+		if rgb == nil {
+			continue
+		}
+		if len(rgb) != 3 {
+			return a, fmt.Errorf("channel adjustment must contain red, green and blue value")
+		}
+		// only the primary component of the channel is supported
+		a.Gain[ch] = float64(clampByte(rgb[ch])) / 255
+	}
+	for ch, g := range [3]*float64{adj.GammaRed, adj.GammaGreen, adj.GammaBlue} {
+		if g == nil {
+			continue
+		}
+		if *g <= 0 {
+			return a, fmt.Errorf("gamma must be greater than zero")
+		}
+		a.Gamma[ch] = *g
+	}
+	return a, nil
+}
+
+func (s *HyperionServer) serverInfo() map[string]interface{} {
+	active := s.pipeline.Active()
+	var priorities []map[string]interface{}
+	for _, src := range s.pipeline.Sources() {
+		p := map[string]interface{}{
+			"priority":     src.Priority,
+			"origin":       src.Origin,
+			"active":       true,
+			"visible":      active != nil && active.Priority == src.Priority && active.Internal == src.Internal,
+			"component_id": "COLOR",
+		}
+		switch v := src.Source.(type) {
+		case *ColorSource:
+			p["value"] = map[string]interface{}{"RGB": []int{int(v.Color.R), int(v.Color.G), int(v.Color.B)}}
+		case *FrameSource:
+			p["component_id"] = "GRABBER"
+		default:
+			p["component_id"] = "EFFECT"
+		}
+		if !src.Expires.IsZero() {
+			p["duration_ms"] = time.Until(src.Expires).Milliseconds()
+		}
+		priorities = append(priorities, p)
+	}
+	a := s.pipeline.Adjustment()
+	effects := []map[string]interface{}{}
+	if s.Effects != nil {
+		for _, name := range s.Effects.EffectNames() {
+			effects = append(effects, map[string]interface{}{"name": name})
+		}
+	}
+	hostname, _ := os.Hostname()
+	return map[string]interface{}{
+		"hostname":   hostname,
+		"priorities": priorities,
+		"adjustment": []map[string]interface{}{{
+			"id":         "default",
+			"brightness": int(a.Brightness * 100),
+			"red":        []int{int(a.Gain[0] * 255), 0, 0},
+			"green":      []int{0, int(a.Gain[1] * 255), 0},
+			"blue":       []int{0, 0, int(a.Gain[2] * 255)},
+			"gammaRed":   a.Gamma[0],
+			"gammaGreen": a.Gamma[1],
+			"gammaBlue":  a.Gamma[2],
+		}},
+		"effects": effects,
+		"components": []map[string]interface{}{
+			{"name": "ALL", "enabled": true},
+			{"name": "GRABBER", "enabled": true},
+			{"name": "LEDDEVICE", "enabled": true},
+		},
+		"leds": s.pipeline.Count(),
+	}
+}
+
+// ImageSource shows colors of the screen edges of a static image.
+type ImageSource struct {
+	colors []color.RGBA
+}
+
+// NewImageSource computes led colors from the image, using the layout scaled to the image size.
+func NewImageSource(img *image.RGBA, layout *Layout, screenWidth, depth int) *ImageSource {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	d := depth * w / screenWidth
+	if d < 1 {
+		d = 1
+	}
+	regions := layout.ScreenRegions(w, h, d)
+	s := &ImageSource{colors: make([]color.RGBA, len(regions))}
+	frameColors(img, regions, s.colors)
+	return s
+}
+
+func (s *ImageSource) Render(now time.Time, colors []color.RGBA) {
+	copy(colors, s.colors)
+}
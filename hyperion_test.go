@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// darkScreen turns the detector's screen off with black frames captured past its delay.
+func darkScreen(t *testing.T, d *ScreenDetector) {
+	t.Helper()
+	frame := image.NewRGBA(image.Rect(0, 0, Width, Height))
+	start := time.Now()
+	d.Update(frame, start)
+	d.Update(frame, start.Add(time.Duration(DefaultScreenOffDelay)*time.Second))
+	if !d.State().Off {
+		t.Fatal("screen wasn't detected as off")
+	}
+}
+
+func TestHyperionCantRemoveScreenOff(t *testing.T) {
+	for _, req := range []string{
+		`{"command":"clearall"}`,
+		`{"command":"clear","priority":-1}`,
+		`{"command":"clear","priority":239}`,
+	} {
+		t.Run(req, func(t *testing.T) {
+			p := NewPipeline(4, nil)
+			p.SetSource(PriorityCamera, "camera", NewFrameSource(4), 0)
+			d := NewScreenDetector(ScreenOffConfig{}, screenQuad, p)
+			darkScreen(t, d)
+			s := NewHyperionServer(p, nil)
+			if resp := s.Handle([]byte(req)); !resp.Success {
+				t.Fatalf("request failed: %s", resp.Error)
+			}
+			active := p.Active()
+			if active == nil || active.Priority != PriorityScreenOff || !active.Internal {
+				t.Fatalf("active source is %+v, want screen off", active)
+			}
+		})
+	}
+}
+
+func TestHyperionSourceDoesntReplaceInternal(t *testing.T) {
+	p := NewPipeline(4, nil)
+	d := NewScreenDetector(ScreenOffConfig{}, screenQuad, p)
+	darkScreen(t, d)
+	s := NewHyperionServer(p, nil)
+	if resp := s.Handle([]byte(`{"command":"color","priority":239,"color":[255,0,0]}`)); !resp.Success {
+		t.Fatalf("request failed: %s", resp.Error)
+	}
+	sources := p.Sources()
+	if len(sources) != 2 {
+		t.Fatalf("got %d sources, want screen off and the color", len(sources))
+	}
+	if !sources[0].Internal || sources[1].Internal {
+		t.Errorf("internal source must win the tie, got %+v", sources)
+	}
+	s.Handle([]byte(`{"command":"clear","priority":239}`))
+	if active := p.Active(); active == nil || !active.Internal {
+		t.Errorf("clear removed internal source, active is %+v", active)
+	}
+}
+
+func TestHyperionDelayKeepsOrder(t *testing.T) {
+	p := NewPipeline(4, nil)
+	s := NewHyperionServer(p, nil)
+	delay := 50 * time.Millisecond
+	s.SetImageDelay(delay)
+	for _, req := range []string{
+		`{"command":"color","priority":50,"color":[0,255,0]}`,
+		`{"command":"clear","priority":50}`,
+		`{"command":"color","priority":50,"color":[255,0,0]}`,
+	} {
+		if resp := s.Handle([]byte(req)); !resp.Success {
+			t.Fatalf("request %s failed: %s", req, resp.Error)
+		}
+	}
+	if active := p.Active(); active != nil {
+		t.Fatalf("color applied before the delay, active is %+v", active)
+	}
+	red := &ColorSource{color.RGBA{255, 0, 0, 255}}
+	waitFor(t, "red color", func() bool {
+		active := p.Active()
+		return active != nil && reflect.DeepEqual(active.Source, red)
+	})
+	// the clear must not be applied after the color
+	time.Sleep(2 * delay)
+	if active := p.Active(); active == nil || !reflect.DeepEqual(active.Source, red) {
+		t.Errorf("active source is %+v, want red color", active)
+	}
+}
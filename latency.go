@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// latencyTimeout is maximum time to wait until the camera sees the flash or the leds are written.
+const latencyTimeout = 3 * time.Second
+
+// latencyJitter is maximum random pause before the flash, so it doesn't stay in phase with camera frames.
+const latencyJitter = 200 * time.Millisecond
+
+// LatencySample is a single measured flash.
+type LatencySample struct {
+	// Display is time from sending the flash to the calibration page until the camera captured it.
+	// It includes painting by the browser, latency of the screen and of the camera.
+	Display time.Duration
+	// Processing is time from capturing the frame until its colors were written to the leds.
+	Processing time.Duration
+}
+
+// Percentiles summarizes measured durations.
+type Percentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+func (p Percentiles) String() string {
+	ms := func(d time.Duration) string { return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond)) }
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s, max %s", ms(p.P50), ms(p.P90), ms(p.P99), ms(p.Max))
+}
+
+// percentiles uses nearest rank, so only measured values are reported.
+func percentiles(values []time.Duration) Percentiles {
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	sorted := append([]time.Duration(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(sorted))+0.999999) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return Percentiles{P50: rank(0.5), P90: rank(0.9), P99: rank(0.99), Max: sorted[len(sorted)-1]}
+}
+
+// LatencyReport summarizes all samples.
+type LatencyReport struct {
+	Samples    []LatencySample
+	Display    Percentiles
+	Processing Percentiles
+	Total      Percentiles
+}
+
+func NewLatencyReport(samples []LatencySample) *LatencyReport {
+	display := make([]time.Duration, len(samples))
+	processing := make([]time.Duration, len(samples))
+	total := make([]time.Duration, len(samples))
+	for i, s := range samples {
+		display[i] = s.Display
+		processing[i] = s.Processing
+		total[i] = s.Display + s.Processing
+	}
+	return &LatencyReport{
+		Samples:    samples,
+		Display:    percentiles(display),
+		Processing: percentiles(processing),
+		Total:      percentiles(total),
+	}
+}
+
+// latencyTest flashes the screen and measures when the camera sees it and when the leds show it.
+type latencyTest struct {
+	// cal shows the flashes and provides the camera frames.
+	cal        *calibrator
+	regions    []*image.Rectangle
+	correction *ColorMatrix
+	source     *FrameSource
+	pipeline   *Pipeline
+	// written receives time of each write to the leds.
+	written   chan time.Time
+	threshold float64
+}
+
+func newLatencyTest(cal *calibrator, regions []*image.Rectangle, correction *ColorMatrix, p *Pipeline) *latencyTest {
+	t := &latencyTest{
+		cal:        cal,
+		regions:    regions,
+		correction: correction,
+		source:     NewFrameSource(p.Count()),
+		pipeline:   p,
+		written:    make(chan time.Time, 1),
+	}
+	p.SetSource(PriorityCamera, "latency test", t.source, 0)
+	p.OnWrite = func() {
+		select {
+		case t.written <- time.Now():
+		default:
+		}
+	}
+	return t
+}
+
+// screenLuma returns mean luma of the screen in the frame.
+func (t *latencyTest) screenLuma(frame *image.RGBA) (float64, error) {
+	m, err := screenMean(frame, t.cal.quad)
+	if err != nil {
+		return 0, err
+	}
+	return luma(color.RGBA{uint8(m[0]), uint8(m[1]), uint8(m[2]), 255}), nil
+}
+
+// calibrate measures black and white screen to find threshold of the flash.
+func (t *latencyTest) calibrate(ctx context.Context) error {
+	black, err := t.cal.captureScreenColor(ctx, color.RGBA{A: 255}, colorSettleTime)
+	if err != nil {
+		return err
+	}
+	white, err := t.cal.captureScreenColor(ctx, color.RGBA{255, 255, 255, 255}, colorSettleTime)
+	if err != nil {
+		return err
+	}
+	b, err := t.screenLuma(black)
+	if err != nil {
+		return err
+	}
+	w, err := t.screenLuma(white)
+	if err != nil {
+		return err
+	}
+	if w-b < minMarkerContrast {
+		return fmt.Errorf("flash isn't visible in the camera frame, check screen area and camera exposure")
+	}
+	t.threshold = (w + b) / 2
+	return nil
+}
+
+// waitForScreen processes frames like the ambilight does until the screen is lit or dark as requested.
+// Returns the matching frame, the time it was captured and when its colors were written.
+func (t *latencyTest) waitForScreen(ctx context.Context, after time.Time, lit bool) (captured, written time.Time, err error) {
+	ctx, cancel := context.WithTimeout(ctx, latencyTimeout)
+	defer cancel()
+	colors := make([]color.RGBA, len(t.regions))
+	for {
+		b, at, err := t.cal.frames.NextCaptured(ctx, after)
+		if err != nil {
+			return captured, written, err
+		}
+		after = at
+		frame, err := decodeFrame(b)
+		if err != nil {
+			return captured, written, err
+		}
+		frameColors(frame, t.regions, colors)
+		if t.correction != nil {
+			t.correction.ApplyAll(colors)
+		}
+		// drop write of the previous frame
+		select {
+		case <-t.written:
+		default:
+		}
+		t.source.Update(colors, at)
+		t.pipeline.Invalidate()
+		l, err := t.screenLuma(frame)
+		if err != nil {
+			return captured, written, err
+		}
+		if l > t.threshold != lit {
+			continue
+		}
+		select {
+		case written = <-t.written:
+			return at, written, nil
+		case <-ctx.Done():
+			return captured, written, fmt.Errorf("leds weren't written: %s", ctx.Err())
+		}
+	}
+}
+
+// measure flashes the screen once.
+func (t *latencyTest) measure(ctx context.Context) (LatencySample, error) {
+	var s LatencySample
+	if err := t.cal.display.Show(ctx, ColorPattern(color.RGBA{A: 255})); err != nil {
+		return s, err
+	}
+	if _, _, err := t.waitForScreen(ctx, time.Now(), false); err != nil {
+		return s, fmt.Errorf("screen didn't turn dark: %s", err)
+	}
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(latencyJitter)))):
+	case <-ctx.Done():
+		return s, ctx.Err()
+	}
+	// the frame may be captured before the page confirms painting, so frames are watched meanwhile
+	shown := time.Now()
+	showDone := make(chan error, 1)
+	go func() {
+		showDone <- t.cal.display.Show(ctx, ColorPattern(color.RGBA{255, 255, 255, 255}))
+	}()
+	captured, written, err := t.waitForScreen(ctx, shown, true)
+	if showErr := <-showDone; showErr != nil {
+		return s, showErr
+	}
+	if err != nil {
+		return s, fmt.Errorf("camera didn't see the flash: %s", err)
+	}
+	s.Display = captured.Sub(shown)
+	s.Processing = written.Sub(captured)
+	return s, nil
+}
+
+// measureLatency flashes the screen the given amount of times.
+func measureLatency(ctx context.Context, t *latencyTest, iterations int) (*LatencyReport, error) {
+	if err := t.calibrate(ctx); err != nil {
+		return nil, err
+	}
+	samples := make([]LatencySample, 0, iterations)
+	for i := 0; i < iterations; i++ {
+		s, err := t.measure(ctx)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("%3d: display %s, processing %s\n", i+1, s.Display.Round(time.Millisecond), s.Processing.Round(time.Millisecond))
+		samples = append(samples, s)
+	}
+	return NewLatencyReport(samples), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPercentiles(t *testing.T) {
+	ms := func(values ...int) []time.Duration {
+		d := make([]time.Duration, len(values))
+		for i, v := range values {
+			d[i] = time.Duration(v) * time.Millisecond
+		}
+		return d
+	}
+	hundred := ms(rand.Perm(100)...)
+	for i := range hundred {
+		hundred[i] += time.Millisecond
+	}
+	for _, tc := range []struct {
+		name   string
+		values []time.Duration
+		want   []time.Duration
+	}{
+		{"no samples", nil, ms(0, 0, 0, 0)},
+		{"single", ms(5), ms(5, 5, 5, 5)},
+		{"two", ms(10, 20), ms(10, 20, 20, 20)},
+		{"unsorted", ms(30, 10, 20), ms(20, 30, 30, 30)},
+		{"hundred", hundred, ms(50, 90, 99, 100)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			input := append([]time.Duration(nil), tc.values...)
+			p := percentiles(tc.values)
+			if got := []time.Duration{p.P50, p.P90, p.P99, p.Max}; !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("percentiles are %v, want %v", got, tc.want)
+			}
+			if !reflect.DeepEqual(input, tc.values) {
+				t.Error("values were reordered")
+			}
+		})
+	}
+}
+
+func TestNewLatencyReport(t *testing.T) {
+	r := NewLatencyReport([]LatencySample{
+		{Display: 80 * time.Millisecond, Processing: 10 * time.Millisecond},
+		{Display: 60 * time.Millisecond, Processing: 20 * time.Millisecond},
+	})
+	if r.Display.P50 != 60*time.Millisecond || r.Processing.Max != 20*time.Millisecond || r.Total.P50 != 80*time.Millisecond || r.Total.Max != 90*time.Millisecond {
+		t.Errorf("report is %+v", r)
+	}
+}
+
+func TestLatencyWaitForScreen(t *testing.T) {
+	screen := func(c color.RGBA) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+		fillRGBARect(img, &img.Rect, c)
+		b, err := encodeJpeg(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	dark, lit := screen(color.RGBA{10, 10, 10, 255}), screen(color.RGBA{240, 240, 240, 255})
+	q := Quad{image.Pt(0, 0), image.Pt(64, 0), image.Pt(64, 48), image.Pt(0, 48)}
+	topLeft, bottomRight := image.Rect(0, 0, 8, 8), image.Rect(56, 40, 64, 48)
+	regions := []*image.Rectangle{&topLeft, &bottomRight}
+	for _, tc := range []struct {
+		name    string
+		frames  [][]byte
+		lit     bool
+		timeout bool
+	}{
+		{"flash", [][]byte{dark, dark, lit}, true, false},
+		{"dark", [][]byte{lit, dark}, false, false},
+		{"flash not seen", [][]byte{dark, dark, dark}, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			p := NewPipeline(len(regions), nil)
+			go p.Run(ctx)
+			test := newLatencyTest(&calibrator{frames: newFrameBuffer(), quad: q}, regions, nil, p)
+			test.threshold = 128
+			start := time.Now()
+			sent := make(chan time.Time, len(tc.frames))
+			go func() {
+				for _, b := range tc.frames {
+					time.Sleep(20 * time.Millisecond)
+					sent <- time.Now()
+					test.cal.frames.Set(b)
+				}
+			}()
+			waitCtx := ctx
+			if tc.timeout {
+				var cancel context.CancelFunc
+				waitCtx, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+				defer cancel()
+			}
+			captured, written, err := test.waitForScreen(waitCtx, start, tc.lit)
+			if tc.timeout {
+				if err != context.DeadlineExceeded {
+					t.Errorf("error is %v, want deadline exceeded", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the matching frame is the last one
+			var last time.Time
+			for range tc.frames {
+				last = <-sent
+			}
+			if captured.Before(last) || written.Before(captured) {
+				t.Errorf("last frame sent at %s, matching frame captured at %s and written at %s", last.Sub(start), captured.Sub(start), written.Sub(start))
+			}
+			// leds show colors of the matching frame
+			for _, c := range p.Last() {
+				if c.R > 128 != tc.lit {
+					t.Errorf("leds show %v, want lit %t", c, tc.lit)
+				}
+			}
+		})
+	}
+}
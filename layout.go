@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Edge identifies a side of the screen or a corner between two sides.
+type Edge string
+
+const (
+	EdgeTop    Edge = "top"
+	EdgeRight  Edge = "right"
+	EdgeBottom Edge = "bottom"
+	EdgeLeft   Edge = "left"
+
+	CornerTopLeft     Edge = "top-left"
+	CornerTopRight    Edge = "top-right"
+	CornerBottomRight Edge = "bottom-right"
+	CornerBottomLeft  Edge = "bottom-left"
+)
+
+// Direction in which the strip runs when looking at the screen.
+type Direction string
+
+const (
+	Clockwise        Direction = "cw"
+	CounterClockwise Direction = "ccw"
+)
+
+// Gap describes slots on the edge which are not covered by the strip,
+// e.g. space left for the TV stand. From and To are inclusive slot indices.
+type Gap struct {
+	Edge Edge `json:"edge"`
+	From int  `json:"from"`
+	To   int  `json:"to"`
+}
+
+// Position points at a single slot of the layout. Offset is ignored for corners.
+type Position struct {
+	Edge   Edge `json:"edge"`
+	Offset int  `json:"offset"`
+}
+
+// Layout describes how the led strip is placed around the screen.
+//
+// Each edge is divided into equally sized slots which are numbered clockwise:
+// top from left to right, right from top to bottom, bottom from right to left
+// and left from bottom to top. Slots listed in Gaps hold no led. When Corners
+// is set, every corner holds one additional led.
+type Layout struct {
+	Top       int       `json:"top"`
+	Right     int       `json:"right"`
+	Bottom    int       `json:"bottom"`
+	Left      int       `json:"left"`
+	Gaps      []Gap     `json:"gaps,omitempty"`
+	Start     Position  `json:"start"`
+	Direction Direction `json:"direction"`
+	Corners   bool      `json:"corners,omitempty"`
+}
+
+// Slot is a position of a single led within the layout.
+type Slot struct {
+	Edge  Edge
+	Index int
+}
+
+// NewUniformLayout returns layout with the same amount of leds on opposite
+// edges, starting in the top-left corner and running clockwise.
+func NewUniformLayout(ledsX, ledsY int) *Layout {
+	return &Layout{
+		Top:       ledsX,
+		Right:     ledsY,
+		Bottom:    ledsX,
+		Left:      ledsY,
+		Start:     Position{Edge: EdgeTop},
+		Direction: Clockwise,
+	}
+}
+
+var edgeOrder = [4]struct {
+	corner Edge
+	edge   Edge
+}{
+	{CornerTopLeft, EdgeTop},
+	{CornerTopRight, EdgeRight},
+	{CornerBottomRight, EdgeBottom},
+	{CornerBottomLeft, EdgeLeft},
+}
+
+func isCorner(e Edge) bool {
+	switch e {
+	case CornerTopLeft, CornerTopRight, CornerBottomRight, CornerBottomLeft:
+		return true
+	}
+	return false
+}
+
+// EdgeSlots returns amount of slots on the given edge.
+func (l *Layout) EdgeSlots(e Edge) int {
+	switch e {
+	case EdgeTop:
+		return l.Top
+	case EdgeRight:
+		return l.Right
+	case EdgeBottom:
+		return l.Bottom
+	case EdgeLeft:
+		return l.Left
+	}
+	if isCorner(e) && l.Corners {
+		return 1
+	}
+	return 0
+}
+
+func (l *Layout) inGap(e Edge, i int) bool {
+	for _, g := range l.Gaps {
+		if g.Edge == e && i >= g.From && i <= g.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks whether layout describes at least one led and all references are in range.
+func (l *Layout) Validate() error {
+	for _, n := range []int{l.Top, l.Right, l.Bottom, l.Left} {
+		if n < 0 {
+			return fmt.Errorf("amount of leds on edge can't be negative")
+		}
+	}
+	for _, g := range l.Gaps {
+		n := l.EdgeSlots(g.Edge)
+		if isCorner(g.Edge) || n == 0 {
+			return fmt.Errorf("gap references invalid edge %q", g.Edge)
+		}
+		if g.From < 0 || g.To >= n || g.From > g.To {
+			return fmt.Errorf("gap %d-%d is out of range of %s edge (0-%d)", g.From, g.To, g.Edge, n-1)
+		}
+	}
+	switch l.Direction {
+	case Clockwise, CounterClockwise:
+	default:
+		return fmt.Errorf("invalid direction %q: must be %q or %q", l.Direction, Clockwise, CounterClockwise)
+	}
+	if l.EdgeSlots(l.Start.Edge) == 0 {
+		return fmt.Errorf("start position references invalid edge %q", l.Start.Edge)
+	}
+	if !isCorner(l.Start.Edge) {
+		if l.Start.Offset < 0 || l.Start.Offset >= l.EdgeSlots(l.Start.Edge) {
+			return fmt.Errorf("start offset %d is out of range of %s edge", l.Start.Offset, l.Start.Edge)
+		}
+		if l.inGap(l.Start.Edge, l.Start.Offset) {
+			return fmt.Errorf("strip can't start within a gap")
+		}
+	}
+	if l.Count() == 0 {
+		return fmt.Errorf("layout must contain at least one led")
+	}
+	return nil
+}
+
+// Count returns amount of leds in the layout.
+func (l *Layout) Count() int {
+	n := 0
+	for _, e := range edgeOrder {
+		n += l.EdgeSlots(e.corner)
+		for i := 0; i < l.EdgeSlots(e.edge); i++ {
+			if !l.inGap(e.edge, i) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Slots returns positions of all leds in the order they are wired on the strip.
+func (l *Layout) Slots() []Slot {
+	slots := make([]Slot, 0, l.Count())
+	start := 0
+	for _, e := range edgeOrder {
+		if l.EdgeSlots(e.corner) > 0 {
+			if l.Start.Edge == e.corner {
+				start = len(slots)
+			}
+			slots = append(slots, Slot{e.corner, 0})
+		}
+		for i := 0; i < l.EdgeSlots(e.edge); i++ {
+			if l.inGap(e.edge, i) {
+				continue
+			}
+			if l.Start.Edge == e.edge && l.Start.Offset == i {
+				start = len(slots)
+			}
+			slots = append(slots, Slot{e.edge, i})
+		}
+	}
+	ordered := make([]Slot, len(slots))
+	for i := range slots {
+		j := start + i
+		if l.Direction == CounterClockwise {
+			j = start - i + len(slots)
+		}
+		ordered[i] = slots[j%len(slots)]
+	}
+	return ordered
+}
+
+// ScreenRegions returns area of the screen covered by each led in strip order.
+// Depth is the distance in pixels from the screen border towards its center.
+func (l *Layout) ScreenRegions(screenWidth, screenHeight, depth int) []*image.Rectangle {
+	inset := 0
+	if l.Corners {
+		inset = depth
+	}
+	widths := map[Edge][]int{
+		EdgeTop:    divideScreenForLeds(screenWidth-2*inset, l.Top),
+		EdgeBottom: divideScreenForLeds(screenWidth-2*inset, l.Bottom),
+		EdgeRight:  divideScreenForLeds(screenHeight-2*inset, l.Right),
+		EdgeLeft:   divideScreenForLeds(screenHeight-2*inset, l.Left),
+	}
+	// offset of the slot from the start of the edge in clockwise direction
+	offset := func(e Edge, i int) (from, to int) {
+		from = inset
+		for _, w := range widths[e][:i] {
+			from += w
+		}
+		return from, from + widths[e][i]
+	}
+	slots := l.Slots()
+	regions := make([]*image.Rectangle, len(slots))
+	for i, s := range slots {
+		var r image.Rectangle
+		switch s.Edge {
+		case EdgeTop:
+			x0, x1 := offset(s.Edge, s.Index)
+			r = image.Rect(x0, 0, x1, depth)
+		case EdgeRight:
+			y0, y1 := offset(s.Edge, s.Index)
+			r = image.Rect(screenWidth-depth, y0, screenWidth, y1)
+		case EdgeBottom:
+			x0, x1 := offset(s.Edge, s.Index)
+			r = image.Rect(screenWidth-x1, screenHeight-depth, screenWidth-x0, screenHeight)
+		case EdgeLeft:
+			y0, y1 := offset(s.Edge, s.Index)
+			r = image.Rect(0, screenHeight-y1, depth, screenHeight-y0)
+		case CornerTopLeft:
+			r = image.Rect(0, 0, depth, depth)
+		case CornerTopRight:
+			r = image.Rect(screenWidth-depth, 0, screenWidth, depth)
+		case CornerBottomRight:
+			r = image.Rect(screenWidth-depth, screenHeight-depth, screenWidth, screenHeight)
+		case CornerBottomLeft:
+			r = image.Rect(0, screenHeight-depth, depth, screenHeight)
+		}
+		regions[i] = &r
+	}
+	return regions
+}
+
+// CameraRegions returns area of the camera frame covered by each led in strip order.
+// Screen regions are projected onto the quad, where the screen is visible in the camera.
+func (l *Layout) CameraRegions(q Quad, screenWidth, screenHeight, depth int) []*image.Rectangle {
+	screen := l.ScreenRegions(screenWidth, screenHeight, depth)
+	regions := make([]*image.Rectangle, len(screen))
+	w, h := float64(screenWidth), float64(screenHeight)
+	for i, sr := range screen {
+		var r image.Rectangle
+		corners := [4]image.Point{sr.Min, {sr.Max.X, sr.Min.Y}, sr.Max, {sr.Min.X, sr.Max.Y}}
+		for j, c := range corners {
+			pt := q.Map(float64(c.X)/w, float64(c.Y)/h)
+			if j == 0 {
+				r = image.Rectangle{pt, pt}
+				continue
+			}
+			r = r.Union(image.Rectangle{pt, pt.Add(image.Pt(1, 1))})
+		}
+		regions[i] = &r
+	}
+	return regions
+}
+
+// Quad is an area of the camera frame where the screen is visible.
+type Quad struct {
+	TopLeft     image.Point `json:"topLeft"`
+	TopRight    image.Point `json:"topRight"`
+	BottomRight image.Point `json:"bottomRight"`
+	BottomLeft  image.Point `json:"bottomLeft"`
+}
+
+// Map converts normalized screen coordinates (0-1) into the point of the camera frame.
+func (q Quad) Map(u, v float64) image.Point {
+	lerp := func(a, b image.Point, t float64) (float64, float64) {
+		return float64(a.X) + float64(b.X-a.X)*t, float64(a.Y) + float64(b.Y-a.Y)*t
+	}
+	tx, ty := lerp(q.TopLeft, q.TopRight, u)
+	bx, by := lerp(q.BottomLeft, q.BottomRight, u)
+	return image.Pt(int(tx+(bx-tx)*v+0.5), int(ty+(by-ty)*v+0.5))
+}
+
+// ParseGap parses gap in format "edge:from-to" or "edge:index".
+func ParseGap(s string) (Gap, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return Gap{}, fmt.Errorf("invalid gap %q: expected format edge:from-to", s)
+	}
+	from, to, err := parseRange(parts[1])
+	if err != nil {
+		return Gap{}, fmt.Errorf("invalid gap %q: %s", s, err)
+	}
+	return Gap{Edge(parts[0]), from, to}, nil
+}
+
+// ParsePosition parses position in format "edge:offset" or name of a corner.
+func ParsePosition(s string) (Position, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 1 {
+		return Position{Edge: Edge(s)}, nil
+	}
+	offset, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Position{}, fmt.Errorf("invalid position %q: offset must be a number", s)
+	}
+	return Position{Edge(parts[0]), offset}, nil
+}
+
+func parseRange(s string) (from, to int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	from, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q is not a number", parts[0])
+	}
+	to = from
+	if len(parts) == 2 {
+		to, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q is not a number", parts[1])
+		}
+	}
+	return from, to, nil
+}
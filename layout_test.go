@@ -0,0 +1,168 @@
+package main
+
+import (
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLayoutRegions(t *testing.T) {
+	// 100x60 screen with 10 pixels deep regions
+	const width, height, depth = 100, 60, 10
+	for _, tc := range []struct {
+		name    string
+		layout  *Layout
+		slots   []Slot
+		regions []image.Rectangle
+	}{
+		{
+			name:   "uniform clockwise",
+			layout: NewUniformLayout(2, 1),
+			slots: []Slot{
+				{EdgeTop, 0}, {EdgeTop, 1}, {EdgeRight, 0}, {EdgeBottom, 0}, {EdgeBottom, 1}, {EdgeLeft, 0},
+			},
+			regions: []image.Rectangle{
+				image.Rect(0, 0, 50, 10), image.Rect(50, 0, 100, 10),
+				image.Rect(90, 0, 100, 60),
+				image.Rect(50, 50, 100, 60), image.Rect(0, 50, 50, 60),
+				image.Rect(0, 0, 10, 60),
+			},
+		},
+		{
+			name: "counter clockwise from right edge",
+			layout: &Layout{
+				Top: 2, Right: 1, Bottom: 2, Left: 1,
+				Start:     Position{EdgeRight, 0},
+				Direction: CounterClockwise,
+			},
+			slots: []Slot{
+				{EdgeRight, 0}, {EdgeTop, 1}, {EdgeTop, 0}, {EdgeLeft, 0}, {EdgeBottom, 1}, {EdgeBottom, 0},
+			},
+			regions: []image.Rectangle{
+				image.Rect(90, 0, 100, 60),
+				image.Rect(50, 0, 100, 10), image.Rect(0, 0, 50, 10),
+				image.Rect(0, 0, 10, 60),
+				image.Rect(0, 50, 50, 60), image.Rect(50, 50, 100, 60),
+			},
+		},
+		{
+			name: "start offset",
+			layout: &Layout{
+				Top: 3, Left: 1,
+				Start:     Position{EdgeTop, 1},
+				Direction: Clockwise,
+			},
+			slots: []Slot{{EdgeTop, 1}, {EdgeTop, 2}, {EdgeLeft, 0}, {EdgeTop, 0}},
+			regions: []image.Rectangle{
+				image.Rect(34, 0, 67, 10), image.Rect(67, 0, 100, 10),
+				image.Rect(0, 0, 10, 60),
+				image.Rect(0, 0, 34, 10),
+			},
+		},
+		{
+			name: "corners and gap",
+			layout: &Layout{
+				Top: 2, Right: 1, Bottom: 2, Left: 1,
+				Gaps:      []Gap{{EdgeBottom, 0, 1}},
+				Start:     Position{Edge: CornerTopLeft},
+				Direction: Clockwise,
+				Corners:   true,
+			},
+			slots: []Slot{
+				{CornerTopLeft, 0}, {EdgeTop, 0}, {EdgeTop, 1}, {CornerTopRight, 0}, {EdgeRight, 0},
+				{CornerBottomRight, 0}, {CornerBottomLeft, 0}, {EdgeLeft, 0},
+			},
+			// edges are shortened by the corners
+			regions: []image.Rectangle{
+				image.Rect(0, 0, 10, 10), image.Rect(10, 0, 50, 10), image.Rect(50, 0, 90, 10),
+				image.Rect(90, 0, 100, 10), image.Rect(90, 10, 100, 50),
+				image.Rect(90, 50, 100, 60), image.Rect(0, 50, 10, 60), image.Rect(0, 10, 10, 50),
+			},
+		},
+		{
+			name: "counter clockwise from corner",
+			layout: &Layout{
+				Top: 2, Right: 1, Bottom: 2, Left: 1,
+				Gaps:      []Gap{{EdgeBottom, 0, 1}},
+				Start:     Position{Edge: CornerBottomLeft},
+				Direction: CounterClockwise,
+				Corners:   true,
+			},
+			slots: []Slot{
+				{CornerBottomLeft, 0}, {CornerBottomRight, 0}, {EdgeRight, 0}, {CornerTopRight, 0},
+				{EdgeTop, 1}, {EdgeTop, 0}, {CornerTopLeft, 0}, {EdgeLeft, 0},
+			},
+			regions: []image.Rectangle{
+				image.Rect(0, 50, 10, 60), image.Rect(90, 50, 100, 60), image.Rect(90, 10, 100, 50),
+				image.Rect(90, 0, 100, 10), image.Rect(50, 0, 90, 10), image.Rect(10, 0, 50, 10),
+				image.Rect(0, 0, 10, 10), image.Rect(0, 10, 10, 50),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.layout.Validate(); err != nil {
+				t.Fatalf("invalid layout: %s", err)
+			}
+			if n := tc.layout.Count(); n != len(tc.slots) {
+				t.Errorf("count is %d, want %d", n, len(tc.slots))
+			}
+			if slots := tc.layout.Slots(); !reflect.DeepEqual(slots, tc.slots) {
+				t.Errorf("slots are %v\nwant %v", slots, tc.slots)
+			}
+			regions := tc.layout.ScreenRegions(width, height, depth)
+			if len(regions) != len(tc.regions) {
+				t.Fatalf("got %d regions, want %d", len(regions), len(tc.regions))
+			}
+			for i, r := range regions {
+				if *r != tc.regions[i] {
+					t.Errorf("region %d is %v, want %v", i, *r, tc.regions[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLayoutCameraRegions(t *testing.T) {
+	q := Quad{image.Pt(100, 50), image.Pt(200, 50), image.Pt(200, 110), image.Pt(100, 110)}
+	regions := NewUniformLayout(2, 1).CameraRegions(q, 100, 60, 10)
+	// regions are shifted by the quad, far edges include the boundary pixel
+	want := []image.Rectangle{
+		image.Rect(100, 50, 151, 61), image.Rect(150, 50, 201, 61),
+		image.Rect(190, 50, 201, 111),
+		image.Rect(150, 100, 201, 111), image.Rect(100, 100, 151, 111),
+		image.Rect(100, 50, 111, 111),
+	}
+	if len(regions) != len(want) {
+		t.Fatalf("got %d regions, want %d", len(regions), len(want))
+	}
+	for i, r := range regions {
+		if *r != want[i] {
+			t.Errorf("region %d is %v, want %v", i, *r, want[i])
+		}
+	}
+}
+
+func TestLayoutValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		layout Layout
+		err    string
+	}{
+		{"negative edge", Layout{Top: -1, Start: Position{Edge: EdgeTop}, Direction: Clockwise}, "can't be negative"},
+		{"empty", Layout{Start: Position{Edge: EdgeTop}, Direction: Clockwise}, `start position references invalid edge "top"`},
+		{"gap on empty edge", Layout{Top: 2, Gaps: []Gap{{EdgeLeft, 0, 0}}, Start: Position{Edge: EdgeTop}, Direction: Clockwise}, `gap references invalid edge "left"`},
+		{"gap out of range", Layout{Top: 2, Gaps: []Gap{{EdgeTop, 1, 2}}, Start: Position{Edge: EdgeTop}, Direction: Clockwise}, "gap 1-2 is out of range of top edge (0-1)"},
+		{"invalid direction", Layout{Top: 2, Start: Position{Edge: EdgeTop}, Direction: "up"}, `invalid direction "up"`},
+		{"start out of range", Layout{Top: 2, Start: Position{EdgeTop, 2}, Direction: Clockwise}, "start offset 2 is out of range"},
+		{"start in gap", Layout{Top: 2, Gaps: []Gap{{EdgeTop, 0, 0}}, Start: Position{Edge: EdgeTop}, Direction: Clockwise}, "within a gap"},
+		{"corner without corners", Layout{Top: 2, Start: Position{Edge: CornerTopLeft}, Direction: Clockwise}, `invalid edge "top-left"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.layout.Validate()
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error is %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -3,40 +3,79 @@ package main
 import (
 	"fmt"
 	"github.com/stianeikeland/go-rpio"
+	"image/color"
+	"sync"
 	"time"
 )
 
+// spi access is shared by all strips, because rpio keeps chip select and speed globally
+var spi = struct {
+	sync.Mutex
+	opened  int
+	devices map[rpio.SpiDev]int
+}{devices: make(map[rpio.SpiDev]int)}
+
 type WS2801Led struct{
 	State []uint8
 	Count int
 	spi rpio.SpiDev
+	chipSelect uint8
+	speed int
 }
 
-func NewWS2801Led(dev rpio.SpiDev, amountOfLeds int) (*WS2801Led, error) {
+func NewWS2801Led(dev rpio.SpiDev, chipSelect uint8, speed int, amountOfLeds int) (*WS2801Led, error) {
 	if amountOfLeds <= 0 {
 		return nil, fmt.Errorf("amount of leds should be greater than zero")
 	}
-	if err := rpio.Open(); err != nil {
-		return nil, err
+	if speed <= 0 {
+		speed = 1000000 // 1 mHZ
 	}
-	led := &WS2801Led{}
-	if err := rpio.SpiBegin(dev); err != nil {
-		return nil, err
+	spi.Lock()
+	defer spi.Unlock()
+	if spi.opened == 0 {
+		if err := rpio.Open(); err != nil {
+			return nil, err
+		}
 	}
+	spi.opened++
+	if spi.devices[dev] == 0 {
+		if err := rpio.SpiBegin(dev); err != nil {
+			spi.opened--
+			if spi.opened == 0 {
+				rpio.Close()
+			}
+			return nil, err
+		}
+	}
+	spi.devices[dev]++
+	led := &WS2801Led{}
 	led.Count = amountOfLeds
 	led.State = make([]uint8, led.Count*3)
 	led.spi = dev
-	rpio.SpiSpeed(1000000) // 1 mHZ
-	rpio.SpiChipSelect(0)
+	led.chipSelect = chipSelect
+	led.speed = speed
 	return led, nil
 }
 
 func (led *WS2801Led) Close() error {
-	rpio.SpiEnd(led.spi)
+	spi.Lock()
+	defer spi.Unlock()
+	spi.devices[led.spi]--
+	if spi.devices[led.spi] == 0 {
+		rpio.SpiEnd(led.spi)
+	}
+	spi.opened--
+	if spi.opened > 0 {
+		return nil
+	}
 	err := rpio.Close()
 	return err
 }
 
+func (led *WS2801Led) Len() int {
+	return led.Count
+}
+
 func (led *WS2801Led) UpdatePixel(i int, r, g, b uint8) error {
 	if i < 0 || i >= led.Count {
 		return fmt.Errorf("LED index %d is out of range (0-%d)", i, led.Count)
@@ -48,7 +87,26 @@ func (led *WS2801Led) UpdatePixel(i int, r, g, b uint8) error {
 	return nil
 }
 
+// Write sends colors to the strip. Color channels are written as is,
+// their order should be already adjusted to the strip wiring.
+func (led *WS2801Led) Write(colors []color.RGBA) error {
+	if len(colors) > led.Count {
+		return fmt.Errorf("received %d colors for %d leds", len(colors), led.Count)
+	}
+	for i, c := range colors {
+		led.State[i*3] = c.R
+		led.State[i*3+1] = c.G
+		led.State[i*3+2] = c.B
+	}
+	led.Update()
+	return nil
+}
+
 func (led *WS2801Led) Update() {
+	spi.Lock()
+	rpio.SpiChipSelect(led.chipSelect)
+	rpio.SpiSpeed(led.speed)
 	rpio.SpiTransmit(led.State...)
+	spi.Unlock()
 	time.Sleep(2 * time.Millisecond)
 }
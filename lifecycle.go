@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DefaultShutdownTimeout = 5 * time.Second
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Lifecycle cancels its context on SIGINT or SIGTERM and releases
+// acquired resources in the order they were registered.
+type Lifecycle struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+	mu      sync.Mutex
+	hooks   []shutdownHook
+	once    sync.Once
+	err     error
+}
+
+func NewLifecycle(timeout time.Duration) *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	lc := &Lifecycle{ctx: ctx, cancel: cancel, timeout: timeout}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Printf("\nReceived %s, shutting down...\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return lc
+}
+
+// Context is cancelled when the application is requested to stop.
+func (lc *Lifecycle) Context() context.Context {
+	return lc.ctx
+}
+
+// Stop requests the application to stop.
+func (lc *Lifecycle) Stop() {
+	lc.cancel()
+}
+
+// OnShutdown registers a function releasing resources. Functions are called in the order of registration.
+func (lc *Lifecycle) OnShutdown(name string, fn func(ctx context.Context) error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.hooks = append(lc.hooks, shutdownHook{name, fn})
+}
+
+// Shutdown stops the application and calls all registered functions. All of them together
+// have to finish within the shutdown timeout, otherwise remaining ones are skipped.
+func (lc *Lifecycle) Shutdown() error {
+	lc.once.Do(func() {
+		lc.cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), lc.timeout)
+		defer cancel()
+		lc.mu.Lock()
+		hooks := lc.hooks
+		lc.mu.Unlock()
+		errs := make([]error, 0, len(hooks))
+		for _, h := range hooks {
+			done := make(chan error, 1)
+			go func(h shutdownHook) {
+				done <- h.fn(ctx)
+			}(h)
+			select {
+			case err := <-done:
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s", h.name, err))
+				}
+			case <-ctx.Done():
+				errs = append(errs, fmt.Errorf("%s: shutdown timed out", h.name))
+				lc.err = joinErrors(errs)
+				return
+			}
+		}
+		lc.err = joinErrors(errs)
+	})
+	return lc.err
+}
+
+// serveHTTP starts http server which is gracefully stopped on shutdown.
+// The application is stopped when the server fails.
+func serveHTTP(lc *Lifecycle, addr string) {
+	server := &http.Server{Addr: addr, ConnState: metrics.ConnState}
+	go func() {
+		httpLog.Info("http server started", "addr", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			httpLog.Error("http server failed", "addr", addr, "err", err)
+			lc.Stop()
+		}
+	}()
+	lc.OnShutdown("http server", server.Shutdown)
+}
+
+// Watchdog calls OnStall when it isn't kicked within the timeout.
+type Watchdog struct {
+	timeout time.Duration
+	kick    chan struct{}
+	OnStall func()
+}
+
+func NewWatchdog(timeout time.Duration, onStall func()) *Watchdog {
+	return &Watchdog{timeout: timeout, kick: make(chan struct{}, 1), OnStall: onStall}
+}
+
+// Kick notifies the watchdog that the watched loop is still running.
+func (w *Watchdog) Kick() {
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run watches kicks until the context is cancelled. OnStall is called once per stall.
+func (w *Watchdog) Run(ctx context.Context) {
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+	stalled := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.kick:
+			stalled = false
+		case <-timer.C:
+			if !stalled {
+				stalled = true
+				w.OnStall()
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(w.timeout)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"sync"
+	"time"
+)
+
+// Priorities of sources controlled by the light. They're internal, so Hyperion clients can't
+// replace or clear them, and off wins over any external source as it shares the highest priority.
+const (
+	PriorityOff   = 0
+	PriorityLight = 100
+)
+
+// Effects available without any additional source.
+const (
+	EffectAmbilight = "ambilight"
+	EffectStatic    = "static"
+)
+
+// DefaultTransition is a duration of the crossfade when the light changes.
+const DefaultTransition = time.Second
+
+// LightState is a state of the leds as seen by home automation systems.
+type LightState struct {
+	On         bool       `json:"on"`
+	Brightness uint8      `json:"brightness"`
+	Color      color.RGBA `json:"color"`
+	Effect     string     `json:"effect"`
+	// Args are parameters of the effect, color of the state is used when they don't set any.
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// LightUpdate contains changed fields of the light state, nil fields are left intact.
+type LightUpdate struct {
+	On         *bool
+	Brightness *uint8
+	Color      *color.RGBA
+	Effect     *string
+	Args       json.RawMessage
+	// Transition overrides duration of the crossfade.
+	Transition *time.Duration
+}
+
+// LightConfig is the light state stored in the config, it's applied on start and whenever it changes.
+// Missing fields keep the state set over the api or mqtt, fields removed from the config return to defaults.
+type LightConfig struct {
+	On         *bool           `json:"on,omitempty"`
+	Brightness *uint8          `json:"brightness,omitempty"`
+	Color      *effectColor    `json:"color,omitempty"`
+	Effect     *string         `json:"effect,omitempty"`
+	Args       json.RawMessage `json:"args,omitempty"`
+}
+
+// Validate checks that the effect exists and accepts the arguments.
+func (c *LightConfig) Validate(effects EffectRegistry) error {
+	if c.Effect == nil || *c.Effect == EffectAmbilight {
+		return nil
+	}
+	s := LightState{Color: color.RGBA{255, 255, 255, 255}, Args: c.Args}
+	if c.Color != nil {
+		s.Color = c.Color.RGBA()
+	}
+	args, err := effectArgs(s)
+	if err != nil {
+		return err
+	}
+	_, err = effects.NewEffect(*c.Effect, args)
+	return err
+}
+
+// update returns fields which differ from the previous config, prev is nil when nothing was applied yet.
+// Fields removed from the config return to their defaults.
+func (c *LightConfig) update(prev *LightConfig) (LightUpdate, bool) {
+	var u LightUpdate
+	if c == nil {
+		c = &LightConfig{}
+	}
+	if prev == nil {
+		prev = &LightConfig{}
+	}
+	def := defaultLightState()
+	switch {
+	case c.On != nil && (prev.On == nil || *prev.On != *c.On):
+		u.On = c.On
+	case c.On == nil && prev.On != nil:
+		u.On = &def.On
+	}
+	switch {
+	case c.Brightness != nil && (prev.Brightness == nil || *prev.Brightness != *c.Brightness):
+		u.Brightness = c.Brightness
+	case c.Brightness == nil && prev.Brightness != nil:
+		u.Brightness = &def.Brightness
+	}
+	switch {
+	case c.Color != nil && (prev.Color == nil || *prev.Color != *c.Color):
+		rgba := c.Color.RGBA()
+		u.Color = &rgba
+	case c.Color == nil && prev.Color != nil:
+		u.Color = &def.Color
+	}
+	effectChanged := false
+	switch {
+	case c.Effect != nil && (prev.Effect == nil || *prev.Effect != *c.Effect):
+		u.Effect = c.Effect
+		effectChanged = true
+	case c.Effect == nil && prev.Effect != nil:
+		u.Effect = &def.Effect
+		effectChanged = true
+	}
+	switch {
+	// arguments are reset by the effect change, so they're sent again
+	case c.Args != nil && (effectChanged || !bytes.Equal(c.Args, prev.Args)):
+		u.Args = c.Args
+	case c.Args == nil && prev.Args != nil && !effectChanged:
+		u.Args = json.RawMessage("{}")
+	}
+	changed := u.On != nil || u.Brightness != nil || u.Color != nil || u.Effect != nil || u.Args != nil
+	return u, changed
+}
+
+// Light switches between camera ambilight and effects shown on the leds.
+type Light struct {
+	pipeline *Pipeline
+	effects  EffectRegistry
+	// Transition is a duration of the crossfade used when the update doesn't specify one.
+	Transition time.Duration
+	mu         sync.Mutex
+	state      LightState
+	watchers   []func(LightState)
+}
+
+func NewLight(p *Pipeline, effects EffectRegistry) *Light {
+	return &Light{
+		pipeline:   p,
+		effects:    effects,
+		Transition: DefaultTransition,
+		state:      defaultLightState(),
+	}
+}
+
+func defaultLightState() LightState {
+	return LightState{
+		On:         true,
+		Brightness: 255,
+		Color:      color.RGBA{255, 255, 255, 255},
+		Effect:     EffectAmbilight,
+	}
+}
+
+// Effects returns names of all effects the light can show.
+func (l *Light) Effects() []string {
+	return append([]string{EffectAmbilight}, l.effects.EffectNames()...)
+}
+
+// State returns current state of the light.
+func (l *Light) State() LightState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// OnChange registers function called after each state change.
+func (l *Light) OnChange(fn func(LightState)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.watchers = append(l.watchers, fn)
+}
+
+// Update applies changed fields of the state.
+func (l *Light) Update(u LightUpdate) error {
+	l.mu.Lock()
+	state := l.state
+	if u.On != nil {
+		state.On = *u.On
+	}
+	if u.Brightness != nil {
+		state.Brightness = *u.Brightness
+	}
+	if u.Color != nil {
+		state.Color = *u.Color
+		state.Color.A = 255
+		// setting color switches from camera to static color
+		if u.Effect == nil && state.Effect == EffectAmbilight {
+			state.Effect = EffectStatic
+		}
+	}
+	if u.Effect != nil {
+		if *u.Effect != state.Effect {
+			state.Args = nil
+		}
+		state.Effect = *u.Effect
+	}
+	if u.Args != nil {
+		state.Args = u.Args
+	}
+	transition := l.Transition
+	if u.Transition != nil {
+		transition = *u.Transition
+	}
+	if err := l.apply(l.state, state, transition); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	l.state = state
+	watchers := l.watchers
+	l.mu.Unlock()
+	for _, fn := range watchers {
+		fn(state)
+	}
+	return nil
+}
+
+func (l *Light) apply(prev, s LightState, transition time.Duration) error {
+	if s.Effect != prev.Effect || s.Color != prev.Color || !bytes.Equal(s.Args, prev.Args) {
+		d := transition
+		if !s.On || !prev.On {
+			// the change isn't visible, the fade from off is enough
+			d = 0
+		}
+		if s.Effect == EffectAmbilight {
+			l.pipeline.Fade(PriorityLight, "light", nil, d)
+		} else {
+			args, err := effectArgs(s)
+			if err != nil {
+				return err
+			}
+			src, err := l.effects.NewEffect(s.Effect, args)
+			if err != nil {
+				return err
+			}
+			l.pipeline.Fade(PriorityLight, "light", src, d)
+		}
+	}
+	if s.Brightness != prev.Brightness {
+		a := l.pipeline.Adjustment()
+		a.Brightness = float64(s.Brightness) / 255
+		l.pipeline.SetAdjustment(a)
+	}
+	if s.On != prev.On {
+		if s.On {
+			l.pipeline.Fade(PriorityOff, "light", nil, transition)
+		} else {
+			l.pipeline.Fade(PriorityOff, "light", &ColorSource{color.RGBA{A: 255}}, transition)
+		}
+	}
+	return nil
+}
+
+// effectArgs returns arguments of the effect with color of the state used as default.
+func effectArgs(s LightState) (json.RawMessage, error) {
+	args := map[string]json.RawMessage{}
+	if len(s.Args) > 0 {
+		if err := json.Unmarshal(s.Args, &args); err != nil {
+			return nil, fmt.Errorf("invalid effect arguments: %s", err)
+		}
+	}
+	if _, ok := args["color"]; !ok {
+		c, err := json.Marshal(effectColor{s.Color.R, s.Color.G, s.Color.B})
+		if err != nil {
+			return nil, err
+		}
+		args["color"] = c
+	}
+	return json.Marshal(args)
+}
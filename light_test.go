@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLightSurvivesHyperionClients(t *testing.T) {
+	off, effect := false, "rainbow"
+	for _, tc := range []struct {
+		name     string
+		update   LightUpdate
+		requests []string
+		priority int
+	}{
+		{"off with color of the same priority", LightUpdate{On: &off}, []string{`{"command":"color","priority":0,"color":[255,0,0]}`}, PriorityOff},
+		{"off after clearall", LightUpdate{On: &off}, []string{`{"command":"clearall"}`}, PriorityOff},
+		{"effect with color of the same priority", LightUpdate{Effect: &effect}, []string{`{"command":"color","priority":100,"color":[255,0,0]}`}, PriorityLight},
+		{"effect after clear", LightUpdate{Effect: &effect}, []string{
+			`{"command":"color","priority":100,"color":[255,0,0]}`,
+			`{"command":"clear","priority":100}`,
+			`{"command":"clear","priority":-1}`,
+		}, PriorityLight},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewPipeline(4, nil)
+			l := NewLight(p, DefaultEffects())
+			l.Transition = 0
+			if err := l.Update(tc.update); err != nil {
+				t.Fatal(err)
+			}
+			s := NewHyperionServer(p, nil)
+			for _, req := range tc.requests {
+				if resp := s.Handle([]byte(req)); !resp.Success {
+					t.Fatalf("%s failed: %s", req, resp.Error)
+				}
+			}
+			active := p.Active()
+			if active == nil || !active.Internal || active.Priority != tc.priority {
+				t.Errorf("active source is %+v, want internal with priority %d", active, tc.priority)
+			}
+		})
+	}
+}
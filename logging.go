@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is severity of the log record.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (LogLevel, error) {
+	for l, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q: must be debug, info, warn or error", s)
+}
+
+// Log formats.
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// logSettings are shared by all loggers.
+var logSettings = struct {
+	sync.Mutex
+	out   io.Writer
+	level LogLevel
+	json  bool
+}{out: os.Stderr, level: LevelInfo}
+
+// configureLogging sets format and minimal level of all loggers.
+func configureLogging(format, level string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != LogText && format != LogJSON {
+		return fmt.Errorf("unknown log format %q: must be %q or %q", format, LogText, LogJSON)
+	}
+	logSettings.Lock()
+	defer logSettings.Unlock()
+	logSettings.level = l
+	logSettings.json = format == LogJSON
+	return nil
+}
+
+// Logger writes records of a single component. Records carry key value pairs after the message.
+type Logger struct {
+	component string
+}
+
+// Loggers of the application components.
+var (
+	mainLog       = &Logger{"main"}
+	cameraLog     = &Logger{"camera"}
+	calibratorLog = &Logger{"calibrator"}
+	ledLog        = &Logger{"led"}
+	httpLog       = &Logger{"http"}
+	mqttLog       = &Logger{"mqtt"}
+	hyperionLog   = &Logger{"hyperion"}
+)
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level LogLevel, msg string, kv []interface{}) {
+	logSettings.Lock()
+	defer logSettings.Unlock()
+	if level < logSettings.level {
+		return
+	}
+	fields := []interface{}{
+		"time", time.Now().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"component", l.component,
+		"msg", msg,
+	}
+	if len(kv)%2 != 0 {
+		kv = append(kv, "!MISSING")
+	}
+	fields = append(fields, kv...)
+	var b bytes.Buffer
+	if logSettings.json {
+		writeJSONRecord(&b, fields)
+	} else {
+		writeTextRecord(&b, fields)
+	}
+	b.WriteByte('\n')
+	// there's nowhere else to report failed logging
+	logSettings.out.Write(b.Bytes())
+}
+
+// logValue converts the value to the form written in the record.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// writeTextRecord writes logfmt line, values with spaces or quotes are quoted.
+func writeTextRecord(b *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(b, "%v=", fields[i])
+		s := fmt.Sprint(logValue(fields[i+1]))
+		if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+}
+
+// writeJSONRecord writes object keeping order of the fields.
+func writeJSONRecord(b *bytes.Buffer, fields []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		b.Write(key)
+		b.WriteByte(':')
+		value, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+}
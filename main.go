@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/hybridgroup/mjpeg"
@@ -9,25 +10,16 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	"io/ioutil"
-	"log"
 	"math"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"sync"
 	"time"
 )
 
-// raspistill -o img.jpg --exif none --mode 7 -w 640 -h 480 -th none -q 20 -e jpg
-// raspistill options:
-// -o -   : capture img and output into stdout
-// -e jpg : set jpeg encoding
-// --exif none : doesn't save any exif metadata
-// -md 6 : captures in 1280x720 resolution
-// -ex off : turn off automatic exposure and gain control
-// -drc off : disable dynamic range (feature useful in dark areas)
+// Camera frames are captured by raspivid, its arguments are described by CameraConfig
+// and can be changed in the config file, by init flags or over the http api.
 
 // Deps:
 // https://github.com/technomancers/piCamera - raspivid wrapper to capture video frames
@@ -39,10 +31,39 @@ import (
 // Top Right: 573.4:34.6
 
 type Config struct {
+	// Version of the file format, see ConfigVersion.
+	Version int `json:"version"`
 	ScreenWidth int `json:"screenWidth"`
 	ScreenHeight int `json:"screenHeight"`
-	LedsX int `json:"ledsX"`
-	LedsY int `json:"ledsY"`
+	// Layout describes placement of the strip around the screen.
+	Layout *Layout `json:"layout,omitempty"`
+	// LedDepth is a distance in screen pixels from the border analyzed for each led.
+	LedDepth int `json:"ledDepth,omitempty"`
+	// ScreenQuad is an area of the camera frame where the screen is visible.
+	ScreenQuad *Quad `json:"screenQuad,omitempty"`
+	// Outputs lists led devices, single WS2801 strip covering the whole layout is used when empty.
+	Outputs []*OutputConfig `json:"outputs,omitempty"`
+	// MQTT enables Home Assistant integration when set.
+	MQTT *MQTTConfig `json:"mqtt,omitempty"`
+	// ScreenOff controls turning leds off while the screen is dark, defaults are used when nil.
+	ScreenOff *ScreenOffConfig `json:"screenOff,omitempty"`
+	// Camera contains raspivid arguments, defaults are used when nil.
+	Camera *CameraConfig `json:"camera,omitempty"`
+	// ColorCorrection maps camera colors to the colors shown on the screen, measured by calibration.
+	ColorCorrection *ColorMatrix `json:"colorCorrection,omitempty"`
+	// LedRegions are areas of the camera frame detected by calibration in the strip order.
+	LedRegions []image.Rectangle `json:"ledRegions,omitempty"`
+	// ImageDelay in milliseconds postpones images received over Hyperion API, so they show together
+	// with the picture delayed by the screen. Measured by latency-test.
+	ImageDelay int `json:"imageDelay,omitempty"`
+	// Smoothing blends camera colors with the previous frames, 0 disables it and values close to 1 react slowly.
+	Smoothing float64 `json:"smoothing,omitempty"`
+	// Light is the state of the light applied on start, other changes are kept only while running.
+	Light *LightConfig `json:"light,omitempty"`
+	// Profiles override a subset of the settings by name, e.g. lower brightness at night.
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty"`
+	// Profile is the name of the active profile, the settings above are used as they are when empty.
+	Profile string `json:"profile,omitempty"`
 	dir string
 }
 
@@ -59,29 +80,34 @@ const ScreenHeight = 2160
 
 var leds = [2]int{31, 17}
 
-var points = map[string]image.Point{
-	"topLeft": image.Pt(58, 70),
-	"topRight": image.Pt(537, 61),
-	"bottomLeft": image.Pt(27, 343),
-	"bottomRight": image.Pt(560, 334),
+const DefaultLedDepth = 300
+
+var screenQuad = Quad{
+	TopLeft: image.Pt(58, 70),
+	TopRight: image.Pt(537, 61),
+	BottomRight: image.Pt(560, 334),
+	BottomLeft: image.Pt(27, 343),
 }
 
 var defishStr float64
 var defishZoom float64
 
-var ledMap = generateLedMap()
-var ledColors = make([]*color.RGBA, leds[AxisX]*2+leds[AxisY]*2)
+var ledMap = NewUniformLayout(leds[AxisX], leds[AxisY]).CameraRegions(screenQuad, ScreenWidth, ScreenHeight, DefaultLedDepth)
+var ledColors = make([]*color.RGBA, len(ledMap))
 
 var camera *piCamera.PiCamera
 var stream *mjpeg.Stream
 var cameraStream *mjpeg.Stream
 var calibrationStream *mjpeg.Stream
+var cameraFrames = newFrameBuffer()
 
 var calibrationRGBA *image.RGBA
 //var calibrationScreens []image.Image
 
+const DefaultConfigDir = "./.rpicam-ambilight"
+
 var Conf = &Config{
-	dir: "./.rpicam-ambilight",
+	dir: DefaultConfigDir,
 }
 
 func (c *Config) CalibrationScreenDir() string {
@@ -93,7 +119,70 @@ func (c *Config) CalibrationScreenPath(index int) string {
 }
 
 func (c *Config) HasCalibrationSettingsSet() bool {
-	return c.ScreenWidth > 0 && c.ScreenHeight > 0 && c.LedsX > 0 && c.LedsY > 0
+	return c.ScreenWidth > 0 && c.ScreenHeight > 0 && c.LedLayout().Validate() == nil
+}
+
+// LedLayout returns configured layout of the strip, empty one when it's missing.
+func (c *Config) LedLayout() *Layout {
+	if c.Layout != nil {
+		return c.Layout
+	}
+	return &Layout{}
+}
+
+// LedOutputs returns configured led devices.
+func (c *Config) LedOutputs() []*OutputConfig {
+	if len(c.Outputs) > 0 {
+		return c.Outputs
+	}
+	return defaultOutputs(c.LedLayout().Count())
+}
+
+// CameraQuad returns an area of the camera frame where the screen is visible.
+func (c *Config) CameraQuad() Quad {
+	if c.ScreenQuad != nil {
+		return *c.ScreenQuad
+	}
+	return screenQuad
+}
+
+// CameraLedRegions returns areas of the camera frame analyzed for each led. Regions detected
+// by calibration are preferred, the ones computed from the screen area are used for the rest.
+func (c *Config) CameraLedRegions() []*image.Rectangle {
+	regions := c.LedLayout().CameraRegions(c.CameraQuad(), c.ScreenWidth, c.ScreenHeight, c.Depth())
+	if len(c.LedRegions) != len(regions) {
+		return regions
+	}
+	for i := range regions {
+		if !c.LedRegions[i].Empty() {
+			r := c.LedRegions[i]
+			regions[i] = &r
+		}
+	}
+	return regions
+}
+
+// ScreenOffSettings returns configured screen off detection with defaults filled in.
+func (c *Config) ScreenOffSettings() ScreenOffConfig {
+	if c.ScreenOff != nil {
+		return c.ScreenOff.withDefaults()
+	}
+	return ScreenOffConfig{}.withDefaults()
+}
+
+// CameraSettings returns configured camera arguments or the defaults.
+func (c *Config) CameraSettings() CameraConfig {
+	if c.Camera != nil {
+		return *c.Camera
+	}
+	return DefaultCameraConfig()
+}
+
+func (c *Config) Depth() int {
+	if c.LedDepth > 0 {
+		return c.LedDepth
+	}
+	return DefaultLedDepth
 }
 
 func createOrCleanUpDir(dir string) error {
@@ -111,150 +200,69 @@ func createOrCleanUpDir(dir string) error {
 
 func handleError(err error) (ok bool) {
 	if err != nil {
-		fmt.Printf("Error occured: %s", err)
+		mainLog.Error("command failed", "err", err)
 		return false
 	}
 	return true
 }
 
 func main() {
-	if ok := handleError(Conf.Read()); !ok {
-		return
-	}
-	if len(os.Args) >= 2 {
-		switch os.Args[1] {
-		case "init":
-			runInitCmd()
-		case "calibrate":
-			if !Conf.HasCalibrationSettingsSet() {
-				fmt.Printf("Missing or invalid configuration: run \"./%s init\"", os.Args[0])
-				return
-			}
-			camera, err := startCamera()
-			if ok := handleError(err); !ok {
-				return
-			}
-			defer camera.Stop()
-			serveCameraStream(camera)
-			serveCalibrationStream()
-			go startServer()
-			fmt.Println("Started camera stream at http://127.0.0.1:8081/camera")
-			fmt.Println("Adjust camera placement to it's permanent position and make sure whole screen is visible")
-			fmt.Println()
-			fmt.Println("Started calibration server at http://127.0.0.1:8081/calibration")
-			fmt.Println("Open website on calibrated screen and make it full screen")
-			fmt.Println("When you are ready press enter to start calibration process")
-			reader := bufio.NewReader(os.Stdin)
-			_, err = reader.ReadString('\n')
-			if ok := handleError(err); !ok {
-				return
-			}
-			// todo: show each of pre-generated calibration screen images
-			// todo: capture camera frame and store coordinates of all white pixels
-			// todo: save coordinates into config file
-			// todo: show calibrated result image with highlighted areas
-		case "run":
-			// todo: if config or calibration coordinates doesn't exist, show error
-			// todo: capture frame
-			// todo: analyze avg color of each led position based on calibration coordinates
-			// todo: set led color
-		default:
-			fmt.Printf("Unrecognized command: %s", os.Args[1])
-			return
-		}
-	}
-return
-	//var err error
-	/*led, err := NewWS2801Led(rpio.Spi0, 96)
-	if err != nil {
-		log.Printf("error occurred: %q", err)
-		return
-	}
-	defer led.Close()
-	for i := 0; i < led.Count; i++ {
-		err = led.UpdatePixel(i, 0, 255, 0)
-		if err != nil {
-			log.Printf("error occurred: %q", err)
-			return
-		}
-	}*/
-	//calibrationRGBA = drawCalibrationImage(leds[AxisX], leds[AxisY], ScreenWidth, ScreenHeight)
-	/*args := piCamera.NewArgs()
-	args.Width = 1640
-	args.Height = 1232
-	args.Mode = 4
-	args.ExposureMode = piCamera.ExpVerylong
-	args.Brightness = 60
-	args.Contrast = 40
-	camera, err = piCamera.New(nil, args)
-	if err != nil {
-		log.Printf("error occurred: %q", err)
-		return
-	}
-	err = camera.Start()
-	defer camera.Stop()
-	if err != nil {
-		log.Printf("error occurred: %q", err)
-		return
-	}
-
-	//stream = mjpeg.NewStream()
-	calibrationStream = mjpeg.NewStream()*/
-
-	//go mjpegCapture()
-
-	//http.Handle("/stream", stream)
-	/*http.Handle("/calibration", calibrationStream)
-	http.HandleFunc("/calibrate", func(w http.ResponseWriter, r *http.Request) {
-		go calibrate()
-		http.ServeFile(w, r, "./calibration.html")
-	})
-	http.HandleFunc("/leds", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Content-Type", "application/json")
-		response := struct {
-			Positions []*image.Rectangle `json:"positions"`
-			Colors    []*color.RGBA      `json:"colors"`
-		}{ledMap, ledColors}
-		encoder := json.NewEncoder(w)
-		err := encoder.Encode(response)
-		if err != nil {
-			log.Printf("error occurred: %q", err)
-		}
-	})
-	http.Handle("/", http.FileServer(http.Dir("./static")))
-	log.Fatal(http.ListenAndServe(":8081", nil))*/
+	os.Exit(execute(os.Args[1:]))
 }
 
-func serveCameraStream(cam *piCamera.PiCamera) {
+func serveCameraStream(ctx context.Context, cam *piCamera.PiCamera) {
 	cameraStream = mjpeg.NewStream()
 	http.Handle("/camera-stream", cameraStream)
 	http.HandleFunc("/camera", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "camera.html")
 	})
-	go mjpegCapture(cam)
+	go mjpegCapture(ctx, cam)
 }
 
-func serveCalibrationStream() {
+func serveCalibrationStream(ctx context.Context) {
 	calibrationStream = mjpeg.NewStream()
 	http.Handle("/calibration-stream", calibrationStream)
 	http.HandleFunc("/calibration", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "calibration.html")
 	})
+	go repeatCalibrationImage(ctx)
 }
 
-func startServer() {
-	log.Fatal(http.ListenAndServe(":8081", nil))
+var calibrationImage = struct {
+	sync.Mutex
+	jpeg []byte
+}{}
+
+// showCalibrationImage displays the image on the calibration page.
+func showCalibrationImage(b []byte) {
+	calibrationImage.Lock()
+	calibrationImage.jpeg = b
+	calibrationImage.Unlock()
+	calibrationStream.UpdateJPEG(b)
 }
 
-func startCamera() (*piCamera.PiCamera, error) {
-	args := piCamera.NewArgs()
-	args.Width = 1640
-	args.Height = 1232
-	args.Mode = 4
-	args.ExposureMode = piCamera.ExpVerylong
-	args.Brightness = 60
-	args.Contrast = 40
-	camera, err := piCamera.New(nil, args)
+// repeatCalibrationImage sends the shown image again, clients connected later receive only new frames.
+func repeatCalibrationImage(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			calibrationImage.Lock()
+			b := calibrationImage.jpeg
+			calibrationImage.Unlock()
+			if b != nil {
+				calibrationStream.UpdateJPEG(b)
+			}
+		}
+	}
+}
+
+func startCamera(c CameraConfig) (*piCamera.PiCamera, error) {
+	cameraLog.Debug("starting camera", "width", c.Width, "height", c.Height, "mode", c.Mode, "exposure", c.Exposure, "locked", c.Locked)
+	camera, err := piCamera.New(nil, c.args())
 	if err != nil {
 		return nil, err
 	}
@@ -265,87 +273,29 @@ func startCamera() (*piCamera.PiCamera, error) {
 	return camera, nil
 }
 
-func runInitCmd() {
-	if len(os.Args) < 6 {
-		fmt.Printf("Usage: %s init {screen_width} {screen_height} {amount_of_leds_x} {amount_of_leds_y}", os.Args[0])
-		return
-	}
-	var err error
-	Conf.ScreenWidth, err = strconv.Atoi(os.Args[2])
-	if ok := handleError(err); !ok {
-		return
-	}
-	Conf.ScreenHeight, err = strconv.Atoi(os.Args[3])
-	if ok := handleError(err); !ok {
-		return
-	}
-	Conf.LedsX, err = strconv.Atoi(os.Args[4])
-	if ok := handleError(err); !ok {
-		return
-	}
-	Conf.LedsY, err = strconv.Atoi(os.Args[5])
-	if ok := handleError(err); !ok {
-		return
-	}
-	if !Conf.HasCalibrationSettingsSet() {
-		handleError(fmt.Errorf("entered arguments must be greater than zero"))
-		return
-	}
-	if ok := handleError(Conf.Write()); !ok {
-		return
-	}
-	dir := Conf.CalibrationScreenDir()
-	if ok := handleError(createOrCleanUpDir(dir)); !ok {
-		return
-	}
-	fmt.Println("Generating calibration screens...")
-	var wg sync.WaitGroup
-	buffer := make(chan *CalibrationJpegImage)
-	generateCalibrationImages(buffer, Conf)
-	for img := range buffer {
-		wg.Add(1)
-		go func(img *CalibrationJpegImage) {
-			defer wg.Done()
-			err := ioutil.WriteFile(Conf.CalibrationScreenPath(img.Index()), img.Bytes(), 0644)
-			handleError(err)
-		}(img)
-	}
-	wg.Wait()
-	fmt.Println("\nDone.")
-}
-
-func (c *Config) Read() error {
-	f, err := os.Open(c.Dest())
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	d := json.NewDecoder(bufio.NewReader(f))
-	err = d.Decode(c)
-	return err
-}
-
-func (c *Config) Write() error {
-	err := os.MkdirAll(c.dir, os.ModePerm)
+func (c *Config) Write() (err error) {
+	err = os.MkdirAll(c.dir, os.ModePerm)
 	if err != nil {
 		return err
 	}
-	f, err := os.Create(c.Dest())
+	// the file is replaced at once, so the running application never reads it half written
+	tmp := c.Dest() + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
 	defer func() {
-		if err := f.Close(); err != nil {
-			panic(err)
+		// unflushed data may fail to be written only on close
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, c.Dest())
+		} else {
+			os.Remove(tmp)
 		}
 	}()
+	c.Version = ConfigVersion
 	w := bufio.NewWriter(f)
 	encoder := json.NewEncoder(w)
 	err = encoder.Encode(c)
@@ -361,18 +311,19 @@ func (c *Config) Dest() string {
 }
 
 
-func mjpegCapture(cam *piCamera.PiCamera) {
-	for {
+func mjpegCapture(ctx context.Context, cam *piCamera.PiCamera) {
+	for ctx.Err() == nil {
 		b, err := cam.GetFrame()
 		if err != nil {
-			log.Printf("error occurred: %q", err)
+			metrics.CameraError()
+			cameraLog.Error("reading frame failed", "err", err)
 			time.Sleep(time.Duration(1) * time.Second)
 			continue
 		}
 
 		//img, err := jpeg.Decode(bytes.NewReader(b))
 		if err != nil {
-			log.Printf("error occurred: %q", err)
+			cameraLog.Error("processing frame failed", "err", err)
 			continue
 		}
 
@@ -385,7 +336,7 @@ func mjpegCapture(cam *piCamera.PiCamera) {
 		//buffer := new(bytes.Buffer)
 		//err = jpeg.Encode(buffer, img, nil)
 		if err != nil {
-			log.Printf("error occurred: %q", err)
+			cameraLog.Error("processing frame failed", "err", err)
 			continue
 		}
 
@@ -394,6 +345,7 @@ func mjpegCapture(cam *piCamera.PiCamera) {
 		}*/
 		//stream.UpdateJPEG(buffer.Bytes())
 		cameraStream.UpdateJPEG(b)
+		cameraFrames.Set(b)
 	}
 }
 
@@ -508,71 +460,3 @@ func avgColor(c1, c2 *color.RGBA) *color.RGBA {
 		A: uint8(math.Sqrt(a / 2)),
 	}
 }
-
-func generateLedMap() []*image.Rectangle {
-	ledMap := make([]*image.Rectangle, leds[AxisX]*2+leds[AxisY]*2)
-
-	edges := [4]struct {
-		from image.Point
-		to image.Point
-		axis int
-		calcRectDest func(x0, y0, stepX, stepY int) (x1, y1 int)
-	}{
-		{points["topLeft"], points["topRight"], AxisX, func(x0, y0, stepX, stepY int) (x1, y1 int) {
-			return x0 + stepX, y0 + 50
-		}},
-		{points["topRight"], points["bottomRight"], AxisY, func(x0, y0, stepX, stepY int) (x1, y1 int) {
-			return x0 - 50, y0 + stepY
-		}},
-		{points["bottomRight"], points["bottomLeft"], AxisX, func(x0, y0, stepX, stepY int) (x1, y1 int) {
-			return x0 - stepX, y0 - 50
-		}},
-		{points["bottomLeft"], points["topLeft"], AxisY, func(x0, y0, stepX, stepY int) (x1, y1 int) {
-			return x0 + 50, y0 - stepY
-		}},
-	}
-
-	idx := 0
-	for _, edge := range edges {
-		amount := leds[edge.axis]
-		diffX := edge.to.X - edge.from.X
-		diffY := edge.to.Y - edge.from.Y
-		stepX := diffX / amount
-		stepY := diffY / amount
-		remainderX := diffX % amount
-		remainderY := diffY % amount
-
-		x0 := edge.from.X
-		y0 := edge.from.Y
-		for i := 0; i < amount; i++ {
-			if i != 0 {
-				x0 = x0 + stepX
-				y0 = y0 + stepY
-			}
-			if remainderX != 0 {
-				x0 += signum(remainderX)
-				remainderX += -signum(remainderX)
-			}
-			if remainderY != 0 {
-				y0 += signum(remainderY)
-				remainderY += -signum(remainderY)
-			}
-			x1, y1 := edge.calcRectDest(x0, y0, stepX, stepY)
-			rect := image.Rect(x0, y0, x1, y1)
-			ledMap[idx] = &rect
-			idx++
-		}
-	}
-	return ledMap
-}
-
-func signum(n int) int {
-	switch {
-	case n < 0:
-		return -1
-	case n > 0:
-		return 1
-	default:
-		return 0
-	}
-}
\ No newline at end of file
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"time"
+)
+
+// Marker is a row of blocks in the center of the calibration pattern, away from the led regions.
+// It starts with white and black guard block followed by bits of the code, most significant first.
+const (
+	markerBits   = 8
+	markerBlocks = markerBits + 2
+	markerX      = 0.3
+	markerY      = 0.47
+	markerW      = 0.4
+	markerH      = 0.06
+)
+
+// minMarkerContrast is minimal luma difference between the guard blocks of visible marker.
+const minMarkerContrast = 30
+
+// Handshake waits for the marker at most markerTimeout by default, then the pattern is shown again.
+const (
+	markerTimeout = 3 * time.Second
+	markerRetries = 3
+)
+
+// markerRects returns normalized areas of the marker blocks, lit ones are returned when on is set.
+func markerRects(code int, on bool) []PatternRect {
+	var rects []PatternRect
+	w := markerW / markerBlocks
+	for i := 0; i < markerBlocks; i++ {
+		lit := i == 0 || i > 1 && code>>uint(markerBlocks-1-i)&1 == 1
+		if lit != on {
+			continue
+		}
+		rects = append(rects, PatternRect{X: markerX + float64(i)*w, Y: markerY, W: w, H: markerH})
+	}
+	return rects
+}
+
+// markerPatternRects returns colored blocks of the marker, dark ones first.
+func markerPatternRects(code int) []PatternRect {
+	var rects []PatternRect
+	for _, r := range markerRects(code, false) {
+		r.Color = effectColor{0, 0, 0}
+		rects = append(rects, r)
+	}
+	for _, r := range markerRects(code, true) {
+		r.Color = effectColor{255, 255, 255}
+		rects = append(rects, r)
+	}
+	return rects
+}
+
+// withMarker returns copy of the pattern with the marker drawn over it.
+func (p Pattern) withMarker(code int) Pattern {
+	p.Rects = append(append([]PatternRect(nil), p.Rects...), markerPatternRects(code)...)
+	p.Marker = &code
+	return p
+}
+
+// markerContains reports whether the normalized screen point is covered by the marker.
+func markerContains(u, v float64) bool {
+	return u >= markerX && u < markerX+markerW && v >= markerY && v < markerY+markerH
+}
+
+// markerArea returns area of the camera frame covered by the marker, with margin for blur.
+func markerArea(q Quad) image.Rectangle {
+	const margin = 0.02
+	var r image.Rectangle
+	for i, uv := range [][2]float64{
+		{markerX - margin, markerY - margin}, {markerX + markerW + margin, markerY - margin},
+		{markerX + markerW + margin, markerY + markerH + margin}, {markerX - margin, markerY + markerH + margin},
+	} {
+		pt := q.Map(uv[0], uv[1])
+		if i == 0 {
+			r = image.Rectangle{pt, pt}
+			continue
+		}
+		r = r.Union(image.Rectangle{pt, pt.Add(image.Pt(1, 1))})
+	}
+	return r
+}
+
+// readMarker returns code of the marker visible in the frame.
+func readMarker(frame *image.RGBA, q Quad) (int, bool) {
+	var lumas [markerBlocks]float64
+	w := markerW / markerBlocks
+	for i := range lumas {
+		center := q.Map(markerX+(float64(i)+0.5)*w, markerY+markerH/2)
+		// average small neighbourhood, so single noisy pixel doesn't flip the bit
+		n := 0
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				pt := center.Add(image.Pt(dx, dy))
+				if pt.In(frame.Rect) {
+					lumas[i] += luma(frame.RGBAAt(pt.X, pt.Y))
+					n++
+				}
+			}
+		}
+		if n == 0 {
+			return 0, false
+		}
+		lumas[i] /= float64(n)
+	}
+	white, black := lumas[0], lumas[1]
+	if white-black < minMarkerContrast {
+		return 0, false
+	}
+	threshold := (white + black) / 2
+	code := 0
+	for _, l := range lumas[2:] {
+		code <<= 1
+		if l > threshold {
+			code |= 1
+		}
+	}
+	return code, true
+}
+
+// ignoredArea returns camera frame area covered by the marker, which the led detection ignores.
+func (c *calibrator) ignoredArea() image.Rectangle {
+	if !c.handshake {
+		return image.Rectangle{}
+	}
+	return markerArea(c.quad)
+}
+
+// nextMarker returns code of the next pattern. Codes wrap around, but 0 is skipped,
+// so a frame with only the guard blocks visible isn't taken for a shown pattern.
+func (c *calibrator) nextMarker() int {
+	c.sequence = c.sequence%(1<<markerBits-1) + 1
+	return c.sequence
+}
+
+// showWithHandshake shows the pattern with the next marker code and returns camera frame showing it.
+// The pattern is shown again when the camera doesn't see the marker in time.
+func (c *calibrator) showWithHandshake(ctx context.Context, p Pattern, settle time.Duration) (*image.RGBA, error) {
+	code := c.nextMarker()
+	p = p.withMarker(code)
+	for attempt := 1; attempt <= markerRetries; attempt++ {
+		if err := c.display.Show(ctx, p); err != nil {
+			return nil, err
+		}
+		frame, err := c.waitForMarker(ctx, code)
+		if err == nil && settle > 0 {
+			// the screen is ready, but the camera may still adjust to it
+			select {
+			case <-time.After(settle):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			frame, err = c.waitForMarker(ctx, code)
+		}
+		if err == nil {
+			return frame, nil
+		}
+		if err != context.DeadlineExceeded {
+			return nil, err
+		}
+		calibratorLog.Warn("camera didn't see calibration pattern", "code", code, "attempt", attempt, "attempts", markerRetries)
+	}
+	return nil, fmt.Errorf("camera didn't see calibration pattern %d, make sure the whole screen is visible or use --handshake=false", code)
+}
+
+// waitForMarker returns the second consecutive frame with the code, so the frame isn't blended
+// with the previous pattern. context.DeadlineExceeded is returned after the marker timeout.
+func (c *calibrator) waitForMarker(ctx context.Context, code int) (*image.RGBA, error) {
+	timeout, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	matched := 0
+	after := time.Now()
+	for {
+		b, err := c.frames.Next(timeout, after)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		after = time.Now()
+		frame, err := decodeFrame(b)
+		if err != nil {
+			return nil, err
+		}
+		if read, ok := readMarker(frame, c.quad); !ok || read != code {
+			matched = 0
+			continue
+		}
+		if matched++; matched == 2 {
+			return frame, nil
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var markerQuad = Quad{image.Pt(0, 0), image.Pt(200, 0), image.Pt(200, 100), image.Pt(0, 100)}
+
+func TestMarkerRoundtrip(t *testing.T) {
+	for _, code := range []int{1, 2, 0x80, 0xa5, 255} {
+		p := ColorPattern(color.RGBA{A: 255}).withMarker(code)
+		img := p.Render(200, 100)
+		// camera frame is a jpeg
+		b, err := encodeJpeg(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := decodeFrame(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := readMarker(frame, markerQuad); !ok || got != code {
+			t.Errorf("marker %d is read as %d, %t", code, got, ok)
+		}
+	}
+	for _, c := range []color.RGBA{{A: 255}, {255, 255, 255, 255}} {
+		p := ColorPattern(c)
+		if code, ok := readMarker(p.Render(200, 100), markerQuad); ok {
+			t.Errorf("%v screen without marker is read as %d", c, code)
+		}
+	}
+}
+
+func TestNextMarkerSkipsZero(t *testing.T) {
+	c := &calibrator{sequence: 253}
+	for _, want := range []int{254, 255, 1, 2} {
+		if code := c.nextMarker(); code != want {
+			t.Errorf("next code is %d, want %d", code, want)
+		}
+	}
+}
+
+// fakeMarkerScreen shows patterns to a camera feeding the frame buffer.
+type fakeMarkerScreen struct {
+	frames *frameBuffer
+	// lag is amount of frames still showing the previous pattern.
+	lag int
+	// missed is amount of first patterns, which the camera doesn't see.
+	missed int
+	mu     sync.Mutex
+	shown  []Pattern
+	screen []byte
+	next   []byte
+	delay  int
+}
+
+func (s *fakeMarkerScreen) Show(ctx context.Context, p Pattern) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shown = append(s.shown, p)
+	if len(s.shown) <= s.missed {
+		p = ColorPattern(color.RGBA{A: 255})
+	}
+	b, err := encodeJpeg(p.Render(200, 100))
+	if err != nil {
+		return err
+	}
+	s.next, s.delay = b, s.lag
+	return nil
+}
+
+// run captures the screen until the context is done.
+func (s *fakeMarkerScreen) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+		s.mu.Lock()
+		if s.next != nil {
+			if s.delay == 0 {
+				s.screen, s.next = s.next, nil
+			}
+			s.delay--
+		}
+		screen := s.screen
+		s.mu.Unlock()
+		if screen != nil {
+			s.frames.Set(screen)
+		}
+	}
+}
+
+func TestShowWithHandshake(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		lag    int
+		missed int
+		shown  int
+		err    string
+	}{
+		{name: "seen", shown: 1},
+		{name: "previous pattern shown meanwhile", lag: 5, shown: 1},
+		{name: "retried", missed: 2, shown: 3},
+		{name: "never seen", missed: markerRetries, shown: markerRetries, err: "camera didn't see calibration pattern 8"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			screen := &fakeMarkerScreen{frames: newFrameBuffer(), lag: tc.lag}
+			go screen.run(ctx)
+			c := &calibrator{display: screen, frames: screen.frames, quad: markerQuad, handshake: true, timeout: 200 * time.Millisecond, sequence: 7}
+			// the previous pattern is visible when the next is shown
+			screen.Show(ctx, ColorPattern(color.RGBA{A: 255}).withMarker(7))
+			screen.mu.Lock()
+			screen.shown, screen.missed = nil, tc.missed
+			screen.mu.Unlock()
+			frame, err := c.capturePattern(ctx, ColorPattern(color.RGBA{255, 0, 0, 255}), colorSettleTime)
+			if len(screen.shown) != tc.shown {
+				t.Errorf("pattern shown %d times, want %d", len(screen.shown), tc.shown)
+			}
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error is %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code, ok := readMarker(frame, markerQuad); !ok || code != 8 {
+				t.Errorf("captured frame has marker %d, %t, want 8", code, ok)
+			}
+			if c := frame.RGBAAt(10, 10); c.R < 200 || c.G > 50 {
+				t.Errorf("captured frame is %v, want red pattern", c)
+			}
+		})
+	}
+}
+
+func TestCapturePatternWithoutHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	screen := &fakeMarkerScreen{frames: newFrameBuffer()}
+	go screen.run(ctx)
+	c := &calibrator{display: screen, frames: screen.frames, quad: markerQuad}
+	frame, err := c.capturePattern(ctx, ColorPattern(color.RGBA{255, 0, 0, 255}), 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readMarker(frame, markerQuad); ok {
+		t.Error("marker shown without handshake")
+	}
+	if c.ignoredArea() != (image.Rectangle{}) {
+		t.Errorf("area %v is ignored without handshake", c.ignoredArea())
+	}
+	if c := frame.RGBAAt(10, 10); c.R < 200 || c.G > 50 {
+		t.Errorf("captured frame is %v, want red pattern", c)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics counts events of the capture loop and http server, they are exposed for Prometheus.
+type Metrics struct {
+	mu sync.Mutex
+	metricValues
+}
+
+type metricValues struct {
+	framesCaptured uint64
+	framesDropped  uint64
+	cameraErrors   uint64
+	writeErrors    uint64
+	captureFPS     float64
+	lastCaptured   time.Time
+	decode         durationSummary
+	analysis       durationSummary
+	ledWrite       durationSummary
+	httpClients    int
+}
+
+// durationSummary is a Prometheus summary without quantiles.
+type durationSummary struct {
+	sum   time.Duration
+	count uint64
+}
+
+func (s *durationSummary) observe(d time.Duration) {
+	s.sum += d
+	s.count++
+}
+
+var metrics = &Metrics{}
+
+// FrameCaptured counts frame received from the camera at the given time.
+func (m *Metrics) FrameCaptured(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.framesCaptured++
+	if !m.lastCaptured.IsZero() {
+		if dt := now.Sub(m.lastCaptured).Seconds(); dt > 0 {
+			if m.captureFPS == 0 {
+				m.captureFPS = 1 / dt
+			} else {
+				m.captureFPS += statsSmoothing * (1/dt - m.captureFPS)
+			}
+		}
+	}
+	m.lastCaptured = now
+}
+
+// FrameDropped counts frame which wasn't shown on the leds.
+func (m *Metrics) FrameDropped() {
+	m.mu.Lock()
+	m.framesDropped++
+	m.mu.Unlock()
+}
+
+// CameraError counts failed read of the camera frame.
+func (m *Metrics) CameraError() {
+	m.mu.Lock()
+	m.cameraErrors++
+	m.mu.Unlock()
+}
+
+// LedWritten records duration of the write to the outputs.
+func (m *Metrics) LedWritten(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ledWrite.observe(d)
+	if err != nil {
+		m.writeErrors++
+	}
+}
+
+// FrameDecoded records duration of decoding the camera frame.
+func (m *Metrics) FrameDecoded(d time.Duration) {
+	m.mu.Lock()
+	m.decode.observe(d)
+	m.mu.Unlock()
+}
+
+// FrameAnalyzed records duration of computing led colors from the frame.
+func (m *Metrics) FrameAnalyzed(d time.Duration) {
+	m.mu.Lock()
+	m.analysis.observe(d)
+	m.mu.Unlock()
+}
+
+// ConnState tracks connected http clients, it's meant for http.Server.ConnState.
+// Hijacked connections, e.g. websockets, are no longer tracked.
+func (m *Metrics) ConnState(conn net.Conn, state http.ConnState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		m.httpClients++
+	case http.StateClosed, http.StateHijacked:
+		m.httpClients--
+	}
+}
+
+// metricsWriter writes metrics in Prometheus text exposition format.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// metricLabel is a label of a single sample.
+type metricLabel struct {
+	name, value string
+}
+
+// metricSample is a value of the metric with the given labels.
+type metricSample struct {
+	labels []metricLabel
+	value  float64
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (w *metricsWriter) printf(format string, a ...interface{}) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, a...)
+	}
+}
+
+func (w *metricsWriter) header(name, typ, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w *metricsWriter) sample(name string, labels []metricLabel, value float64) {
+	w.printf("%s", name)
+	if len(labels) > 0 {
+		parts := make([]string, len(labels))
+		for i, l := range labels {
+			parts[i] = fmt.Sprintf(`%s="%s"`, l.name, labelEscaper.Replace(l.value))
+		}
+		w.printf("{%s}", strings.Join(parts, ","))
+	}
+	w.printf(" %s\n", formatMetricValue(value))
+}
+
+func (w *metricsWriter) counter(name, help string, value float64) {
+	w.header(name, "counter", help)
+	w.sample(name, nil, value)
+}
+
+func (w *metricsWriter) gauge(name, help string, value float64) {
+	w.header(name, "gauge", help)
+	w.sample(name, nil, value)
+}
+
+func (w *metricsWriter) vector(name, typ, help string, samples []metricSample) {
+	w.header(name, typ, help)
+	for _, s := range samples {
+		w.sample(name, s.labels, s.value)
+	}
+}
+
+func (w *metricsWriter) summary(name, help string, s durationSummary) {
+	w.header(name, "summary", help)
+	w.sample(name+"_sum", nil, s.sum.Seconds())
+	w.sample(name+"_count", nil, float64(s.count))
+}
+
+// formatMetricValue prints integers without exponent, so counters stay readable.
+func formatMetricValue(v float64) string {
+	if v == float64(int64(v)) {
+		return fmt.Sprintf("%d", int64(v))
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// lightMode describes what the leds show, screen detector is optional.
+func lightMode(light *Light, screen *ScreenDetector) string {
+	s := light.State()
+	switch {
+	case !s.On:
+		return "off"
+	case s.Effect == EffectAmbilight && screen != nil && screen.State().Off:
+		return "screen-off"
+	}
+	return s.Effect
+}
+
+// write writes all metrics, light and screen detector are optional.
+func (m *Metrics) write(w *metricsWriter, p *Pipeline, light *Light, screen *ScreenDetector) {
+	m.mu.Lock()
+	c := m.metricValues
+	m.mu.Unlock()
+	w.counter("ambilight_frames_captured_total", "Camera frames captured.", float64(c.framesCaptured))
+	w.gauge("ambilight_capture_fps", "Rate of captured camera frames.", c.captureFPS)
+	w.counter("ambilight_frames_dropped_total", "Camera frames which weren't shown on the leds.", float64(c.framesDropped))
+	w.counter("ambilight_camera_errors_total", "Failed reads of camera frames.", float64(c.cameraErrors))
+	w.summary("ambilight_frame_decode_seconds", "Time spent decoding camera frames.", c.decode)
+	w.summary("ambilight_frame_analysis_seconds", "Time spent computing led colors from camera frames.", c.analysis)
+	w.summary("ambilight_led_write_seconds", "Time spent writing colors to the outputs.", c.ledWrite)
+	w.counter("ambilight_led_write_errors_total", "Failed writes to the outputs.", float64(c.writeErrors))
+	w.gauge("ambilight_http_clients", "Connected http clients.", float64(c.httpClients))
+	if p != nil {
+		stats := p.Stats()
+		w.gauge("ambilight_output_fps", "Rate of frames written to the outputs.", stats.FPS)
+		w.gauge("ambilight_latency_seconds", "Time from capturing camera frame until its colors are written.", stats.Latency.Seconds())
+	}
+	var frames, limited []metricSample
+	var outputs Outputs
+	if p != nil {
+		outputs = p.Outputs()
+	}
+	for _, out := range outputs {
+		if out.Limiter == nil {
+			continue
+		}
+		f, l := out.Limiter.Stats()
+		labels := []metricLabel{{"output", out.Name}}
+		frames = append(frames, metricSample{labels, float64(f)})
+		limited = append(limited, metricSample{labels, float64(l)})
+	}
+	if len(frames) > 0 {
+		w.vector("ambilight_power_frames_total", "counter", "Frames checked by the power limiter.", frames)
+		w.vector("ambilight_power_limited_frames_total", "counter", "Frames dimmed to fit into the power budget.", limited)
+	}
+	if light != nil {
+		current := lightMode(light, screen)
+		modes := append(light.Effects(), "off")
+		if screen != nil {
+			modes = append(modes, "screen-off")
+		}
+		sort.Strings(modes)
+		samples := make([]metricSample, len(modes))
+		for i, mode := range modes {
+			samples[i].labels = []metricLabel{{"mode", mode}}
+			if mode == current {
+				samples[i].value = 1
+			}
+		}
+		w.vector("ambilight_mode", "gauge", "Current mode of the leds, the active one is 1.", samples)
+	}
+}
+
+// handleMetrics registers Prometheus endpoint, light and screen detector are optional.
+func handleMetrics(mux *http.ServeMux, p *Pipeline, light *Light, screen *ScreenDetector) {
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		mw := &metricsWriter{w: bufio.NewWriter(w)}
+		metrics.write(mw, p, light, screen)
+		if mw.err == nil {
+			mw.err = mw.w.Flush()
+		}
+		if mw.err != nil {
+			httpLog.Warn("writing metrics failed", "err", mw.err)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeMetrics(t *testing.T, fn func(w *metricsWriter)) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := &metricsWriter{w: bufio.NewWriter(&buf)}
+	fn(w)
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if w.err != nil {
+		t.Fatal(w.err)
+	}
+	return buf.String()
+}
+
+func TestMetricsExposition(t *testing.T) {
+	m := &Metrics{}
+	start := time.Unix(0, 0)
+	m.FrameCaptured(start)
+	m.FrameCaptured(start.Add(40 * time.Millisecond))
+	m.FrameDropped()
+	m.FrameDecoded(1500 * time.Microsecond)
+	m.FrameDecoded(500 * time.Microsecond)
+	m.LedWritten(time.Millisecond, nil)
+	got := writeMetrics(t, func(w *metricsWriter) { m.write(w, nil, nil, nil) })
+	for _, want := range []string{
+		"# HELP ambilight_frames_captured_total Camera frames captured.\n# TYPE ambilight_frames_captured_total counter\nambilight_frames_captured_total 2\n",
+		"# TYPE ambilight_capture_fps gauge\nambilight_capture_fps 25\n",
+		"ambilight_frames_dropped_total 1\n",
+		"# TYPE ambilight_frame_decode_seconds summary\nambilight_frame_decode_seconds_sum 0.002\nambilight_frame_decode_seconds_count 2\n",
+		"ambilight_frame_analysis_seconds_sum 0\nambilight_frame_analysis_seconds_count 0\n",
+		"ambilight_led_write_seconds_sum 0.001\nambilight_led_write_seconds_count 1\n",
+		"ambilight_led_write_errors_total 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in\n%s", want, got)
+		}
+	}
+	// optional components are omitted
+	for _, name := range []string{"ambilight_output_fps", "ambilight_power_frames_total", "ambilight_mode"} {
+		if strings.Contains(got, name) {
+			t.Errorf("unexpected %s in\n%s", name, got)
+		}
+	}
+	if !strings.HasSuffix(got, "\n") || strings.Contains(got, "\n\n") {
+		t.Errorf("every line must end with a single newline:\n%s", got)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	got := writeMetrics(t, func(w *metricsWriter) {
+		w.vector("test_metric", "gauge", "Test.", []metricSample{
+			{[]metricLabel{{"output", `tv "left"`}}, 1},
+			{[]metricLabel{{"output", `C:\strip`}, {"line", "a\nb"}}, 0.5},
+		})
+	})
+	want := "# HELP test_metric Test.\n# TYPE test_metric gauge\n" +
+		`test_metric{output="tv \"left\""} 1` + "\n" +
+		`test_metric{output="C:\\strip",line="a\nb"} 0.5` + "\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMetricsOfPipeline(t *testing.T) {
+	limiter := NewPowerLimiter(PowerConfig{MilliampsPerChannel: 10, BudgetMilliamps: 1})
+	limiter.Limit(testColors(2))
+	p := NewPipeline(2, Outputs{{Name: `desk "1"`, Limiter: limiter}, {Name: "tv"}})
+	light := NewLight(p, DefaultEffects())
+	got := writeMetrics(t, func(w *metricsWriter) { (&Metrics{}).write(w, p, light, nil) })
+	for _, want := range []string{
+		"# TYPE ambilight_output_fps gauge\n",
+		"# TYPE ambilight_power_frames_total counter\nambilight_power_frames_total{output=\"desk \\\"1\\\"\"} 1\n",
+		"ambilight_power_limited_frames_total{output=\"desk \\\"1\\\"\"} 1\n",
+		"# TYPE ambilight_mode gauge\n",
+		`ambilight_mode{mode="ambilight"} 1` + "\n",
+		`ambilight_mode{mode="off"} 0` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `output="tv"`) {
+		t.Errorf("output without limiter is reported:\n%s", got)
+	}
+	if strings.Contains(got, "screen-off") {
+		t.Errorf("screen off mode reported without detector:\n%s", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	handleMetrics(mux, nil, nil, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content type is %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "# TYPE ambilight_http_clients gauge\n") {
+		t.Errorf("unexpected body:\n%s", rec.Body.String())
+	}
+}
+
+func TestFormatMetricValue(t *testing.T) {
+	for v, want := range map[float64]string{0: "0", 12345678: "12345678", 0.25: "0.25", -3: "-3", 1e-7: "1e-07"} {
+		if got := formatMetricValue(v); got != want {
+			t.Errorf("%g is formatted as %s, want %s", v, got, want)
+		}
+	}
+}
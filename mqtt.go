@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"image/color"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMQTTDiscoveryPrefix = "homeassistant"
+	DefaultMQTTBaseTopic       = "rpi-cam-ambilight"
+	mqttSensorInterval         = 10 * time.Second
+	mqttTimeout                = 5 * time.Second
+)
+
+// MQTTConfig describes connection to MQTT broker and topics used for Home Assistant integration.
+type MQTTConfig struct {
+	// Broker address, e.g. tcp://192.168.1.2:1883.
+	Broker   string `json:"broker"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+	// DiscoveryPrefix of Home Assistant MQTT discovery.
+	DiscoveryPrefix string `json:"discoveryPrefix,omitempty"`
+	// BaseTopic prefixes state and command topics.
+	BaseTopic string `json:"baseTopic,omitempty"`
+	// NodeID identifies this instance in Home Assistant, hostname is used when empty.
+	NodeID string `json:"nodeId,omitempty"`
+}
+
+func (c *MQTTConfig) Validate() error {
+	if c.Broker == "" {
+		return fmt.Errorf("mqtt broker address is required")
+	}
+	for _, t := range []string{c.BaseTopic, c.DiscoveryPrefix} {
+		if strings.ContainsAny(t, "#+") {
+			return fmt.Errorf("mqtt topic %q can't contain wildcards", t)
+		}
+	}
+	return nil
+}
+
+func (c *MQTTConfig) nodeID() string {
+	if c.NodeID != "" {
+		return c.NodeID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "ambilight"
+	}
+	// discovery node id may contain only letters, numbers, underscores and hyphens
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, hostname)
+}
+
+func (c *MQTTConfig) topic(parts ...string) string {
+	base := c.BaseTopic
+	if base == "" {
+		base = DefaultMQTTBaseTopic
+	}
+	return strings.Join(append([]string{base, c.nodeID()}, parts...), "/")
+}
+
+func (c *MQTTConfig) discoveryTopic(component, object string) string {
+	prefix := c.DiscoveryPrefix
+	if prefix == "" {
+		prefix = DefaultMQTTDiscoveryPrefix
+	}
+	return strings.Join([]string{prefix, component, c.nodeID(), object, "config"}, "/")
+}
+
+// mqttLightPayload is a state and command of the light in Home Assistant JSON schema.
+type mqttLightPayload struct {
+	State      string     `json:"state,omitempty"`
+	Brightness *uint8     `json:"brightness,omitempty"`
+	ColorMode  string     `json:"color_mode,omitempty"`
+	Color      *mqttColor `json:"color,omitempty"`
+	Effect     *string    `json:"effect,omitempty"`
+	// Transition is a duration of the crossfade in seconds.
+	Transition *float64 `json:"transition,omitempty"`
+}
+
+type mqttColor struct {
+	R uint8 `json:"r"`
+	G uint8 `json:"g"`
+	B uint8 `json:"b"`
+}
+
+// MQTTBridge exposes the light, profiles and pipeline stats to Home Assistant over MQTT.
+type MQTTBridge struct {
+	conf     *MQTTConfig
+	client   mqtt.Client
+	light    *Light
+	pipeline *Pipeline
+	app      *ambilight
+}
+
+// NewMQTTBridge creates a bridge with a client connecting to the broker of the config. Options may
+// be nil, otherwise the broker, credentials and handlers of the bridge are set on them.
+func NewMQTTBridge(c *MQTTConfig, light *Light, p *Pipeline, app *ambilight, opts *mqtt.ClientOptions) *MQTTBridge {
+	b := &MQTTBridge{conf: c, light: light, pipeline: p, app: app}
+	if opts == nil {
+		opts = mqtt.NewClientOptions()
+	}
+	opts.AddBroker(c.Broker).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(c.topic("availability"), "offline", 1, true).
+		// handlers publish and wait for the broker, which would block delivery of ordered messages
+		SetOrderMatters(false).
+		SetOnConnectHandler(b.onConnect)
+	clientID := c.ClientID
+	if clientID == "" {
+		clientID = "rpi-cam-ambilight-" + c.nodeID()
+	}
+	opts.SetClientID(clientID)
+	b.client = mqtt.NewClient(opts)
+	return b
+}
+
+// Connect starts connecting to the broker in background, retrying until it succeeds.
+// Discovery and state are published on every (re)connection.
+func (b *MQTTBridge) Connect() error {
+	token := b.client.Connect()
+	// with connect retry enabled, the token completes only on success or on invalid options
+	if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// LightChanged publishes the state of the light, changes while disconnected are published on connection.
+func (b *MQTTBridge) LightChanged() {
+	if b.client.IsConnected() {
+		b.publishState()
+	}
+}
+
+// ProfilesChanged publishes the active profile and the options of the profile select.
+func (b *MQTTBridge) ProfilesChanged() {
+	if b.client.IsConnected() {
+		if err := b.publishDiscovery(); err != nil {
+			mqttLog.Error("publishing discovery failed", "err", err)
+		}
+		b.publishProfile()
+	}
+}
+
+func (b *MQTTBridge) Disconnect() {
+	if b.client.IsConnected() {
+		b.publish(b.conf.topic("availability"), true, "offline")
+	}
+	b.client.Disconnect(uint(mqttTimeout / time.Millisecond))
+}
+
+func (b *MQTTBridge) onConnect(client mqtt.Client) {
+	if err := b.publishDiscovery(); err != nil {
+		mqttLog.Error("publishing discovery failed", "err", err)
+	}
+	token := client.Subscribe(b.conf.topic("light", "set"), 1, func(_ mqtt.Client, msg mqtt.Message) {
+		if err := b.handleCommand(msg.Payload()); err != nil {
+			mqttLog.Warn("invalid command", "topic", msg.Topic(), "err", err)
+		}
+	})
+	if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+		mqttLog.Error("subscribing failed", "err", token.Error())
+	}
+	token = client.Subscribe(b.conf.topic("profile", "set"), 1, func(_ mqtt.Client, msg mqtt.Message) {
+		if err := b.app.SwitchProfile(string(msg.Payload())); err != nil {
+			mqttLog.Warn("switching profile failed", "topic", msg.Topic(), "err", err)
+			// the select shows the requested option until the state is published again
+			b.publishProfile()
+		}
+	})
+	if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+		mqttLog.Error("subscribing failed", "err", token.Error())
+	}
+	b.publish(b.conf.topic("availability"), true, "online")
+	b.publishState()
+	b.publishProfile()
+	b.publishSensorValues()
+}
+
+func (b *MQTTBridge) device() map[string]interface{} {
+	return map[string]interface{}{
+		"identifiers":  []string{"rpi-cam-ambilight-" + b.conf.nodeID()},
+		"name":         "Ambilight " + b.conf.nodeID(),
+		"manufacturer": "rpi-cam-ambilight",
+		"model":        "Raspberry Pi camera ambilight",
+	}
+}
+
+// publishDiscovery announces the light and sensors to Home Assistant.
+func (b *MQTTBridge) publishDiscovery() error {
+	for topic, config := range b.discoveryConfigs() {
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		if err := b.publish(topic, true, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discoveryConfigs returns discovery payloads of all entities by their config topic.
+func (b *MQTTBridge) discoveryConfigs() map[string]map[string]interface{} {
+	id := b.conf.nodeID()
+	availability := b.conf.topic("availability")
+	return map[string]map[string]interface{}{
+		b.conf.discoveryTopic("light", "light"): {
+			"name":                  "Ambilight",
+			"unique_id":             id + "_light",
+			"schema":                "json",
+			"state_topic":           b.conf.topic("light", "state"),
+			"command_topic":         b.conf.topic("light", "set"),
+			"availability_topic":    availability,
+			"brightness":            true,
+			"supported_color_modes": []string{"rgb"},
+			"effect":                true,
+			"effect_list":           b.light.Effects(),
+			"device":                b.device(),
+		},
+		b.conf.discoveryTopic("select", "profile"): {
+			"name":               "Ambilight profile",
+			"unique_id":          id + "_profile",
+			"state_topic":        b.conf.topic("profile", "state"),
+			"command_topic":      b.conf.topic("profile", "set"),
+			"availability_topic": availability,
+			"options":            currentConfig().ProfileNames(),
+			"device":             b.device(),
+		},
+		b.conf.discoveryTopic("sensor", "fps"): {
+			"name":                "Ambilight FPS",
+			"unique_id":           id + "_fps",
+			"state_topic":         b.conf.topic("sensor", "fps"),
+			"availability_topic":  availability,
+			"unit_of_measurement": "fps",
+			"state_class":         "measurement",
+			"device":              b.device(),
+		},
+		b.conf.discoveryTopic("sensor", "latency"): {
+			"name":                "Ambilight latency",
+			"unique_id":           id + "_latency",
+			"state_topic":         b.conf.topic("sensor", "latency"),
+			"availability_topic":  availability,
+			"unit_of_measurement": "ms",
+			"device_class":        "duration",
+			"state_class":         "measurement",
+			"device":              b.device(),
+		},
+	}
+}
+
+func (b *MQTTBridge) publish(topic string, retained bool, payload interface{}) error {
+	token := b.client.Publish(topic, 1, retained, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("publishing to %s timed out", topic)
+	}
+	return token.Error()
+}
+
+func (b *MQTTBridge) publishState() {
+	s := b.light.State()
+	state := "OFF"
+	if s.On {
+		state = "ON"
+	}
+	payload, err := json.Marshal(mqttLightPayload{
+		State:      state,
+		Brightness: &s.Brightness,
+		ColorMode:  "rgb",
+		Color:      &mqttColor{s.Color.R, s.Color.G, s.Color.B},
+		Effect:     &s.Effect,
+	})
+	if err == nil {
+		err = b.publish(b.conf.topic("light", "state"), true, payload)
+	}
+	if err != nil {
+		mqttLog.Warn("publishing state failed", "err", err)
+	}
+}
+
+func (b *MQTTBridge) publishProfile() {
+	if err := b.publish(b.conf.topic("profile", "state"), true, currentConfig().ActiveProfile()); err != nil {
+		mqttLog.Warn("publishing profile failed", "err", err)
+	}
+}
+
+func (b *MQTTBridge) publishSensorValues() {
+	stats := b.pipeline.Stats()
+	err := joinErrors([]error{
+		b.publish(b.conf.topic("sensor", "fps"), false, fmt.Sprintf("%.1f", stats.FPS)),
+		b.publish(b.conf.topic("sensor", "latency"), false, fmt.Sprintf("%d", stats.Latency.Milliseconds())),
+	})
+	if err != nil {
+		mqttLog.Warn("publishing sensors failed", "err", err)
+	}
+}
+
+func (b *MQTTBridge) publishSensors(ctx context.Context) {
+	ticker := time.NewTicker(mqttSensorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if b.client.IsConnected() {
+				b.publishSensorValues()
+			}
+		}
+	}
+}
+
+// handleCommand applies command received from Home Assistant.
+func (b *MQTTBridge) handleCommand(payload []byte) error {
+	var cmd mqttLightPayload
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return fmt.Errorf("invalid mqtt command: %s", err)
+	}
+	var on *bool
+	switch cmd.State {
+	case "ON", "OFF":
+		v := cmd.State == "ON"
+		on = &v
+	case "":
+	default:
+		return fmt.Errorf("invalid mqtt command: unknown state %q", cmd.State)
+	}
+	u := LightUpdate{On: on, Brightness: cmd.Brightness, Effect: cmd.Effect}
+	if cmd.Color != nil {
+		u.Color = &color.RGBA{cmd.Color.R, cmd.Color.G, cmd.Color.B, 255}
+	}
+	if cmd.Transition != nil {
+		d := time.Duration(*cmd.Transition * float64(time.Second))
+		u.Transition = &d
+	}
+	return b.light.Update(u)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker is a minimal MQTT 3.1.1 broker. It accepts any client, forwards messages
+// with qos 0 to exact topic subscriptions and keeps retained messages.
+type testBroker struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	subs     map[net.Conn]map[string]bool
+	retained map[string]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{ln: ln, subs: make(map[net.Conn]map[string]bool), retained: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.subs[conn] = make(map[string]bool)
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) URL() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *testBroker) Close() {
+	b.ln.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.subs {
+		conn.Close()
+	}
+}
+
+// Retained returns the retained message of the topic.
+func (b *testBroker) Retained(topic string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+// Publish delivers the message to subscribers as if another client published it.
+func (b *testBroker) Publish(topic, payload string) {
+	b.publish(topic, payload, false)
+}
+
+func (b *testBroker) publish(topic, payload string, retain bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if retain {
+		if payload == "" {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	for conn, subs := range b.subs {
+		if subs[topic] {
+			conn.Write(mqttPacket(0x30, append(mqttString(topic), payload...)))
+		}
+	}
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, multiplier := 0, 1
+		for {
+			d, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length += int(d&0x7f) * multiplier
+			multiplier *= 128
+			if d&0x80 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // connect
+			b.write(conn, mqttPacket(0x20, []byte{0, 0}))
+		case 3: // publish
+			n := int(binary.BigEndian.Uint16(body))
+			topic, payload := string(body[2:2+n]), body[2+n:]
+			if qos := header >> 1 & 3; qos > 0 {
+				b.write(conn, mqttPacket(0x40, payload[:2]))
+				payload = payload[2:]
+			}
+			b.publish(topic, string(payload), header&1 == 1)
+		case 8: // subscribe
+			ack := append([]byte(nil), body[:2]...)
+			var topics []string
+			for rest := body[2:]; len(rest) > 0; {
+				n := int(binary.BigEndian.Uint16(rest))
+				topics = append(topics, string(rest[2:2+n]))
+				rest = rest[3+n:]
+				ack = append(ack, 0)
+			}
+			b.mu.Lock()
+			conn.Write(mqttPacket(0x90, ack))
+			for _, topic := range topics {
+				b.subs[conn][topic] = true
+				if payload, ok := b.retained[topic]; ok {
+					conn.Write(mqttPacket(0x31, append(mqttString(topic), payload...)))
+				}
+			}
+			b.mu.Unlock()
+		case 10: // unsubscribe
+			b.write(conn, mqttPacket(0xb0, body[:2]))
+		case 12: // ping
+			b.write(conn, mqttPacket(0xd0, nil))
+		case 14: // disconnect
+			return
+		}
+	}
+}
+
+// write sends the packet, the lock keeps it from interleaving with forwarded messages.
+func (b *testBroker) write(conn net.Conn, packet []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn.Write(packet)
+}
+
+func mqttPacket(header byte, body []byte) []byte {
+	p := []byte{header}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		p = append(p, d)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestApp returns the application with a night profile, which switches without restarting
+// the camera or outputs. The config is stored in a temporary directory removed by the cleanup.
+func newTestApp(t *testing.T) (*ambilight, func()) {
+	dir, err := ioutil.TempDir("", "ambilight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		dir:          dir,
+		ScreenWidth:  3840,
+		ScreenHeight: 2160,
+		Layout:       NewUniformLayout(10, 6),
+		Profiles:     map[string]json.RawMessage{"night": json.RawMessage(`{"smoothing":0.5}`)},
+	}
+	active, err := c.WithProfile(c.Profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := currentConfig()
+	setConfig(c)
+	p := NewPipeline(active.LedLayout().Count(), nil)
+	a := &ambilight{lc: NewLifecycle(time.Second), pipeline: p, capture: &capture{}, light: NewLight(p, DefaultEffects())}
+	a.light.Transition = 0
+	a.active.Store(active)
+	a.settings.Store(newFrameSettings(active))
+	a.screen = NewScreenDetector(active.ScreenOffSettings(), active.CameraQuad(), p)
+	a.watchMQTT()
+	return a, func() {
+		a.lc.Stop()
+		setConfig(prev)
+		os.RemoveAll(dir)
+	}
+}
+
+// connectTestBridge connects the bridge of the app to the broker and waits until it subscribed.
+func connectTestBridge(t *testing.T, broker *testBroker, a *ambilight) {
+	t.Helper()
+	if err := a.startMQTT(&MQTTConfig{Broker: broker.URL(), NodeID: "tv"}); err != nil {
+		t.Fatal(err)
+	}
+	// availability is published after subscribing
+	waitFor(t, "availability", func() bool {
+		payload, _ := broker.Retained("rpi-cam-ambilight/tv/availability")
+		return payload == "online"
+	})
+}
+
+func newTestBridge() *MQTTBridge {
+	p := NewPipeline(4, nil)
+	l := NewLight(p, DefaultEffects())
+	l.Transition = 0
+	return NewMQTTBridge(&MQTTConfig{Broker: "tcp://127.0.0.1:1883", NodeID: "tv"}, l, p, nil, nil)
+}
+
+func TestMQTTHandleCommand(t *testing.T) {
+	initial := defaultLightState()
+	for _, tc := range []struct {
+		name    string
+		payload string
+		want    func(s *LightState)
+		err     string
+	}{
+		{
+			name:    "off",
+			payload: `{"state":"OFF"}`,
+			want:    func(s *LightState) { s.On = false },
+		},
+		{
+			name:    "brightness keeps state",
+			payload: `{"brightness":128}`,
+			want:    func(s *LightState) { s.Brightness = 128 },
+		},
+		{
+			name:    "color switches to static",
+			payload: `{"state":"ON","color":{"r":255,"g":10,"b":0}}`,
+			want: func(s *LightState) {
+				s.Color = color.RGBA{255, 10, 0, 255}
+				s.Effect = EffectStatic
+			},
+		},
+		{
+			name:    "effect",
+			payload: `{"effect":"rainbow","transition":0.5}`,
+			want:    func(s *LightState) { s.Effect = "rainbow" },
+		},
+		{
+			name:    "empty command",
+			payload: `{}`,
+			want:    func(s *LightState) {},
+		},
+		{name: "unknown state", payload: `{"state":"TOGGLE"}`, err: `unknown state "TOGGLE"`},
+		{name: "unknown effect", payload: `{"effect":"fire"}`, err: "fire"},
+		{name: "invalid json", payload: `ON`, err: "invalid mqtt command"},
+		{name: "brightness out of range", payload: `{"brightness":300}`, err: "invalid mqtt command"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBridge()
+			err := b.handleCommand([]byte(tc.payload))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error is %v, want %q", err, tc.err)
+				}
+				if s := b.light.State(); !reflect.DeepEqual(s, initial) {
+					t.Errorf("rejected command changed state to %+v", s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := initial
+			tc.want(&want)
+			if s := b.light.State(); !reflect.DeepEqual(s, want) {
+				t.Errorf("state is %+v, want %+v", s, want)
+			}
+		})
+	}
+}
+
+func TestMQTTCommandTransition(t *testing.T) {
+	b := newTestBridge()
+	b.light.Transition = time.Minute
+	if err := b.handleCommand([]byte(`{"state":"OFF","transition":0.25}`)); err != nil {
+		t.Fatal(err)
+	}
+	active := b.pipeline.Active()
+	fade, ok := active.Source.(*Crossfade)
+	if !ok || active.Priority != PriorityOff {
+		t.Fatalf("active source is %+v, want crossfade to off", active)
+	}
+	if fade.Duration != 250*time.Millisecond {
+		t.Errorf("fade takes %s, want 250ms", fade.Duration)
+	}
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	prev := currentConfig()
+	defer setConfig(prev)
+	setConfig(&Config{Profiles: map[string]json.RawMessage{"night": json.RawMessage(`{}`)}})
+	b := newTestBridge()
+	b.conf.DiscoveryPrefix = "ha"
+	b.conf.BaseTopic = "home/ambilight"
+	configs := b.discoveryConfigs()
+	var topics []string
+	for topic := range configs {
+		topics = append(topics, topic)
+	}
+	wantTopics := []string{
+		"ha/light/tv/light/config",
+		"ha/select/tv/profile/config",
+		"ha/sensor/tv/fps/config",
+		"ha/sensor/tv/latency/config",
+	}
+	for _, topic := range wantTopics {
+		if configs[topic] == nil {
+			t.Errorf("missing %s, got %v", topic, topics)
+		}
+	}
+	if len(configs) != len(wantTopics) {
+		t.Errorf("got topics %v, want %v", topics, wantTopics)
+	}
+	// payloads are compared as published
+	decode := func(topic string) map[string]interface{} {
+		b, err := json.Marshal(configs[topic])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	light := decode("ha/light/tv/light/config")
+	for key, want := range map[string]interface{}{
+		"unique_id":             "tv_light",
+		"schema":                "json",
+		"state_topic":           "home/ambilight/tv/light/state",
+		"command_topic":         "home/ambilight/tv/light/set",
+		"availability_topic":    "home/ambilight/tv/availability",
+		"brightness":            true,
+		"supported_color_modes": []interface{}{"rgb"},
+		"effect_list":           []interface{}{"ambilight", "breathing", "candle", "gradient", "rainbow", "static"},
+	} {
+		if !reflect.DeepEqual(light[key], want) {
+			t.Errorf("light %s is %v, want %v", key, light[key], want)
+		}
+	}
+	profile := decode("ha/select/tv/profile/config")
+	if !reflect.DeepEqual(profile["options"], []interface{}{"default", "night"}) {
+		t.Errorf("profile options are %v", profile["options"])
+	}
+	if profile["command_topic"] != "home/ambilight/tv/profile/set" {
+		t.Errorf("profile command topic is %v", profile["command_topic"])
+	}
+	latency := decode("ha/sensor/tv/latency/config")
+	if latency["unit_of_measurement"] != "ms" || latency["device_class"] != "duration" {
+		t.Errorf("latency sensor is %v", latency)
+	}
+	device := light["device"].(map[string]interface{})
+	if !reflect.DeepEqual(device["identifiers"], []interface{}{"rpi-cam-ambilight-tv"}) {
+		t.Errorf("device identifiers are %v", device["identifiers"])
+	}
+}
+
+func TestMQTTBridgePublishesOnConnect(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+	a, cleanup := newTestApp(t)
+	defer cleanup()
+	connectTestBridge(t, broker, a)
+	defer a.stopMQTT()
+	for _, topic := range []string{
+		"homeassistant/light/tv/light/config",
+		"homeassistant/select/tv/profile/config",
+		"homeassistant/sensor/tv/fps/config",
+		"homeassistant/sensor/tv/latency/config",
+	} {
+		if _, ok := broker.Retained(topic); !ok {
+			t.Errorf("discovery %s isn't retained", topic)
+		}
+	}
+	waitFor(t, "profile", func() bool {
+		_, ok := broker.Retained("rpi-cam-ambilight/tv/profile/state")
+		return ok
+	})
+	state, _ := broker.Retained("rpi-cam-ambilight/tv/light/state")
+	if want := `{"state":"ON","brightness":255,"color_mode":"rgb","color":{"r":255,"g":255,"b":255},"effect":"ambilight"}`; state != want {
+		t.Errorf("state is %s, want %s", state, want)
+	}
+	if profile, _ := broker.Retained("rpi-cam-ambilight/tv/profile/state"); profile != DefaultProfile {
+		t.Errorf("profile is %s, want %s", profile, DefaultProfile)
+	}
+}
+
+func TestMQTTBridgeLightCommand(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+	a, cleanup := newTestApp(t)
+	defer cleanup()
+	connectTestBridge(t, broker, a)
+	defer a.stopMQTT()
+	broker.Publish("rpi-cam-ambilight/tv/light/set", `{"state":"OFF"}`)
+	waitFor(t, "light off", func() bool {
+		return !a.light.State().On
+	})
+	waitFor(t, "state of light off", func() bool {
+		state, _ := broker.Retained("rpi-cam-ambilight/tv/light/state")
+		return strings.Contains(state, `"state":"OFF"`)
+	})
+}
+
+func TestMQTTBridgeProfileCommand(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+	a, cleanup := newTestApp(t)
+	defer cleanup()
+	connectTestBridge(t, broker, a)
+	defer a.stopMQTT()
+	broker.Publish("rpi-cam-ambilight/tv/profile/set", "night")
+	// the config is written after the switch is applied
+	waitFor(t, "stored night profile", func() bool {
+		stored, err := loadConfig(currentConfig().dir)
+		return err == nil && stored.Profile == "night"
+	})
+	if s := a.Active().Smoothing; s != 0.5 {
+		t.Errorf("smoothing of the active config is %g, want 0.5", s)
+	}
+	waitFor(t, "state of night profile", func() bool {
+		profile, _ := broker.Retained("rpi-cam-ambilight/tv/profile/state")
+		return profile == "night"
+	})
+}
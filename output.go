@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stianeikeland/go-rpio"
+	"image/color"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LedDriver is a device which displays colors on the leds.
+type LedDriver interface {
+	// Len returns amount of leds driven by the device.
+	Len() int
+	// Write displays colors, first color belongs to the first led of the device.
+	Write(colors []color.RGBA) error
+	Close() error
+}
+
+// OutputConfig describes a single led device and part of the layout it displays.
+type OutputConfig struct {
+	Name    string         `json:"name"`
+	Driver  string         `json:"driver"`
+	SPI     *SPIConfig     `json:"spi,omitempty"`
+	Serial  *SerialConfig  `json:"serial,omitempty"`
+	Network *NetworkConfig `json:"network,omitempty"`
+	WLED    *WLEDConfig    `json:"wled,omitempty"`
+	Range   *LedRange      `json:"range,omitempty"`
+	Color   ColorSettings  `json:"color"`
+	// Power limits current drawn by the device, no limit is applied when empty.
+	Power *PowerConfig `json:"power,omitempty"`
+}
+
+// SPIConfig describes SPI transport of the device.
+type SPIConfig struct {
+	Device     int `json:"device"`
+	ChipSelect int `json:"chipSelect"`
+	Speed      int `json:"speed,omitempty"`
+}
+
+// LedRange selects leds of the layout displayed by an output. Both ends are inclusive,
+// when From is greater than To, the leds are displayed in reversed order.
+type LedRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// ColorSettings adjust colors for a specific device.
+type ColorSettings struct {
+	// Order of color channels expected by the device, e.g. "rgb" or "rbg".
+	Order string `json:"order,omitempty"`
+	// Brightness scales all channels, 0-1. Zero value means full brightness.
+	Brightness float64 `json:"brightness,omitempty"`
+	// Gamma correction applied to each channel. Zero value disables the correction.
+	Gamma float64 `json:"gamma,omitempty"`
+}
+
+// Len returns amount of leds within the range.
+func (r LedRange) Len() int {
+	if r.From > r.To {
+		return r.From - r.To + 1
+	}
+	return r.To - r.From + 1
+}
+
+// Index returns index of the layout led displayed by i-th led of the range.
+func (r LedRange) Index(i int) int {
+	if r.From > r.To {
+		return r.From - i
+	}
+	return r.From + i
+}
+
+// defaultOutputs returns single WS2801 strip on the first SPI chip select covering whole layout.
+func defaultOutputs(count int) []*OutputConfig {
+	return []*OutputConfig{{
+		Name:   "default",
+		Driver: "ws2801",
+		SPI:    &SPIConfig{},
+		Range:  &LedRange{0, count - 1},
+	}}
+}
+
+// Validate checks whether output can be created for layout with given amount of leds.
+func (c *OutputConfig) Validate(count int) error {
+	if c.Range != nil {
+		if c.Range.From < 0 || c.Range.To < 0 || c.Range.From >= count || c.Range.To >= count {
+			return fmt.Errorf("output %q: range %d-%d is out of layout (0-%d)", c.Name, c.Range.From, c.Range.To, count-1)
+		}
+	}
+	if err := c.Color.Validate(); err != nil {
+		return fmt.Errorf("output %q: %s", c.Name, err)
+	}
+	if c.Power != nil {
+		if err := c.Power.Validate(c.ledRange(count).Len()); err != nil {
+			return fmt.Errorf("output %q: %s", c.Name, err)
+		}
+	}
+	switch c.Driver {
+	case "ws2801":
+		if c.SPI == nil {
+			return fmt.Errorf("output %q: spi settings are required for ws2801 driver", c.Name)
+		}
+		if c.SPI.ChipSelect < 0 || c.SPI.ChipSelect > 1 {
+			return fmt.Errorf("output %q: invalid spi chip select %d", c.Name, c.SPI.ChipSelect)
+		}
+	case "adalight":
+		if c.Serial == nil || c.Serial.Device == "" {
+			return fmt.Errorf("output %q: serial device is required for adalight driver", c.Name)
+		}
+		if c.Serial.Baud < 0 {
+			return fmt.Errorf("output %q: invalid baud rate %d", c.Name, c.Serial.Baud)
+		}
+	case "e131", "artnet":
+		if c.Network == nil {
+			return fmt.Errorf("output %q: network settings are required for %s driver", c.Name, c.Driver)
+		}
+		if err := c.Network.Validate(c.Driver); err != nil {
+			return fmt.Errorf("output %q: %s", c.Name, err)
+		}
+	case "wled":
+		if c.WLED == nil {
+			return fmt.Errorf("output %q: wled settings are required for wled driver", c.Name)
+		}
+		if err := c.WLED.Validate(c.ledRange(count).Len()); err != nil {
+			return fmt.Errorf("output %q: %s", c.Name, err)
+		}
+	default:
+		return fmt.Errorf("output %q: unknown driver %q", c.Name, c.Driver)
+	}
+	return nil
+}
+
+func (c *OutputConfig) ledRange(count int) LedRange {
+	if c.Range != nil {
+		return *c.Range
+	}
+	return LedRange{0, count - 1}
+}
+
+// Validate checks whether color settings are in allowed range.
+func (s ColorSettings) Validate() error {
+	if s.Order != "" {
+		if len(s.Order) != 3 || !strings.ContainsRune(s.Order, 'r') || !strings.ContainsRune(s.Order, 'g') || !strings.ContainsRune(s.Order, 'b') {
+			return fmt.Errorf("invalid color order %q", s.Order)
+		}
+	}
+	if s.Brightness < 0 || s.Brightness > 1 {
+		return fmt.Errorf("brightness must be within 0-1 range")
+	}
+	if s.Gamma < 0 {
+		return fmt.Errorf("gamma can't be negative")
+	}
+	return nil
+}
+
+// colorTable precomputes brightness and gamma correction for each channel value.
+func (s ColorSettings) colorTable() [256]uint8 {
+	var t [256]uint8
+	brightness := s.Brightness
+	if brightness == 0 {
+		brightness = 1
+	}
+	for i := range t {
+		v := float64(i) / 255
+		if s.Gamma > 0 {
+			v = math.Pow(v, s.Gamma)
+		}
+		t[i] = uint8(math.Round(v * brightness * 255))
+	}
+	return t
+}
+
+// Output displays part of the layout on a single device.
+type Output struct {
+	Name   string
+	mu     sync.Mutex
+	driver LedDriver
+	rng    LedRange
+	order  [3]int
+	table  [256]uint8
+	buf    []color.RGBA
+	// Limiter is nil when power limiting is disabled.
+	Limiter *PowerLimiter
+}
+
+func NewOutput(c *OutputConfig, count int) (*Output, error) {
+	if err := c.Validate(count); err != nil {
+		return nil, err
+	}
+	rng := c.ledRange(count)
+	order := c.Color.Order
+	var driver LedDriver
+	var err error
+	switch c.Driver {
+	case "ws2801":
+		// strips used so far are wired in rbg order
+		if order == "" {
+			order = "rbg"
+		}
+		driver, err = NewWS2801Led(rpio.SpiDev(c.SPI.Device), uint8(c.SPI.ChipSelect), c.SPI.Speed, rng.Len())
+	case "adalight":
+		driver, err = OpenAdalightLed(c.Serial, rng.Len())
+	case "e131":
+		driver, err = NewE131Led(c.Network, rng.Len())
+	case "artnet":
+		driver, err = NewArtNetLed(c.Network, rng.Len())
+	case "wled":
+		driver, err = NewWLEDLed(c.WLED, rng.Len())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("output %q: %s", c.Name, err)
+	}
+	if order == "" {
+		order = "rgb"
+	}
+	out := &Output{
+		Name:   c.Name,
+		driver: driver,
+		rng:    rng,
+		table:  c.Color.colorTable(),
+		buf:    make([]color.RGBA, rng.Len()),
+	}
+	for i, ch := range order {
+		out.order[i] = strings.IndexRune("rgb", ch)
+	}
+	if c.Power != nil {
+		out.Limiter = NewPowerLimiter(*c.Power)
+	}
+	return out, nil
+}
+
+// Write displays colors of the whole layout, picking only leds within the output range.
+func (o *Output) Write(colors []color.RGBA) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range o.buf {
+		c := colors[o.rng.Index(i)]
+		ch := [3]uint8{o.table[c.R], o.table[c.G], o.table[c.B]}
+		o.buf[i] = color.RGBA{ch[o.order[0]], ch[o.order[1]], ch[o.order[2]], 255}
+	}
+	if o.Limiter != nil {
+		o.Limiter.Limit(o.buf)
+	}
+	return o.driver.Write(o.buf)
+}
+
+func (o *Output) Close() error {
+	return o.driver.Close()
+}
+
+// Outputs fans colors out to all configured devices.
+type Outputs []*Output
+
+// OpenOutputs creates devices for all configs. Already opened devices are closed on failure.
+func OpenOutputs(configs []*OutputConfig, count int) (Outputs, error) {
+	outputs := make(Outputs, 0, len(configs))
+	for _, c := range configs {
+		out, err := NewOutput(c, count)
+		if err != nil {
+			outputs.Close()
+			return nil, err
+		}
+		outputs = append(outputs, out)
+	}
+	return outputs, nil
+}
+
+// Write displays colors on all devices concurrently.
+func (outputs Outputs) Write(colors []color.RGBA) error {
+	errs := make([]error, len(outputs))
+	var wg sync.WaitGroup
+	for i, out := range outputs {
+		wg.Add(1)
+		go func(i int, out *Output) {
+			defer wg.Done()
+			if err := out.Write(colors); err != nil {
+				errs[i] = fmt.Errorf("output %q: %s", out.Name, err)
+			}
+		}(i, out)
+	}
+	wg.Wait()
+	return joinErrors(errs)
+}
+
+// Blank turns all leds off.
+func (outputs Outputs) Blank(count int) error {
+	return outputs.Write(make([]color.RGBA, count))
+}
+
+// FadeOut gradually dims colors until all leds are off. Leds are blanked
+// immediately when the context is done before the fade finishes.
+func (outputs Outputs) FadeOut(ctx context.Context, colors []color.RGBA, d time.Duration) error {
+	const step = 20 * time.Millisecond
+	steps := int(d / step)
+	dimmed := make([]color.RGBA, len(colors))
+	for i := steps - 1; i > 0; i-- {
+		scale := float64(i) / float64(steps)
+		for j, c := range colors {
+			dimmed[j] = color.RGBA{uint8(float64(c.R) * scale), uint8(float64(c.G) * scale), uint8(float64(c.B) * scale), c.A}
+		}
+		if err := outputs.Write(dimmed); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return outputs.Blank(len(colors))
+		case <-time.After(step):
+		}
+	}
+	return outputs.Blank(len(colors))
+}
+
+// reportPowerLimits logs how often power limiting was applied since the previous report.
+func (outputs Outputs) reportPowerLimits(last map[string][2]uint64) {
+	for _, out := range outputs {
+		if out.Limiter == nil {
+			continue
+		}
+		frames, limited := out.Limiter.Stats()
+		prev := last[out.Name]
+		last[out.Name] = [2]uint64{frames, limited}
+		if limited > prev[1] {
+			ledLog.Info("power limit applied", "output", out.Name, "limited", limited-prev[1], "frames", frames-prev[0])
+		}
+	}
+}
+
+func (outputs Outputs) Close() error {
+	errs := make([]error, len(outputs))
+	for i, out := range outputs {
+		errs[i] = out.Close()
+	}
+	return joinErrors(errs)
+}
+
+// joinErrors combines non-nil errors into a single one.
+func joinErrors(errs []error) error {
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
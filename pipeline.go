@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Priorities of the built-in sources. Lower number wins. Built-in sources are internal, so external
+// clients using the same priority can neither replace nor clear them and internal one wins the tie.
+const (
+	PriorityCamera = 240
+	PriorityLowest = 255
+)
+
+// animationInterval is time between frames rendered for sources which change over time.
+const animationInterval = 20 * time.Millisecond
+
+// keepAliveInterval is maximum time between two writes, some devices turn off without new data.
+const keepAliveInterval = time.Second
+
+// Source renders colors of all leds in the layout order.
+type Source interface {
+	Render(now time.Time, colors []color.RGBA)
+}
+
+// AnimatedSource changes over time, so it's rendered continuously.
+type AnimatedSource interface {
+	Source
+	Animated() bool
+}
+
+// SourceInfo describes registered source.
+type SourceInfo struct {
+	Priority int
+	// Internal sources are owned by the application, external ones by clients like Hyperion remotes.
+	Internal bool
+	Origin   string
+	// Expires is zero when the source doesn't expire.
+	Expires time.Time
+	Source  Source
+}
+
+// Pipeline picks the source with the highest priority, adjusts its colors
+// and writes them to the outputs.
+type Pipeline struct {
+	// writeMu serializes writes with replacing the outputs.
+	writeMu    sync.Mutex
+	mu         sync.Mutex
+	count      int
+	outputs    Outputs
+	sources    map[sourceKey]*SourceInfo
+	adjustment Adjustment
+	table      [3][256]uint8
+	last       []color.RGBA
+	raw        []color.RGBA
+	update     chan struct{}
+	stats      PipelineStats
+	captured   time.Time
+	// OnWrite is called after colors are successfully written to the outputs.
+	OnWrite func()
+}
+
+// PipelineStats are smoothed measurements of the output loop.
+type PipelineStats struct {
+	// FPS is a rate of frames written to the outputs.
+	FPS float64
+	// Latency is time from capturing camera frame until its colors are written to the outputs.
+	Latency time.Duration
+	written time.Time
+}
+
+// sourceKey separates internal and external sources with the same priority.
+type sourceKey struct {
+	priority int
+	internal bool
+}
+
+func (s *SourceInfo) key() sourceKey {
+	return sourceKey{s.Priority, s.Internal}
+}
+
+// before reports whether the source wins over the other one.
+func (s *SourceInfo) before(o *SourceInfo) bool {
+	if s.Priority != o.Priority {
+		return s.Priority < o.Priority
+	}
+	return s.Internal && !o.Internal
+}
+
+// capturedSource knows when its content was captured.
+type capturedSource interface {
+	Captured() time.Time
+}
+
+// smoothing factor of exponentially weighted moving averages in stats
+const statsSmoothing = 0.1
+
+func NewPipeline(count int, outputs Outputs) *Pipeline {
+	p := &Pipeline{
+		count:   count,
+		outputs: outputs,
+		sources: make(map[sourceKey]*SourceInfo),
+		last:    make([]color.RGBA, count),
+		raw:     make([]color.RGBA, count),
+		update:  make(chan struct{}, 1),
+	}
+	p.SetAdjustment(DefaultAdjustment())
+	return p
+}
+
+// Count returns amount of leds rendered by the pipeline.
+func (p *Pipeline) Count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count
+}
+
+// Outputs returns devices the colors are written to.
+func (p *Pipeline) Outputs() Outputs {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.outputs
+}
+
+// ReplaceOutputs changes amount of leds and devices while running, sources render the new
+// amount from the next frame. Returns the previous devices, which are no longer written to.
+func (p *Pipeline) ReplaceOutputs(count int, outputs Outputs) Outputs {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.mu.Lock()
+	prev := p.outputs
+	p.count = count
+	p.outputs = outputs
+	p.last = make([]color.RGBA, count)
+	p.raw = make([]color.RGBA, count)
+	p.mu.Unlock()
+	p.Invalidate()
+	return prev
+}
+
+// SetSource registers internal source with the given priority, replacing the previous one.
+// Zero duration means the source stays until it's cleared.
+func (p *Pipeline) SetSource(priority int, origin string, src Source, duration time.Duration) {
+	p.set(&SourceInfo{Priority: priority, Internal: true, Origin: origin, Source: src}, duration)
+}
+
+// SetExternalSource registers source of an external client, replacing the previous one
+// of the same priority. Internal sources are never replaced.
+func (p *Pipeline) SetExternalSource(priority int, origin string, src Source, duration time.Duration) {
+	p.set(&SourceInfo{Priority: priority, Origin: origin, Source: src}, duration)
+}
+
+func (p *Pipeline) set(info *SourceInfo, duration time.Duration) {
+	if duration > 0 {
+		info.Expires = time.Now().Add(duration)
+	}
+	p.mu.Lock()
+	p.sources[info.key()] = info
+	p.mu.Unlock()
+	p.Invalidate()
+}
+
+// Fade replaces internal source with the given priority, crossfading from currently shown colors.
+// Nil source fades into the source with lower priority and the given one is removed once the fade is done.
+func (p *Pipeline) Fade(priority int, origin string, src Source, d time.Duration) {
+	if d <= 0 {
+		if src == nil {
+			p.Clear(priority)
+		} else {
+			p.SetSource(priority, origin, src, 0)
+		}
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	from := &ImageSource{colors: append([]color.RGBA(nil), p.raw...)}
+	expires := time.Duration(0)
+	if src == nil {
+		expires = d
+		src = &ColorSource{color.RGBA{A: 255}}
+		p.expire(now)
+		faded := &SourceInfo{Priority: priority, Internal: true}
+		var below *SourceInfo
+		for _, s := range p.sources {
+			if faded.before(s) && (below == nil || s.before(below)) {
+				below = s
+			}
+		}
+		if below != nil {
+			src = below.Source
+		}
+	}
+	p.mu.Unlock()
+	p.SetSource(priority, origin, &Crossfade{From: from, To: src, Start: now, Duration: d}, expires)
+}
+
+// Clear removes internal source with the given priority.
+func (p *Pipeline) Clear(priority int) {
+	p.clear(sourceKey{priority, true})
+}
+
+// ClearExternal removes source of an external client with the given priority.
+func (p *Pipeline) ClearExternal(priority int) {
+	p.clear(sourceKey{priority, false})
+}
+
+func (p *Pipeline) clear(key sourceKey) {
+	p.mu.Lock()
+	delete(p.sources, key)
+	p.mu.Unlock()
+	p.Invalidate()
+}
+
+// ClearAll removes sources of all external clients, internal ones are kept.
+func (p *Pipeline) ClearAll() {
+	p.mu.Lock()
+	for key := range p.sources {
+		if !key.internal {
+			delete(p.sources, key)
+		}
+	}
+	p.mu.Unlock()
+	p.Invalidate()
+}
+
+// Sources returns registered sources ordered by priority.
+func (p *Pipeline) Sources() []SourceInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(time.Now())
+	sources := make([]SourceInfo, 0, len(p.sources))
+	for _, s := range p.sources {
+		sources = append(sources, *s)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].before(&sources[j]) })
+	return sources
+}
+
+// Active returns source with the highest priority or nil when there is none.
+func (p *Pipeline) Active() *SourceInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active(time.Now())
+}
+
+func (p *Pipeline) expire(now time.Time) {
+	for key, s := range p.sources {
+		if !s.Expires.IsZero() && now.After(s.Expires) {
+			delete(p.sources, key)
+		}
+	}
+}
+
+func (p *Pipeline) active(now time.Time) *SourceInfo {
+	p.expire(now)
+	var active *SourceInfo
+	for _, s := range p.sources {
+		if active == nil || s.before(active) {
+			active = s
+		}
+	}
+	return active
+}
+
+// Invalidate requests colors to be rendered and written again, e.g. when a source has new content.
+func (p *Pipeline) Invalidate() {
+	select {
+	case p.update <- struct{}{}:
+	default:
+	}
+}
+
+// SetAdjustment changes color adjustment applied to all sources.
+func (p *Pipeline) SetAdjustment(a Adjustment) {
+	p.mu.Lock()
+	p.adjustment = a
+	p.table = a.tables()
+	p.mu.Unlock()
+	p.Invalidate()
+}
+
+func (p *Pipeline) Adjustment() Adjustment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.adjustment
+}
+
+// Last returns copy of colors written to the outputs most recently.
+func (p *Pipeline) Last() []color.RGBA {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]color.RGBA(nil), p.last...)
+}
+
+// render returns adjusted colors of the active source and whether it should be rendered continuously.
+func (p *Pipeline) render(now time.Time, colors []color.RGBA) (animated bool) {
+	p.mu.Lock()
+	active := p.active(now)
+	table := p.table
+	var expires time.Time
+	for _, s := range p.sources {
+		if !s.Expires.IsZero() && (expires.IsZero() || s.Expires.Before(expires)) {
+			expires = s.Expires
+		}
+	}
+	p.mu.Unlock()
+	if active == nil {
+		for i := range colors {
+			colors[i] = color.RGBA{A: 255}
+		}
+	} else {
+		active.Source.Render(now, colors)
+		if a, ok := active.Source.(AnimatedSource); ok {
+			animated = a.Animated()
+		}
+	}
+	p.mu.Lock()
+	copy(p.raw, colors)
+	p.mu.Unlock()
+	for i, c := range colors {
+		colors[i] = color.RGBA{table[0][c.R], table[1][c.G], table[2][c.B], 255}
+	}
+	// keep rendering until the next source expires, so it's removed in time
+	return animated || !expires.IsZero()
+}
+
+// Run renders and writes colors whenever they change until the context is done.
+func (p *Pipeline) Run(ctx context.Context) {
+	var colors []color.RGBA
+	ticker := time.NewTicker(animationInterval)
+	defer ticker.Stop()
+	animated := false
+	var written time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.update:
+		case now := <-ticker.C:
+			if !animated && now.Sub(written) < keepAliveInterval {
+				continue
+			}
+		}
+		p.writeMu.Lock()
+		p.mu.Lock()
+		outputs := p.outputs
+		if len(colors) != p.count {
+			colors = make([]color.RGBA, p.count)
+		}
+		p.mu.Unlock()
+		animated = p.render(time.Now(), colors)
+		start := time.Now()
+		err := outputs.Write(colors)
+		p.writeMu.Unlock()
+		metrics.LedWritten(time.Since(start), err)
+		if err != nil {
+			ledLog.Error("writing leds failed", "err", err)
+			continue
+		}
+		written = time.Now()
+		p.mu.Lock()
+		copy(p.last, colors)
+		p.updateStats(written)
+		p.mu.Unlock()
+		if p.OnWrite != nil {
+			p.OnWrite()
+		}
+	}
+}
+
+func (p *Pipeline) updateStats(now time.Time) {
+	s := &p.stats
+	if !s.written.IsZero() {
+		if dt := now.Sub(s.written).Seconds(); dt > 0 {
+			if s.FPS == 0 {
+				s.FPS = 1 / dt
+			} else {
+				s.FPS += statsSmoothing * (1/dt - s.FPS)
+			}
+		}
+	}
+	s.written = now
+	active := p.active(now)
+	if active == nil {
+		return
+	}
+	if src, ok := active.Source.(capturedSource); ok {
+		// the same frame may be written again, e.g. to keep the device alive
+		if captured := src.Captured(); !captured.IsZero() && captured != p.captured {
+			p.captured = captured
+			latency := now.Sub(captured)
+			if s.Latency == 0 {
+				s.Latency = latency
+			} else {
+				s.Latency += time.Duration(statsSmoothing * float64(latency-s.Latency))
+			}
+		}
+	}
+}
+
+// Stats returns measurements of the output loop.
+func (p *Pipeline) Stats() PipelineStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Adjustment corrects colors of all sources before they are written to the outputs.
+type Adjustment struct {
+	// Brightness of all channels, 0-1.
+	Brightness float64 `json:"brightness"`
+	// Gamma correction of red, green and blue channel. One leaves the channel intact.
+	Gamma [3]float64 `json:"gamma"`
+	// Gain of red, green and blue channel, 0-1.
+	Gain [3]float64 `json:"gain"`
+}
+
+func DefaultAdjustment() Adjustment {
+	return Adjustment{Brightness: 1, Gamma: [3]float64{1, 1, 1}, Gain: [3]float64{1, 1, 1}}
+}
+
+func (a Adjustment) tables() [3][256]uint8 {
+	var t [3][256]uint8
+	for ch := range t {
+		for i := range t[ch] {
+			v := float64(i) / 255
+			if a.Gamma[ch] > 0 {
+				v = math.Pow(v, a.Gamma[ch])
+			}
+			t[ch][i] = uint8(math.Round(math.Min(v*a.Gain[ch]*a.Brightness, 1) * 255))
+		}
+	}
+	return t
+}
+
+// ColorSource shows single color on all leds.
+type ColorSource struct {
+	Color color.RGBA
+}
+
+func (s *ColorSource) Render(now time.Time, colors []color.RGBA) {
+	for i := range colors {
+		colors[i] = s.Color
+	}
+}
+
+// FrameSource shows colors computed elsewhere, e.g. by the camera analysis.
+type FrameSource struct {
+	mu       sync.Mutex
+	colors   []color.RGBA
+	captured time.Time
+	rendered bool
+}
+
+func NewFrameSource(count int) *FrameSource {
+	return &FrameSource{colors: make([]color.RGBA, count)}
+}
+
+// Update replaces shown colors with the ones captured at the given time and reports
+// whether the previous colors were replaced without being rendered.
+func (s *FrameSource) Update(colors []color.RGBA, captured time.Time) (dropped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped = !s.captured.IsZero() && !s.rendered
+	// amount of leds changes with the layout
+	if len(s.colors) != len(colors) {
+		s.colors = make([]color.RGBA, len(colors))
+	}
+	copy(s.colors, colors)
+	s.captured = captured
+	s.rendered = false
+	return dropped
+}
+
+func (s *FrameSource) Captured() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.captured
+}
+
+func (s *FrameSource) Render(now time.Time, colors []color.RGBA) {
+	s.mu.Lock()
+	copy(colors, s.colors)
+	s.rendered = true
+	s.mu.Unlock()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"sync/atomic"
+)
+
+// PowerConfig describes current drawn by the strip and capacity of its power supply.
+type PowerConfig struct {
+	// MilliampsPerChannel is a current drawn by a single color channel at full value.
+	MilliampsPerChannel float64 `json:"milliampsPerChannel"`
+	// IdleMilliamps is a current drawn by a single led when it's off.
+	IdleMilliamps float64 `json:"idleMilliamps,omitempty"`
+	// BudgetMilliamps is a maximum current the supply can deliver to the strip.
+	BudgetMilliamps float64 `json:"budgetMilliamps"`
+}
+
+// Validate checks the settings for a strip with given amount of leds. Budget must cover
+// the idle current of all leds, otherwise every frame would be scaled to black.
+func (c *PowerConfig) Validate(leds int) error {
+	if c.MilliampsPerChannel <= 0 {
+		return fmt.Errorf("milliamps per channel must be greater than zero")
+	}
+	if c.IdleMilliamps < 0 {
+		return fmt.Errorf("idle milliamps can't be negative")
+	}
+	if c.BudgetMilliamps <= 0 {
+		return fmt.Errorf("power budget must be greater than zero")
+	}
+	if idle := c.IdleMilliamps * float64(leds); idle >= c.BudgetMilliamps {
+		return fmt.Errorf("power budget %gmA doesn't cover %gmA drawn by %d idle leds", c.BudgetMilliamps, idle, leds)
+	}
+	return nil
+}
+
+// PowerLimiter scales frames down, when their estimated current draw exceeds the budget.
+type PowerLimiter struct {
+	conf    PowerConfig
+	frames  uint64
+	limited uint64
+}
+
+func NewPowerLimiter(c PowerConfig) *PowerLimiter {
+	return &PowerLimiter{conf: c}
+}
+
+// Current returns estimated current draw of the frame in milliamps.
+func (p *PowerLimiter) Current(colors []color.RGBA) float64 {
+	return p.conf.IdleMilliamps*float64(len(colors)) + p.channelCurrent(colors)
+}
+
+func (p *PowerLimiter) channelCurrent(colors []color.RGBA) float64 {
+	var sum int
+	for _, c := range colors {
+		sum += int(c.R) + int(c.G) + int(c.B)
+	}
+	return float64(sum) / 255 * p.conf.MilliampsPerChannel
+}
+
+// Limit scales all colors of the frame proportionally to fit into the budget
+// and returns applied scale, 1 means the frame was left intact.
+func (p *PowerLimiter) Limit(colors []color.RGBA) float64 {
+	atomic.AddUint64(&p.frames, 1)
+	available := p.conf.BudgetMilliamps - p.conf.IdleMilliamps*float64(len(colors))
+	required := p.channelCurrent(colors)
+	if required <= available {
+		return 1
+	}
+	atomic.AddUint64(&p.limited, 1)
+	scale := 0.0
+	if available > 0 {
+		scale = available / required
+	}
+	for i, c := range colors {
+		colors[i] = color.RGBA{
+			R: uint8(float64(c.R) * scale),
+			G: uint8(float64(c.G) * scale),
+			B: uint8(float64(c.B) * scale),
+			A: c.A,
+		}
+	}
+	return scale
+}
+
+// Stats returns amount of processed frames and amount of frames which had to be limited.
+func (p *PowerLimiter) Stats() (frames, limited uint64) {
+	return atomic.LoadUint64(&p.frames), atomic.LoadUint64(&p.limited)
+}
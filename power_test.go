@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image/color"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPowerLimiterLimit(t *testing.T) {
+	white := color.RGBA{255, 255, 255, 255}
+	for _, tc := range []struct {
+		name   string
+		conf   PowerConfig
+		colors []color.RGBA
+		scale  float64
+		want   []color.RGBA
+	}{
+		{
+			name:   "within budget",
+			conf:   PowerConfig{MilliampsPerChannel: 20, BudgetMilliamps: 120},
+			colors: []color.RGBA{white, {0, 0, 0, 255}},
+			scale:  1,
+			want:   []color.RGBA{white, {0, 0, 0, 255}},
+		},
+		{
+			name:   "exactly budget",
+			conf:   PowerConfig{MilliampsPerChannel: 20, BudgetMilliamps: 60},
+			colors: []color.RGBA{white},
+			scale:  1,
+			want:   []color.RGBA{white},
+		},
+		{
+			name:   "scaled to half",
+			conf:   PowerConfig{MilliampsPerChannel: 20, BudgetMilliamps: 60},
+			colors: []color.RGBA{white, white},
+			scale:  0.5,
+			want:   []color.RGBA{{127, 127, 127, 255}, {127, 127, 127, 255}},
+		},
+		{
+			name:   "idle current reduces budget",
+			conf:   PowerConfig{MilliampsPerChannel: 20, IdleMilliamps: 10, BudgetMilliamps: 40},
+			colors: []color.RGBA{white, {0, 0, 0, 255}},
+			scale:  1. / 3,
+			want:   []color.RGBA{{85, 85, 85, 255}, {0, 0, 0, 255}},
+		},
+		{
+			name:   "alpha kept",
+			conf:   PowerConfig{MilliampsPerChannel: 10, BudgetMilliamps: 10},
+			colors: []color.RGBA{{255, 0, 255, 128}},
+			scale:  0.5,
+			want:   []color.RGBA{{127, 0, 127, 128}},
+		},
+		{
+			name:   "idle floor over budget",
+			conf:   PowerConfig{MilliampsPerChannel: 20, IdleMilliamps: 50, BudgetMilliamps: 100},
+			colors: []color.RGBA{white, white},
+			scale:  0,
+			want:   []color.RGBA{{0, 0, 0, 255}, {0, 0, 0, 255}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewPowerLimiter(tc.conf)
+			if scale := p.Limit(tc.colors); scale != tc.scale {
+				t.Errorf("scale is %g, want %g", scale, tc.scale)
+			}
+			if !reflect.DeepEqual(tc.colors, tc.want) {
+				t.Errorf("colors are %v, want %v", tc.colors, tc.want)
+			}
+			limited := uint64(0)
+			if tc.scale < 1 {
+				limited = 1
+			}
+			if frames, l := p.Stats(); frames != 1 || l != limited {
+				t.Errorf("stats are %d frames, %d limited, want 1, %d", frames, l, limited)
+			}
+		})
+	}
+}
+
+func TestPowerLimiterCurrent(t *testing.T) {
+	p := NewPowerLimiter(PowerConfig{MilliampsPerChannel: 20, IdleMilliamps: 1, BudgetMilliamps: 1000})
+	if got := p.Current([]color.RGBA{{255, 0, 0, 255}, {255, 255, 255, 255}, {0, 0, 0, 255}}); got != 83 {
+		t.Errorf("current is %g, want 83", got)
+	}
+}
+
+func TestPowerConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conf PowerConfig
+		leds int
+		err  string
+	}{
+		{"valid", PowerConfig{MilliampsPerChannel: 20, IdleMilliamps: 1, BudgetMilliamps: 2000}, 100, ""},
+		{"no idle current", PowerConfig{MilliampsPerChannel: 20, BudgetMilliamps: 1}, 1000, ""},
+		{"idle equals budget", PowerConfig{MilliampsPerChannel: 20, IdleMilliamps: 1, BudgetMilliamps: 100}, 100, "doesn't cover 100mA drawn by 100 idle leds"},
+		{"idle over budget", PowerConfig{MilliampsPerChannel: 20, IdleMilliamps: 1, BudgetMilliamps: 100}, 150, "doesn't cover 150mA"},
+		{"zero channel current", PowerConfig{BudgetMilliamps: 100}, 1, "milliamps per channel"},
+		{"negative idle", PowerConfig{MilliampsPerChannel: 20, IdleMilliamps: -1, BudgetMilliamps: 100}, 1, "idle milliamps"},
+		{"zero budget", PowerConfig{MilliampsPerChannel: 20}, 1, "power budget must be"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.conf.Validate(tc.leds)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("error is %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestOutputValidatesPowerForItsRange(t *testing.T) {
+	c := &OutputConfig{
+		Name:   "strip",
+		Driver: "ws2801",
+		SPI:    &SPIConfig{},
+		Range:  &LedRange{0, 9},
+		Power:  &PowerConfig{MilliampsPerChannel: 20, IdleMilliamps: 10, BudgetMilliamps: 150},
+	}
+	// 10 leds of the range draw 100mA, all 50 leds of the layout would exceed the budget
+	if err := c.Validate(50); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Range = nil
+	if err := c.Validate(50); err == nil || !strings.Contains(err.Error(), `output "strip"`) {
+		t.Errorf("error is %v, want budget error of the output", err)
+	}
+}
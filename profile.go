@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DefaultProfile selects the settings without any profile applied.
+const DefaultProfile = "default"
+
+// profileFields are the settings a profile may override. Others describe the hardware
+// and switching them would reopen the devices.
+var profileFields = map[string]bool{
+	"camera":          true,
+	"colorCorrection": true,
+	"imageDelay":      true,
+	"ledDepth":        true,
+	"light":           true,
+	"screenOff":       true,
+	"smoothing":       true,
+}
+
+// WithProfile returns a copy of the config with the profile applied. Objects are merged,
+// so the profile sets only the fields it contains, e.g. {"light": {"brightness": 60}}.
+// Empty name or DefaultProfile returns the config as it is.
+func (c *Config) WithProfile(name string) (*Config, error) {
+	merged, err := c.Clone()
+	if err != nil {
+		return nil, err
+	}
+	// the merged config has no profiles, so it's validated and applied as a plain config
+	merged.Profiles = nil
+	merged.Profile = ""
+	if name == "" || name == DefaultProfile {
+		return merged, nil
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %q not found", name)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(profile, &fields); err != nil {
+		return nil, fmt.Errorf("profile %q: %s", name, err)
+	}
+	for field := range fields {
+		if !profileFields[field] {
+			return nil, fmt.Errorf("profile %q: %s can't be overridden, only %s", name, field, strings.Join(sortedKeys(profileFields), ", "))
+		}
+	}
+	if _, ok := fields["camera"]; ok && merged.Camera == nil {
+		// fields missing in the profile keep the defaults
+		camera := DefaultCameraConfig()
+		merged.Camera = &camera
+	}
+	if err := json.Unmarshal(profile, merged); err != nil {
+		return nil, fmt.Errorf("profile %q: %s", name, err)
+	}
+	return merged, nil
+}
+
+// ProfileNames returns sorted names of the profiles including DefaultProfile.
+func (c *Config) ProfileNames() []string {
+	names := []string{DefaultProfile}
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// ActiveProfile returns name of the active profile, DefaultProfile when none is set.
+func (c *Config) ActiveProfile() string {
+	if c.Profile == "" {
+		return DefaultProfile
+	}
+	return c.Profile
+}
+
+// validateProfiles checks that each profile results in a valid config.
+func (c *Config) validateProfiles() []error {
+	var errs []error
+	if _, ok := c.Profiles[DefaultProfile]; ok {
+		errs = append(errs, fmt.Errorf("profiles: %q is reserved for settings without profile", DefaultProfile))
+	}
+	for _, name := range c.ProfileNames()[1:] {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("profiles: name can't be empty"))
+			continue
+		}
+		merged, err := c.WithProfile(name)
+		if err == nil {
+			err = merged.Validate()
+			if err != nil {
+				err = fmt.Errorf("profile %q: %s", name, err)
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, ok := c.Profiles[c.Profile]; !ok && c.Profile != "" && c.Profile != DefaultProfile {
+		errs = append(errs, fmt.Errorf("profile: %q not found", c.Profile))
+	}
+	return errs
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SwitchProfile activates the profile and stores it in the config file.
+func (a *ambilight) SwitchProfile(name string) error {
+	c, err := currentConfig().Clone()
+	if err != nil {
+		return err
+	}
+	c.Profile = name
+	if name == DefaultProfile {
+		c.Profile = ""
+	}
+	if err := a.Apply(c); err != nil {
+		return err
+	}
+	return c.Write()
+}
+
+// OnProfileChange registers function called after the active profile or the list of profiles changes.
+func (a *ambilight) OnProfileChange(fn func(active string, names []string)) {
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+	a.profileWatchers = append(a.profileWatchers, fn)
+}
+
+type profileResponse struct {
+	Active   string   `json:"active"`
+	Profiles []string `json:"profiles"`
+}
+
+// handleProfileAPI registers http handler listing and switching profiles.
+func handleProfileAPI(mux *http.ServeMux, a *ambilight) {
+	mux.HandleFunc("/api/profile", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var req struct {
+				Active string `json:"active"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+				return
+			}
+			if err := a.SwitchProfile(req.Active); err != nil {
+				writeAPIError(w, http.StatusBadRequest, err)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		c := currentConfig()
+		writeJSON(w, http.StatusOK, profileResponse{c.ActiveProfile(), c.ProfileNames()})
+	})
+}
+
+func profileCmd() *command {
+	return newCommand(
+		"profile",
+		"[name]",
+		"List profiles or switch the active one, running instance applies the switch immediately.",
+		func(fs *flag.FlagSet) error {
+			if fs.NArg() > 1 {
+				return usageErrorf("unexpected arguments: %s", strings.Join(fs.Args()[1:], " "))
+			}
+			if err := readConfig(); err != nil {
+				return err
+			}
+			if fs.NArg() == 0 {
+				for _, name := range Conf.ProfileNames() {
+					if name == Conf.ActiveProfile() {
+						fmt.Printf("* %s\n", name)
+					} else {
+						fmt.Printf("  %s\n", name)
+					}
+				}
+				return nil
+			}
+			if err := setProfile(fs.Arg(0)); err != nil {
+				return err
+			}
+			fmt.Printf("Active profile: %s\n", Conf.ActiveProfile())
+			return nil
+		},
+	)
+}
+
+// setProfile activates the profile in the config file.
+func setProfile(name string) error {
+	if name == DefaultProfile {
+		name = ""
+	}
+	if _, ok := Conf.Profiles[name]; !ok && name != "" {
+		return usageErrorf("profile %q not found, available: %s", name, strings.Join(Conf.ProfileNames(), ", "))
+	}
+	Conf.Profile = name
+	return Conf.Write()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWithProfile(t *testing.T) {
+	base := func() *Config {
+		brightness := uint8(200)
+		effect := "ambilight"
+		camera := DefaultCameraConfig()
+		return &Config{
+			ScreenWidth:  3840,
+			ScreenHeight: 2160,
+			Layout:       NewUniformLayout(31, 17),
+			Smoothing:    0.3,
+			Camera:       &camera,
+			ScreenOff:    &ScreenOffConfig{Brightness: 20, Delay: 10},
+			Light:        &LightConfig{Brightness: &brightness, Effect: &effect},
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		profile string
+		// prepare changes the base config before the profile is applied
+		prepare func(c *Config)
+		// change is applied to the base config to get the expected result
+		change func(c *Config)
+		err    string
+	}{
+		{
+			name:    "scalar",
+			profile: `{"smoothing":0}`,
+			change:  func(c *Config) { c.Smoothing = 0 },
+		},
+		{
+			name:    "nested fields are merged",
+			profile: `{"light":{"brightness":60},"screenOff":{"delay":3}}`,
+			change: func(c *Config) {
+				b := uint8(60)
+				c.Light.Brightness = &b
+				c.ScreenOff.Delay = 3
+			},
+		},
+		{
+			name:    "camera keeps other settings",
+			profile: `{"camera":{"exposure":"sports"}}`,
+			change:  func(c *Config) { c.Camera.Exposure = "sports" },
+		},
+		{
+			name:    "missing camera uses defaults",
+			profile: `{"camera":{"iso":400}}`,
+			prepare: func(c *Config) { c.Camera = nil },
+			change: func(c *Config) {
+				camera := DefaultCameraConfig()
+				camera.ISO = 400
+				c.Camera = &camera
+			},
+		},
+		{
+			name:    "empty",
+			profile: `{}`,
+			change:  func(c *Config) {},
+		},
+		{
+			name:    "hardware can't be overridden",
+			profile: `{"outputs":[]}`,
+			err:     "outputs can't be overridden",
+		},
+		{
+			name:    "layout can't be overridden",
+			profile: `{"smoothing":0,"layout":{"top":1}}`,
+			err:     "layout can't be overridden",
+		},
+		{
+			name:    "invalid json",
+			profile: `[1]`,
+			err:     `profile "p"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := base()
+			if tc.prepare != nil {
+				tc.prepare(c)
+			}
+			c.Profiles = map[string]json.RawMessage{"p": json.RawMessage(tc.profile)}
+			c.Profile = "p"
+			got, err := c.WithProfile("p")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := base()
+			if tc.prepare != nil {
+				tc.prepare(want)
+			}
+			tc.change(want)
+			if !reflect.DeepEqual(got, want) {
+				a, _ := json.Marshal(got)
+				b, _ := json.Marshal(want)
+				t.Errorf("got  %s\nwant %s", a, b)
+			}
+			// the profile must not leak into the base config
+			if !reflect.DeepEqual(c.Light, base().Light) || c.Smoothing != base().Smoothing {
+				t.Errorf("base config changed to %+v", c)
+			}
+		})
+	}
+}
+
+func TestWithProfileDefault(t *testing.T) {
+	c := &Config{
+		Smoothing: 0.5,
+		Profiles:  map[string]json.RawMessage{"gaming": json.RawMessage(`{"smoothing":0}`)},
+		Profile:   "gaming",
+	}
+	for _, name := range []string{"", DefaultProfile} {
+		got, err := c.WithProfile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Smoothing != 0.5 || got.Profiles != nil || got.Profile != "" {
+			t.Errorf("%q: got %+v, want base settings without profiles", name, got)
+		}
+	}
+	if _, err := c.WithProfile("movie"); err == nil {
+		t.Error("missing profile must fail")
+	}
+}
+
+func TestProfileFieldsCanBeMerged(t *testing.T) {
+	// each field must exist in the config, otherwise the profile would be silently ignored
+	b, err := json.Marshal(&Config{
+		Camera:          &CameraConfig{},
+		ColorCorrection: &ColorMatrix{},
+		ImageDelay:      1,
+		LedDepth:        1,
+		Light:           &LightConfig{},
+		ScreenOff:       &ScreenOffConfig{},
+		Smoothing:       0.1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for field := range profileFields {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("profile field %q isn't a config field", field)
+		}
+	}
+}
+
+func TestValidateProfiles(t *testing.T) {
+	c := &Config{
+		ScreenWidth:  3840,
+		ScreenHeight: 2160,
+		Layout:       NewUniformLayout(31, 17),
+		Profiles: map[string]json.RawMessage{
+			"ok":           json.RawMessage(`{"smoothing":0.8}`),
+			"smooth":       json.RawMessage(`{"smoothing":3}`),
+			"hardware":     json.RawMessage(`{"mqtt":{}}`),
+			DefaultProfile: json.RawMessage(`{}`),
+		},
+		Profile: "missing",
+	}
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("invalid profiles must fail")
+	}
+	for _, want := range []string{`profile "smooth": smoothing`, `profile "hardware": mqtt can't be overridden`, `"default" is reserved`, `"missing" not found`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), `"ok"`) {
+		t.Errorf("valid profile reported in %q", err)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/technomancers/piCamera"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reloadDebounce groups events of a single save, editors often write the file in several steps.
+const reloadDebounce = 200 * time.Millisecond
+
+// confMu guards replacing Conf while the application runs.
+var confMu sync.RWMutex
+
+// currentConfig returns the config used by the running application.
+func currentConfig() *Config {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return Conf
+}
+
+func setConfig(c *Config) {
+	confMu.Lock()
+	defer confMu.Unlock()
+	Conf = c
+}
+
+// Clone returns a deep copy of the config, so it can be changed without affecting the running application.
+func (c *Config) Clone() (*Config, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	clone := &Config{dir: c.dir}
+	if err := json.Unmarshal(b, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// loadConfig reads the config file into a new config, the current one is left intact.
+func loadConfig(dir string) (*Config, error) {
+	c := &Config{dir: dir}
+	b, err := ioutil.ReadFile(c.Dest())
+	if err != nil {
+		return nil, err
+	}
+	b, _, err = migrateConfig(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// frameSettings are used by the capture loop for each frame, they're replaced as a whole when the config changes.
+type frameSettings struct {
+	regions    []*image.Rectangle
+	correction *ColorMatrix
+	smoothing  float64
+}
+
+func newFrameSettings(c *Config) *frameSettings {
+	return &frameSettings{regions: c.CameraLedRegions(), correction: c.ColorCorrection, smoothing: c.Smoothing}
+}
+
+// capture owns the camera and the loop reading its frames, so both can be replaced while running.
+type capture struct {
+	run    func(ctx context.Context, cam *piCamera.PiCamera)
+	mu     sync.Mutex
+	camera *piCamera.PiCamera
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start starts the camera and the capture loop, which runs until the context is done or Stop is called.
+func (c *capture) Start(ctx context.Context, settings CameraConfig) error {
+	cam, err := startCamera(settings)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.camera, c.cancel, c.done = cam, cancel, done
+	c.mu.Unlock()
+	go func() {
+		defer close(done)
+		c.run(ctx, cam)
+	}()
+	return nil
+}
+
+// Stop stops the camera and waits for the capture loop.
+func (c *capture) Stop() {
+	c.mu.Lock()
+	cam, cancel, done := c.camera, c.cancel, c.done
+	c.camera = nil
+	c.mu.Unlock()
+	if cam == nil {
+		return
+	}
+	cancel()
+	// capture may be blocked waiting for a frame, which is released only when camera stops
+	cam.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
+
+// Restart replaces the camera by one with new settings. The previous settings
+// are restored when the camera fails to start with the new ones.
+func (c *capture) Restart(ctx context.Context, settings, prev CameraConfig) error {
+	c.Stop()
+	err := c.Start(ctx, settings)
+	if err == nil {
+		return nil
+	}
+	if rerr := c.Start(ctx, prev); rerr != nil {
+		cameraLog.Error("restoring camera failed", "err", rerr)
+	}
+	return err
+}
+
+// ambilight holds components of the running application, which are reconfigured when the config changes.
+type ambilight struct {
+	lc       *Lifecycle
+	pipeline *Pipeline
+	capture  *capture
+	settings atomic.Value // *frameSettings
+	// active is the config with the active profile applied.
+	active atomic.Value // *Config
+	screen *ScreenDetector
+	light  *Light
+	// hyperion is nil when the server is disabled.
+	hyperion *HyperionServer
+	// mqtt is nil when the bridge is disabled. It's replaced under both mu and mqttMu,
+	// watchers read it only under mqttMu as they may be called while a config is applied.
+	mqtt       *MQTTBridge
+	cancelMQTT context.CancelFunc
+	mqttMu     sync.Mutex
+	// mu serializes applying configs.
+	mu              sync.Mutex
+	watchMu         sync.Mutex
+	profileWatchers []func(active string, names []string)
+}
+
+// Active returns the running config with the active profile applied.
+func (a *ambilight) Active() *Config {
+	return a.active.Load().(*Config)
+}
+
+// Apply validates the config and reconfigures the running components. Invalid config
+// is rejected before anything changes, so the running pipeline keeps the current one.
+func (a *ambilight) Apply(next *Config) error {
+	a.mu.Lock()
+	notify, err := a.apply(next)
+	a.mu.Unlock()
+	// watchers may block, e.g. publishing to mqtt, so they're called without the lock
+	for _, fn := range notify {
+		fn()
+	}
+	return err
+}
+
+// apply reconfigures the components and returns notifications of the profile watchers.
+// Only the components whose settings changed are restarted, ones already restarted
+// are restored when a later one fails.
+func (a *ambilight) apply(next *Config) ([]func(), error) {
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+	base := currentConfig()
+	if sameJSON(base, next) {
+		return nil, nil
+	}
+	active, err := next.WithProfile(next.Profile)
+	if err != nil {
+		return nil, err
+	}
+	prev := a.Active()
+	var undo []func()
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	if active.LedLayout().Count() != prev.LedLayout().Count() || !sameJSON(active.LedOutputs(), prev.LedOutputs()) {
+		if err := a.replaceOutputs(active, prev); err != nil {
+			return nil, fmt.Errorf("outputs: %s", err)
+		}
+		undo = append(undo, func() { logRestore("outputs", a.replaceOutputs(prev, active)) })
+	}
+	if !sameJSON(active.MQTT, prev.MQTT) {
+		if err := a.replaceMQTT(active.MQTT, prev.MQTT); err != nil {
+			rollback()
+			return nil, fmt.Errorf("mqtt: %s", err)
+		}
+		undo = append(undo, func() { logRestore("mqtt", a.replaceMQTT(prev.MQTT, active.MQTT)) })
+	}
+	if camera := active.CameraSettings(); camera != prev.CameraSettings() {
+		if err := a.capture.Restart(a.lc.Context(), camera, prev.CameraSettings()); err != nil {
+			rollback()
+			return nil, fmt.Errorf("camera: %s", err)
+		}
+	}
+	setConfig(next)
+	a.active.Store(active)
+	a.settings.Store(newFrameSettings(active))
+	a.screen.Configure(active.ScreenOffSettings(), active.CameraQuad())
+	if a.hyperion != nil {
+		a.hyperion.SetImageDelay(time.Duration(active.ImageDelay) * time.Millisecond)
+	}
+	if u, ok := active.Light.update(prev.Light); ok {
+		if err := a.light.Update(u); err != nil {
+			mainLog.Error("applying light config failed", "err", err)
+		}
+	}
+	mainLog.Info("config applied", "profile", next.ActiveProfile())
+	names := next.ProfileNames()
+	if next.ActiveProfile() == base.ActiveProfile() && sameJSON(names, base.ProfileNames()) {
+		return nil, nil
+	}
+	a.watchMu.Lock()
+	watchers := a.profileWatchers
+	a.watchMu.Unlock()
+	notify := make([]func(), len(watchers))
+	for i, fn := range watchers {
+		fn := fn
+		notify[i] = func() { fn(next.ActiveProfile(), names) }
+	}
+	return notify, nil
+}
+
+func logRestore(component string, err error) {
+	if err != nil {
+		mainLog.Error("restoring previous config failed", "component", component, "err", err)
+	}
+}
+
+// replaceOutputs closes the current devices before opening the new ones, so they may use
+// the same hardware. Devices of the previous config are opened again when the new ones fail.
+func (a *ambilight) replaceOutputs(c, prev *Config) error {
+	old := a.pipeline.ReplaceOutputs(c.LedLayout().Count(), nil)
+	// leds beyond the new count would keep their colors
+	err := joinErrors([]error{old.Blank(prev.LedLayout().Count()), old.Close()})
+	if err != nil {
+		ledLog.Warn("closing outputs failed", "err", err)
+	}
+	outputs, err := OpenOutputs(c.LedOutputs(), c.LedLayout().Count())
+	if err != nil {
+		count := prev.LedLayout().Count()
+		restored, rerr := OpenOutputs(prev.LedOutputs(), count)
+		logRestore("outputs", rerr)
+		a.pipeline.ReplaceOutputs(count, restored)
+		return err
+	}
+	a.pipeline.ReplaceOutputs(c.LedLayout().Count(), outputs)
+	ledLog.Info("outputs replaced", "leds", c.LedLayout().Count(), "outputs", len(outputs))
+	return nil
+}
+
+// replaceMQTT disconnects the current bridge and connects one for the config, nil config
+// only disconnects. Bridge of the previous config is connected again when the new one fails.
+func (a *ambilight) replaceMQTT(c, prev *MQTTConfig) error {
+	a.stopMQTT()
+	err := a.startMQTT(c)
+	if err != nil {
+		logRestore("mqtt", a.startMQTT(prev))
+	}
+	return err
+}
+
+func (a *ambilight) startMQTT(c *MQTTConfig) error {
+	if c == nil {
+		return nil
+	}
+	b := NewMQTTBridge(c, a.light, a.pipeline, a, nil)
+	if err := b.Connect(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(a.lc.Context())
+	go b.publishSensors(ctx)
+	a.mqttMu.Lock()
+	a.mqtt, a.cancelMQTT = b, cancel
+	a.mqttMu.Unlock()
+	return nil
+}
+
+func (a *ambilight) stopMQTT() {
+	a.mqttMu.Lock()
+	b, cancel := a.mqtt, a.cancelMQTT
+	a.mqtt, a.cancelMQTT = nil, nil
+	a.mqttMu.Unlock()
+	if b == nil {
+		return
+	}
+	cancel()
+	b.Disconnect()
+}
+
+// currentMQTT returns the connected bridge or nil when it's disabled.
+func (a *ambilight) currentMQTT() *MQTTBridge {
+	a.mqttMu.Lock()
+	defer a.mqttMu.Unlock()
+	return a.mqtt
+}
+
+// watchMQTT publishes changes of the light and profiles by the current bridge. It's called
+// once, so watchers don't accumulate as bridges are replaced by config changes.
+func (a *ambilight) watchMQTT() {
+	a.light.OnChange(func(LightState) {
+		if b := a.currentMQTT(); b != nil {
+			b.LightChanged()
+		}
+	})
+	a.OnProfileChange(func(string, []string) {
+		if b := a.currentMQTT(); b != nil {
+			b.ProfilesChanged()
+		}
+	})
+}
+
+// Reload applies the config file, the current config is kept when the file is invalid.
+func (a *ambilight) Reload() {
+	next, err := loadConfig(currentConfig().dir)
+	if err == nil {
+		err = a.Apply(next)
+	}
+	if err != nil {
+		mainLog.Error("config rejected", "file", currentConfig().Dest(), "err", err)
+	}
+}
+
+// watchConfig reloads the config whenever its file changes until the context is done.
+// The directory is watched, so the file may be replaced.
+func (a *ambilight) watchConfig(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dest := currentConfig().Dest()
+	if err := w.Add(filepath.Dir(dest)); err != nil {
+		w.Close()
+		return err
+	}
+	go func() {
+		defer w.Close()
+		reload := time.NewTimer(reloadDebounce)
+		reload.Stop()
+		defer reload.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-w.Events:
+				if filepath.Clean(ev.Name) == filepath.Clean(dest) && ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					reload.Reset(reloadDebounce)
+				}
+			case err := <-w.Errors:
+				mainLog.Warn("watching config failed", "err", err)
+			case <-reload.C:
+				a.Reload()
+			}
+		}
+	}()
+	return nil
+}
+
+// sameJSON reports whether both values have the same json representation.
+func sameJSON(a, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyReplacesMQTTBridge(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+	a, cleanup := newTestApp(t)
+	defer cleanup()
+	defer a.stopMQTT()
+	lightWatchers, profileWatchers := len(a.light.watchers), len(a.profileWatchers)
+	for _, node := range []string{"tv", "desk"} {
+		c, err := currentConfig().Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.MQTT = &MQTTConfig{Broker: broker.URL(), NodeID: node}
+		if err := a.Apply(c); err != nil {
+			t.Fatal(err)
+		}
+		// state is published after availability
+		waitFor(t, "state of "+node, func() bool {
+			_, ok := broker.Retained("rpi-cam-ambilight/" + node + "/light/state")
+			return ok
+		})
+		if n := len(a.light.watchers); n != lightWatchers {
+			t.Errorf("light has %d watchers after connecting %s, want %d", n, node, lightWatchers)
+		}
+		if n := len(a.profileWatchers); n != profileWatchers {
+			t.Errorf("app has %d profile watchers after connecting %s, want %d", n, node, profileWatchers)
+		}
+	}
+	if payload, _ := broker.Retained("rpi-cam-ambilight/tv/availability"); payload != "offline" {
+		t.Errorf("previous bridge is %s", payload)
+	}
+	off := false
+	if err := a.light.Update(LightUpdate{On: &off}); err != nil {
+		t.Fatal(err)
+	}
+	// changes are published only by the current bridge
+	waitFor(t, "state of light off", func() bool {
+		state, _ := broker.Retained("rpi-cam-ambilight/desk/light/state")
+		return strings.Contains(state, `"state":"OFF"`)
+	})
+	if state, _ := broker.Retained("rpi-cam-ambilight/tv/light/state"); !strings.Contains(state, `"state":"ON"`) {
+		t.Errorf("previous bridge published state %s", state)
+	}
+}
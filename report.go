@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files of the calibration report stored in the config directory.
+const (
+	reportJSONFile  = "calibration-report.json"
+	reportHTMLFile  = "calibration-report.html"
+	reportFrameFile = "calibration-report.jpg"
+)
+
+// CalibrationReport describes result of the last calibration.
+type CalibrationReport struct {
+	Created     time.Time        `json:"created"`
+	FrameWidth  int              `json:"frameWidth"`
+	FrameHeight int              `json:"frameHeight"`
+	Leds        []LedCalibration `json:"leds"`
+	// Suspicious lists indexes of leds which should be captured again.
+	Suspicious []int `json:"suspicious"`
+}
+
+func NewCalibrationReport(frame *image.RGBA, leds []LedCalibration) *CalibrationReport {
+	r := &CalibrationReport{
+		Created:     time.Now(),
+		FrameWidth:  frame.Rect.Dx(),
+		FrameHeight: frame.Rect.Dy(),
+		Leds:        leds,
+		Suspicious:  []int{},
+	}
+	for _, led := range leds {
+		if led.Suspicious {
+			r.Suspicious = append(r.Suspicious, led.Index)
+		}
+	}
+	return r
+}
+
+func (c *Config) CalibrationReportPath() string {
+	return filepath.Join(c.dir, reportJSONFile)
+}
+
+// ReadCalibrationReport reads report of the last calibration, nil is returned when there is none.
+func ReadCalibrationReport(c *Config) (*CalibrationReport, error) {
+	b, err := ioutil.ReadFile(c.CalibrationReportPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var r CalibrationReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// writeCalibrationReport stores JSON and HTML report together with the camera frame.
+func writeCalibrationReport(c *Config, r *CalibrationReport, frame *image.RGBA) error {
+	// regions are drawn over the frame by the html report
+	b, err := encodeJpeg(frame)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(c.dir, reportFrameFile), b, 0644); err != nil {
+		return err
+	}
+	b, err = json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.CalibrationReportPath(), b, 0644); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(c.dir, reportHTMLFile))
+	if err != nil {
+		return err
+	}
+	if err := reportTemplate.Execute(f, struct {
+		*CalibrationReport
+		Frame string
+	}{r, reportFrameFile}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(v float64) string { return fmt.Sprintf("%.0f%%", v*100) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Calibration report</title>
+    <style>
+        body {font-family: sans-serif;}
+        svg {max-width: 100%; height: auto;}
+        rect {fill: none; stroke: lime; stroke-width: 2;}
+        rect.suspicious {stroke: red;}
+        text {fill: yellow; font-size: 14px;}
+        table {border-collapse: collapse;}
+        td, th {border: 1px solid #ccc; padding: 2px 6px; text-align: right;}
+        tr.suspicious {background: #fdd;}
+    </style>
+</head>
+<body>
+<h1>Calibration report</h1>
+<p>Created {{.Created.Format "2006-01-02 15:04:05"}}, {{len .Leds}} leds, {{len .Suspicious}} suspicious{{if .Suspicious}}: {{range $i, $v := .Suspicious}}{{if $i}}, {{end}}{{$v}}{{end}}{{end}}</p>
+<svg width="{{.FrameWidth}}" height="{{.FrameHeight}}" viewBox="0 0 {{.FrameWidth}} {{.FrameHeight}}">
+    <image href="{{.Frame}}" width="{{.FrameWidth}}" height="{{.FrameHeight}}"/>
+    {{range .Leds}}<rect class="{{if .Suspicious}}suspicious{{end}}" x="{{.Region.Min.X}}" y="{{.Region.Min.Y}}" width="{{.Region.Dx}}" height="{{.Region.Dy}}"/>
+    <text x="{{.Region.Min.X}}" y="{{.Region.Min.Y}}">{{.Index}}</text>
+    {{end}}
+</svg>
+<table>
+    <tr><th>Led</th><th>Region</th><th>Area</th><th>Centroid</th><th>Overlap</th><th>Confidence</th><th>Out of order</th><th>Problems</th></tr>
+    {{range .Leds}}<tr class="{{if .Suspicious}}suspicious{{end}}">
+        <td>{{.Index}}</td><td>{{.Region}}</td><td>{{.Area}}</td>
+        <td>{{printf "%.1f" (index .Centroid 0)}}, {{printf "%.1f" (index .Centroid 1)}}</td>
+        <td>{{percent .Overlap}}</td><td>{{percent .Confidence}}</td><td>{{if .OutOfOrder}}yes{{end}}</td>
+        <td>{{range $i, $p := .Problems}}{{if $i}}, {{end}}{{$p}}{{end}}</td>
+    </tr>
+    {{end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalibrationReportRoundtrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Config{dir: dir}
+	frame := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	leds := []LedCalibration{
+		{Index: 0, Region: image.Rect(1, 2, 11, 12), Area: 90, Centroid: [2]float64{6, 7}, Contrast: 120, Confidence: 0.9},
+		{Index: 1, Region: image.Rect(20, 2, 30, 12), Area: 4, Overlap: 0.5, Confidence: 0.2, OutOfOrder: true, Suspicious: true, Problems: []string{"small area", "out of order"}},
+	}
+	r := NewCalibrationReport(frame, leds)
+	// monotonic clock reading isn't stored
+	r.Created = time.Date(2020, 5, 17, 20, 30, 0, 0, time.UTC)
+	if !reflect.DeepEqual(r.Suspicious, []int{1}) || r.FrameWidth != 64 || r.FrameHeight != 48 {
+		t.Errorf("report is %+v", r)
+	}
+	if err := writeCalibrationReport(c, r, frame); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadCalibrationReport(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, r) {
+		t.Errorf("read report is %+v\nwant %+v", read, r)
+	}
+	html, err := ioutil.ReadFile(filepath.Join(dir, reportHTMLFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Created 2020-05-17 20:30:00, 2 leds, 1 suspicious: 1",
+		`<image href="calibration-report.jpg" width="64" height="48"/>`,
+		`<rect class="suspicious" x="20" y="2" width="10" height="10"/>`,
+		"<td>50%</td><td>20%</td><td>yes</td>",
+		"<td>small area, out of order</td>",
+	} {
+		if !strings.Contains(string(html), want) {
+			t.Errorf("html report doesn't contain %q", want)
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, reportFrameFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatalf("invalid frame: %s", err)
+	}
+	if img.Bounds() != frame.Rect {
+		t.Errorf("frame size is %v, want %v", img.Bounds(), frame.Rect)
+	}
+}
+
+func TestReadCalibrationReportMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := ReadCalibrationReport(&Config{dir: dir})
+	if r != nil || err != nil {
+		t.Errorf("got %v, %v, want no report and no error", r, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, reportJSONFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadCalibrationReport(&Config{dir: dir}); err == nil {
+		t.Error("invalid report was read")
+	}
+}
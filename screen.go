@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PriorityScreenOff is above the camera only, so effects are still shown when the screen is off.
+const PriorityScreenOff = PriorityCamera - 1
+
+// Defaults of the screen off detection.
+const (
+	DefaultScreenOffBrightness = 16
+	DefaultScreenOffDeviation  = 6
+	DefaultScreenOffDelay      = 10
+	DefaultScreenOffFade       = 2.0
+)
+
+// screenSamples is amount of points sampled along each side of the screen area.
+const screenSamples = 32
+
+// ScreenOffConfig controls turning leds off while the camera sees dark screen.
+type ScreenOffConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// Brightness is mean luma (0-255) of the screen below which the screen may be off.
+	Brightness float64 `json:"brightness,omitempty"`
+	// Deviation is standard deviation of luma below which the screen has no content.
+	Deviation float64 `json:"deviation,omitempty"`
+	// Delay is amount of seconds the screen has to be dark before leds are turned off.
+	Delay int `json:"delay,omitempty"`
+	// Fade is duration of fade out and fade in in seconds.
+	Fade float64 `json:"fade,omitempty"`
+}
+
+// withDefaults returns copy of the config with defaults filled in.
+func (c ScreenOffConfig) withDefaults() ScreenOffConfig {
+	if c.Brightness == 0 {
+		c.Brightness = DefaultScreenOffBrightness
+	}
+	if c.Deviation == 0 {
+		c.Deviation = DefaultScreenOffDeviation
+	}
+	if c.Delay == 0 {
+		c.Delay = DefaultScreenOffDelay
+	}
+	if c.Fade == 0 {
+		c.Fade = DefaultScreenOffFade
+	}
+	return c
+}
+
+func (c *ScreenOffConfig) Validate() error {
+	switch {
+	case c.Brightness < 0 || c.Brightness > 255:
+		return fmt.Errorf("screen off brightness must be within 0-255 range")
+	case c.Deviation < 0 || c.Deviation > 255:
+		return fmt.Errorf("screen off deviation must be within 0-255 range")
+	case c.Delay < 0:
+		return fmt.Errorf("screen off delay can't be negative")
+	case c.Fade < 0:
+		return fmt.Errorf("screen off fade can't be negative")
+	}
+	return nil
+}
+
+// ScreenState describes content of the screen seen by the camera.
+type ScreenState struct {
+	Off bool `json:"off"`
+	// Brightness is mean luma of the last frame.
+	Brightness float64 `json:"brightness"`
+	// Deviation is standard deviation of luma of the last frame.
+	Deviation float64 `json:"deviation"`
+	// Since is time when the screen was turned on or off.
+	Since time.Time `json:"since"`
+}
+
+// ScreenDetector turns the leds off when the screen stays dark and turns them on again
+// as soon as content returns.
+type ScreenDetector struct {
+	conf     ScreenOffConfig
+	quad     Quad
+	pipeline *Pipeline
+	mu       sync.Mutex
+	state    ScreenState
+	dark     time.Time
+}
+
+func NewScreenDetector(c ScreenOffConfig, q Quad, p *Pipeline) *ScreenDetector {
+	return &ScreenDetector{conf: c.withDefaults(), quad: q, pipeline: p, state: ScreenState{Since: time.Now()}}
+}
+
+// screenLuma returns mean and standard deviation of luma sampled from the screen area of the frame.
+func screenLuma(frame *image.RGBA, q Quad) (mean, deviation float64) {
+	var sum, sumSq float64
+	n := 0
+	for i := 0; i < screenSamples; i++ {
+		for j := 0; j < screenSamples; j++ {
+			pt := q.Map((float64(i)+0.5)/screenSamples, (float64(j)+0.5)/screenSamples)
+			if !pt.In(frame.Rect) {
+				continue
+			}
+			y := luma(frame.RGBAAt(pt.X, pt.Y))
+			sum += y
+			sumSq += y * y
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	mean = sum / float64(n)
+	return mean, math.Sqrt(math.Max(sumSq/float64(n)-mean*mean, 0))
+}
+
+func luma(c color.RGBA) float64 {
+	return 0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)
+}
+
+// Update analyses the captured frame and fades the leds out or in when the screen state changes.
+func (d *ScreenDetector) Update(frame *image.RGBA, captured time.Time) {
+	d.mu.Lock()
+	conf, q := d.conf, d.quad
+	d.mu.Unlock()
+	if conf.Disabled {
+		return
+	}
+	mean, deviation := screenLuma(frame, q)
+	dark := mean < conf.Brightness && deviation < conf.Deviation
+	fade := time.Duration(conf.Fade * float64(time.Second))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state.Brightness = mean
+	d.state.Deviation = deviation
+	switch {
+	case !dark:
+		d.dark = time.Time{}
+		if d.state.Off {
+			d.turnOn(captured, fade)
+		}
+	case d.dark.IsZero():
+		d.dark = captured
+	case !d.state.Off && captured.Sub(d.dark) >= time.Duration(conf.Delay)*time.Second:
+		d.state.Off = true
+		d.state.Since = captured
+		d.pipeline.Fade(PriorityScreenOff, "screen off", &ColorSource{color.RGBA{A: 255}}, fade)
+	}
+}
+
+func (d *ScreenDetector) turnOn(at time.Time, fade time.Duration) {
+	d.state.Off = false
+	d.state.Since = at
+	d.pipeline.Fade(PriorityScreenOff, "screen off", nil, fade)
+}
+
+// Configure replaces settings of the detection while it runs. Leds are turned on when the detection gets disabled.
+func (d *ScreenDetector) Configure(c ScreenOffConfig, q Quad) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conf = c.withDefaults()
+	d.quad = q
+	if d.conf.Disabled {
+		d.dark = time.Time{}
+		if d.state.Off {
+			d.turnOn(time.Now(), time.Duration(d.conf.Fade*float64(time.Second)))
+		}
+	}
+}
+
+// State returns the last detected state of the screen.
+func (d *ScreenDetector) State() ScreenState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// handleScreenAPI registers http handler exposing state of the screen.
+func handleScreenAPI(mux *http.ServeMux, d *ScreenDetector) {
+	mux.HandleFunc("/api/screen", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.State())
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/technomancers/piCamera"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"sync"
+)
+
+// tuningPatches are colors shown on the screen while the exposure is tuned.
+var tuningPatches = []color.RGBA{
+	{0, 0, 0, 255}, {32, 32, 32, 255}, {64, 64, 64, 255}, {128, 128, 128, 255}, {192, 192, 192, 255}, {255, 255, 255, 255},
+	{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {0, 255, 255, 255}, {255, 0, 255, 255}, {255, 255, 0, 255},
+}
+
+// tuningColumns is amount of patches in a row of the tuning screen.
+const tuningColumns = 6
+
+// Candidates tried by the exposure tuning, ordered from the least noisy.
+var (
+	tuningISOs          = []int{100, 200, 400, 800}
+	tuningShutterSpeeds = []int{2000, 4000, 8000, 16000, 33000}
+)
+
+// clippedFraction is a share of clipped pixels after which the patch is considered clipped.
+const clippedFraction = 0.01
+
+// TuningCamera captures frames of the screen with the given camera settings.
+type TuningCamera interface {
+	Capture(ctx context.Context, c CameraConfig) (*image.RGBA, error)
+}
+
+// patchRect returns normalized area of the patch on the screen.
+func patchRect(i int) (u0, v0, u1, v1 float64) {
+	rows := (len(tuningPatches) + tuningColumns - 1) / tuningColumns
+	col, row := i%tuningColumns, i/tuningColumns
+	w, h := 1/float64(tuningColumns), 1/float64(rows)
+	return float64(col) * w, float64(row) * h, float64(col+1) * w, float64(row+1) * h
+}
+
+// tuningPattern shows all patches.
+func tuningPattern() Pattern {
+	var p Pattern
+	for i, c := range tuningPatches {
+		u0, v0, u1, v1 := patchRect(i)
+		p.Rects = append(p.Rects, PatternRect{X: u0, Y: v0, W: u1 - u0, H: v1 - v0, Color: effectColor{c.R, c.G, c.B}})
+	}
+	return p
+}
+
+// patchStats are measured colors of a patch in the camera frame.
+type patchStats struct {
+	Mean    [3]float64
+	Clipped float64
+}
+
+// measurePatches samples the center of each patch within the screen area of the frame.
+func measurePatches(frame *image.RGBA, q Quad) []patchStats {
+	const samples = 8
+	stats := make([]patchStats, len(tuningPatches))
+	for i := range tuningPatches {
+		u0, v0, u1, v1 := patchRect(i)
+		// skip borders, they are blurred with neighbouring patches
+		du, dv := (u1-u0)*0.2, (v1-v0)*0.2
+		n, clipped := 0, 0
+		for x := 0; x < samples; x++ {
+			for y := 0; y < samples; y++ {
+				pt := q.Map(u0+du+(u1-u0-2*du)*float64(x)/(samples-1), v0+dv+(v1-v0-2*dv)*float64(y)/(samples-1))
+				if !pt.In(frame.Rect) {
+					continue
+				}
+				c := frame.RGBAAt(pt.X, pt.Y)
+				stats[i].Mean[0] += float64(c.R)
+				stats[i].Mean[1] += float64(c.G)
+				stats[i].Mean[2] += float64(c.B)
+				if c.R >= 254 || c.G >= 254 || c.B >= 254 {
+					clipped++
+				}
+				n++
+			}
+		}
+		if n > 0 {
+			for ch := range stats[i].Mean {
+				stats[i].Mean[ch] /= float64(n)
+			}
+			stats[i].Clipped = float64(clipped) / float64(n)
+		}
+	}
+	return stats
+}
+
+// separation returns the smallest distance between colors of any two patches.
+func separation(stats []patchStats) float64 {
+	min := math.Inf(1)
+	for i := range stats {
+		for j := i + 1; j < len(stats); j++ {
+			var d float64
+			for ch := range stats[i].Mean {
+				diff := stats[i].Mean[ch] - stats[j].Mean[ch]
+				d += diff * diff
+			}
+			min = math.Min(min, math.Sqrt(d))
+		}
+	}
+	return min
+}
+
+// TuningResult describes the best camera settings found.
+type TuningResult struct {
+	Camera     CameraConfig
+	Separation float64
+}
+
+// tuneExposure captures the patches with all candidate settings and returns the ones
+// which don't clip any patch and separate them the best.
+func tuneExposure(ctx context.Context, cam TuningCamera, base CameraConfig, q Quad) (*TuningResult, error) {
+	var best *TuningResult
+	for _, iso := range tuningISOs {
+		for _, shutter := range tuningShutterSpeeds {
+			c := base
+			c.Exposure = "off"
+			c.Locked = false
+			c.ISO = iso
+			c.ShutterSpeed = shutter
+			frame, err := cam.Capture(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			stats := measurePatches(frame, q)
+			clipped := false
+			for _, s := range stats {
+				if s.Clipped > clippedFraction {
+					clipped = true
+				}
+			}
+			if clipped {
+				// longer exposures would clip even more
+				break
+			}
+			// noisier settings have to be clearly better to be picked
+			if sep := separation(stats); best == nil || sep > best.Separation*1.05 {
+				best = &TuningResult{Camera: c, Separation: sep}
+			}
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("all exposure settings clip, lower brightness of the screen")
+	}
+	return best, nil
+}
+
+// piTuningCamera restarts the camera with each of the tuned settings.
+type piTuningCamera struct {
+	mu     sync.Mutex
+	camera *piCamera.PiCamera
+}
+
+// tuningSkipFrames is amount of frames dropped after the camera starts, until the sensor settles.
+const tuningSkipFrames = 10
+
+func (t *piTuningCamera) Capture(ctx context.Context, c CameraConfig) (*image.RGBA, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+	camera, err := startCamera(c)
+	if err != nil {
+		return nil, err
+	}
+	t.camera = camera
+	var frame []byte
+	for i := 0; i <= tuningSkipFrames; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if frame, err = camera.GetFrame(); err != nil {
+			return nil, err
+		}
+	}
+	return decodeFrame(frame)
+}
+
+func (t *piTuningCamera) stop() {
+	if t.camera != nil {
+		t.camera.Stop()
+		t.camera = nil
+	}
+}
+
+// Close stops the camera.
+func (t *piTuningCamera) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+}
+
+func encodeJpeg(img image.Image) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := jpeg.Encode(buffer, img, &jpeg.Options{Quality: 95}); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
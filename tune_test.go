@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+// fakeTuningCamera renders the tuning pattern brighter with longer exposure and higher iso.
+type fakeTuningCamera struct {
+	quad Quad
+	// screen is brightness of the screen, 1 fills the range with iso 100 and 8ms shutter
+	screen   float64
+	err      error
+	captured []CameraConfig
+}
+
+func (f *fakeTuningCamera) Capture(ctx context.Context, c CameraConfig) (*image.RGBA, error) {
+	f.captured = append(f.captured, c)
+	if f.err != nil {
+		return nil, f.err
+	}
+	gain := f.screen * float64(c.ISO) / 100 * float64(c.ShutterSpeed) / 8000
+	frame := image.NewRGBA(image.Rect(0, 0, 120, 80))
+	for i, p := range tuningPatches {
+		u0, v0, u1, v1 := patchRect(i)
+		r := image.Rectangle{f.quad.Map(u0, v0), f.quad.Map(u1, v1)}
+		ch := func(v uint8) uint8 {
+			return uint8(math.Min(255, float64(v)*gain))
+		}
+		c := color.RGBA{ch(p.R), ch(p.G), ch(p.B), 255}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				frame.SetRGBA(x, y, c)
+			}
+		}
+	}
+	return frame, nil
+}
+
+func TestTuneExposure(t *testing.T) {
+	q := Quad{image.Pt(0, 0), image.Pt(120, 0), image.Pt(120, 80), image.Pt(0, 80)}
+	for _, tc := range []struct {
+		name     string
+		screen   float64
+		iso      int
+		shutter  int
+		captures int
+	}{
+		// white clips at full gain, iso 200 with the same gain isn't better
+		{"bright screen", 1, 100, 4000, 7},
+		// iso 100 with the longest shutter is close to the best of noisier settings
+		{"dim screen", 0.2, 100, 33000, 5 + 5 + 4 + 3},
+		// only the highest iso reaches the range
+		{"dark screen", 0.02, 800, 33000, 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cam := &fakeTuningCamera{quad: q, screen: tc.screen}
+			base := DefaultCameraConfig()
+			base.Locked = true
+			res, err := tuneExposure(context.Background(), cam, base, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Camera.ISO != tc.iso || res.Camera.ShutterSpeed != tc.shutter {
+				t.Errorf("picked iso %d shutter %d, want %d, %d", res.Camera.ISO, res.Camera.ShutterSpeed, tc.iso, tc.shutter)
+			}
+			if res.Camera.Exposure != "off" || res.Camera.Locked || res.Camera.Width != base.Width {
+				t.Errorf("picked settings %+v don't fix exposure of the base settings", res.Camera)
+			}
+			if len(cam.captured) != tc.captures {
+				t.Errorf("captured %d frames, want %d", len(cam.captured), tc.captures)
+			}
+			// black and the darkest gray are the closest patches
+			gain := tc.screen * float64(tc.iso) / 100 * float64(tc.shutter) / 8000
+			want := math.Sqrt(3) * math.Floor(32*gain)
+			if math.Abs(res.Separation-want) > 1e-9 {
+				t.Errorf("separation is %g, want %g", res.Separation, want)
+			}
+		})
+	}
+}
+
+func TestTuneExposureFails(t *testing.T) {
+	q := Quad{image.Pt(0, 0), image.Pt(120, 0), image.Pt(120, 80), image.Pt(0, 80)}
+	cam := &fakeTuningCamera{quad: q, screen: 10}
+	_, err := tuneExposure(context.Background(), cam, DefaultCameraConfig(), q)
+	if err == nil || !strings.Contains(err.Error(), "all exposure settings clip") {
+		t.Errorf("error is %v, want clipping error", err)
+	}
+	// only the shortest shutter of each iso is tried
+	if len(cam.captured) != len(tuningISOs) {
+		t.Errorf("captured %d frames, want %d", len(cam.captured), len(tuningISOs))
+	}
+	failing := errors.New("camera failed")
+	cam = &fakeTuningCamera{quad: q, screen: 1, err: failing}
+	if _, err := tuneExposure(context.Background(), cam, DefaultCameraConfig(), q); err != failing {
+		t.Errorf("error is %v, want error of the camera", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"net"
+)
+
+const (
+	WLEDPort = 21324
+	// DefaultWLEDTimeout is amount of seconds WLED waits for the next packet before it returns to normal mode.
+	DefaultWLEDTimeout = 2
+
+	wledWARLS = 1
+	wledDRGB  = 2
+	wledDNRGB = 4
+
+	wledMaxWARLS = 255
+	wledMaxDRGB  = 490
+	wledMaxDNRGB = 489
+)
+
+var wledModes = map[string]byte{
+	"warls": wledWARLS,
+	"drgb":  wledDRGB,
+	"dnrgb": wledDNRGB,
+}
+
+// WLEDConfig describes device running WLED firmware receiving colors over realtime UDP.
+type WLEDConfig struct {
+	// Address of the device, port is optional.
+	Address string `json:"address"`
+	// Mode is a realtime protocol: warls, drgb or dnrgb.
+	Mode string `json:"mode,omitempty"`
+	// Timeout in seconds after which WLED returns to its own effects, 255 disables the timeout.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (c *WLEDConfig) Validate(amountOfLeds int) error {
+	if c.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	mode, ok := wledModes[c.protocol()]
+	if !ok {
+		return fmt.Errorf("unknown wled mode %q", c.Mode)
+	}
+	if mode == wledWARLS && amountOfLeds > wledMaxWARLS {
+		return fmt.Errorf("warls mode supports at most %d leds, use dnrgb instead", wledMaxWARLS)
+	}
+	if c.Timeout < 0 || c.Timeout > 255 {
+		return fmt.Errorf("timeout %d is out of range (0-255)", c.Timeout)
+	}
+	return nil
+}
+
+func (c *WLEDConfig) protocol() string {
+	if c.Mode == "" {
+		return "drgb"
+	}
+	return c.Mode
+}
+
+// WLEDLed sends colors to WLED using its realtime UDP protocols.
+// Strips longer than a single DRGB packet are sent in DNRGB chunks.
+type WLEDLed struct {
+	conn    *net.UDPConn
+	count   int
+	mode    byte
+	timeout byte
+}
+
+func NewWLEDLed(c *WLEDConfig, amountOfLeds int) (*WLEDLed, error) {
+	if err := c.Validate(amountOfLeds); err != nil {
+		return nil, err
+	}
+	addr, err := resolveUDPAddr(c.Address, WLEDPort)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	led := &WLEDLed{conn: conn, count: amountOfLeds, mode: wledModes[c.protocol()], timeout: byte(c.Timeout)}
+	if led.timeout == 0 {
+		led.timeout = DefaultWLEDTimeout
+	}
+	if led.mode == wledDRGB && amountOfLeds > wledMaxDRGB {
+		led.mode = wledDNRGB
+	}
+	return led, nil
+}
+
+// wledPackets returns packets with colors of all leds in the given mode.
+func wledPackets(mode, timeout byte, colors []color.RGBA) [][]byte {
+	var packets [][]byte
+	switch mode {
+	case wledWARLS:
+		p := make([]byte, 2, 2+len(colors)*4)
+		p[0], p[1] = wledWARLS, timeout
+		for i, c := range colors {
+			p = append(p, byte(i), c.R, c.G, c.B)
+		}
+		packets = append(packets, p)
+	case wledDRGB:
+		p := make([]byte, 2, 2+len(colors)*3)
+		p[0], p[1] = wledDRGB, timeout
+		for _, c := range colors {
+			p = append(p, c.R, c.G, c.B)
+		}
+		packets = append(packets, p)
+	case wledDNRGB:
+		for start := 0; start < len(colors); start += wledMaxDNRGB {
+			end := start + wledMaxDNRGB
+			if end > len(colors) {
+				end = len(colors)
+			}
+			p := make([]byte, 4, 4+(end-start)*3)
+			p[0], p[1], p[2], p[3] = wledDNRGB, timeout, byte(start>>8), byte(start)
+			for _, c := range colors[start:end] {
+				p = append(p, c.R, c.G, c.B)
+			}
+			packets = append(packets, p)
+		}
+	}
+	return packets
+}
+
+func (led *WLEDLed) Len() int {
+	return led.count
+}
+
+func (led *WLEDLed) Write(colors []color.RGBA) error {
+	if len(colors) > led.count {
+		return fmt.Errorf("received %d colors for %d leds", len(colors), led.count)
+	}
+	for _, p := range wledPackets(led.mode, led.timeout, colors) {
+		if _, err := led.conn.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (led *WLEDLed) Close() error {
+	return led.conn.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+)
+
+// rgbBytes returns colors as consecutive channels.
+func rgbBytes(colors []color.RGBA) []byte {
+	var b []byte
+	for _, c := range colors {
+		b = append(b, c.R, c.G, c.B)
+	}
+	return b
+}
+
+func TestWLEDPackets(t *testing.T) {
+	colors := testColors(1000)
+	for _, tc := range []struct {
+		name   string
+		conf   WLEDConfig
+		leds   int
+		header [][]byte
+		chunks [][2]int
+	}{
+		{
+			name:   "drgb by default",
+			conf:   WLEDConfig{},
+			leds:   3,
+			header: [][]byte{{wledDRGB, DefaultWLEDTimeout}},
+			chunks: [][2]int{{0, 3}},
+		},
+		{
+			name:   "largest drgb",
+			conf:   WLEDConfig{Mode: "drgb", Timeout: 255},
+			leds:   wledMaxDRGB,
+			header: [][]byte{{wledDRGB, 255}},
+			chunks: [][2]int{{0, wledMaxDRGB}},
+		},
+		{
+			name:   "long drgb strip is sent as dnrgb",
+			conf:   WLEDConfig{Mode: "drgb", Timeout: 5},
+			leds:   wledMaxDRGB + 1,
+			header: [][]byte{{wledDNRGB, 5, 0, 0}, {wledDNRGB, 5, 489 >> 8, 489 & 0xff}},
+			chunks: [][2]int{{0, 489}, {489, 491}},
+		},
+		{
+			name:   "dnrgb chunks",
+			conf:   WLEDConfig{Mode: "dnrgb"},
+			leds:   1000,
+			header: [][]byte{{wledDNRGB, 2, 0, 0}, {wledDNRGB, 2, 0x01, 0xe9}, {wledDNRGB, 2, 0x03, 0xd2}},
+			chunks: [][2]int{{0, 489}, {489, 978}, {978, 1000}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, addr := listenLoopback(t)
+			defer conn.Close()
+			tc.conf.Address = addr
+			led, err := NewWLEDLed(&tc.conf, tc.leds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer led.Close()
+			if err := led.Write(colors[:tc.leds]); err != nil {
+				t.Fatal(err)
+			}
+			for i, p := range receivePackets(t, conn, len(tc.header)) {
+				want := append(append([]byte(nil), tc.header[i]...), rgbBytes(colors[tc.chunks[i][0]:tc.chunks[i][1]])...)
+				if !bytes.Equal(p, want) {
+					t.Errorf("packet %d is % x\nwant % x", i, p, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWLEDWARLSPacket(t *testing.T) {
+	colors := []color.RGBA{{1, 2, 3, 255}, {4, 5, 6, 255}}
+	packets := wledPackets(wledWARLS, 7, colors)
+	want := []byte{wledWARLS, 7, 0, 1, 2, 3, 1, 4, 5, 6}
+	if len(packets) != 1 || !bytes.Equal(packets[0], want) {
+		t.Errorf("packets are % x, want % x", packets, want)
+	}
+}
+
+func TestWLEDConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conf WLEDConfig
+		leds int
+		ok   bool
+	}{
+		{"valid", WLEDConfig{Address: "wled.local"}, 1000, true},
+		{"missing address", WLEDConfig{}, 1, false},
+		{"unknown mode", WLEDConfig{Address: "wled.local", Mode: "rgb"}, 1, false},
+		{"warls limit", WLEDConfig{Address: "wled.local", Mode: "warls"}, wledMaxWARLS, true},
+		{"too long for warls", WLEDConfig{Address: "wled.local", Mode: "warls"}, wledMaxWARLS + 1, false},
+		{"timeout out of range", WLEDConfig{Address: "wled.local", Timeout: 256}, 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.conf.Validate(tc.leds); (err == nil) != tc.ok {
+				t.Errorf("error is %v, want valid %t", err, tc.ok)
+			}
+		})
+	}
+}